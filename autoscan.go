@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// Autoscan samples sources to work out the type and range of each field, and
+// proposes a MapperConfig for them.
+type Autoscan struct {
+	URLFile string
+	Sources []string
+	// SampleSize is the number of lines read from the start of each source.
+	SampleSize int
+	// Output is where the proposed config is written, stdout if empty.
+	Output string
+	// Stats, if set, gets a table of the statistics of every field.
+	Stats io.Writer
+
+	recordManager *RecordManager
+}
+
+// NewAutoscan returns an Autoscan with default settings.
+func NewAutoscan() *Autoscan {
+	return &Autoscan{
+		SampleSize:    10000,
+		Stats:         os.Stderr,
+		recordManager: NewRecordManager(),
+	}
+}
+
+// runAutoscan runs the autoscan command with the given arguments.
+func runAutoscan(args []string) error {
+	a := NewAutoscan()
+	fs := flag.NewFlagSet("autoscan", flag.ExitOnError)
+	fs.StringVar(&a.URLFile, "urls", "", "file listing the sources to sample")
+	fs.IntVar(&a.SampleSize, "n", a.SampleSize, "number of lines to sample from each source")
+	fs.StringVar(&a.Output, "o", "", "file to write the proposed mapper config to (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s autoscan [flags] [source ...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	a.Sources = fs.Args()
+	return a.Run()
+}
+
+// Run samples the sources and writes the proposed config.
+func (a *Autoscan) Run() error {
+	m := &Main{URLFile: a.URLFile, Sources: a.Sources}
+	if err := m.readURLs(); err != nil {
+		return err
+	}
+	scan := newFieldScan()
+	for _, src := range m.urls {
+		if err := a.sample(src, scan); err != nil {
+			return err
+		}
+	}
+	if scan.rows == 0 {
+		return fmt.Errorf("no rows sampled")
+	}
+	if a.Stats != nil {
+		scan.printStats(a.Stats)
+	}
+
+	config := scan.propose()
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+	if a.Output == "" {
+		_, err = os.Stdout.Write(content)
+		return err
+	}
+	return ioutil.WriteFile(a.Output, content, 0644)
+}
+
+// sample adds up to SampleSize lines of src to scan.
+func (a *Autoscan) sample(src Source, scan *fieldScan) error {
+	typ := src.Type
+	if typ == 0 {
+		typ = guessCabType(src.URL)
+	}
+	content, err := a.recordManager.open(src)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	lines := a.recordManager.newLineReader(src, content)
+	header, err := lines.ReadLine()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("reading %s", src))
+	}
+	schema, err := checkSourceHeader(src, typ, header)
+	if err != nil {
+		return err
+	}
+	if schema == nil {
+		log.Printf("skipping %s, its schema is unknown", src)
+		return nil
+	}
+	for n := 0; n < a.SampleSize; n++ {
+		line, err := lines.ReadLine()
+		if err == io.EOF {
+			break
+		} else if err == errLineTooLong {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("reading %s", src))
+		}
+		scan.add(schema, strings.Split(line, ","))
+	}
+	return nil
+}
+
+// fieldStats accumulates what is known about the values of a field.
+type fieldStats struct {
+	name     string
+	count    int
+	empty    int
+	notInt   int
+	notFloat int
+	notTime  int
+	// values are the numeric values, or the unix times for times.
+	values []float64
+	sorted bool
+}
+
+func (s *fieldStats) add(v string) {
+	if v == "" {
+		s.empty++
+		return
+	}
+	s.count++
+	if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+		s.notInt++
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		s.notFloat++
+	}
+	t, ok := parseDateTime(v)
+	if !ok {
+		s.notTime++
+	}
+	switch {
+	case err == nil:
+		s.addValue(f)
+	case ok:
+		s.addValue(float64(t.Unix()))
+	}
+}
+
+// addValue records a numeric value.
+func (s *fieldStats) addValue(f float64) {
+	s.values = append(s.values, f)
+	s.sorted = false
+}
+
+// kind is the type most values of the field have: int, float, time or
+// string. Up to 1% of the values may fail to convert.
+func (s *fieldStats) kind() string {
+	tolerance := s.count / 100
+	switch {
+	case s.count == 0:
+		return "string"
+	case s.notInt <= tolerance:
+		return "int"
+	case s.notFloat <= tolerance:
+		return "float"
+	case s.notTime <= tolerance:
+		return "time"
+	}
+	return "string"
+}
+
+// quantile returns the value below which a fraction q of the values lie.
+func (s *fieldStats) quantile(q float64) float64 {
+	if len(s.values) == 0 {
+		return math.NaN()
+	}
+	if !s.sorted {
+		sort.Float64s(s.values)
+		s.sorted = true
+	}
+	i := int(q * float64(len(s.values)-1))
+	return s.values[i]
+}
+
+// fieldScan collects the statistics of the fields shared by all schemas,
+// plus the derived values, from sampled rows.
+type fieldScan struct {
+	rows   int
+	order  []string
+	fields map[string]*fieldStats
+	common map[*Schema][]string
+}
+
+func newFieldScan() *fieldScan {
+	return &fieldScan{
+		fields: make(map[string]*fieldStats),
+		common: make(map[*Schema][]string),
+	}
+}
+
+func (s *fieldScan) stats(name string) *fieldStats {
+	st, ok := s.fields[name]
+	if !ok {
+		st = &fieldStats{name: name}
+		s.fields[name] = st
+		s.order = append(s.order, name)
+	}
+	return st
+}
+
+// commonFields returns the field names present in every schema, in the
+// order of the columns of schema.
+func commonFields(schema *Schema) []string {
+	names := make([]string, 0, len(schema.Fields))
+	for name := range schema.Fields {
+		common := true
+		for _, other := range schemas {
+			if _, ok := other.Fields[name]; !ok {
+				common = false
+			}
+		}
+		if common {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return schema.Fields[names[i]] < schema.Fields[names[j]] })
+	return names
+}
+
+func (s *fieldScan) add(schema *Schema, values []string) {
+	s.rows++
+	common, ok := s.common[schema]
+	if !ok {
+		common = commonFields(schema)
+		s.common[schema] = common
+	}
+	for _, name := range common {
+		if i := schema.Fields[name]; i < len(values) {
+			s.stats(name).add(values[i])
+		}
+	}
+
+	// the derived values, where the fields they need are valid
+	field := func(name string) string {
+		if i := schema.Fields[name]; i < len(values) {
+			return values[i]
+		}
+		return ""
+	}
+	pickup, ok1 := parseDateTime(field("pickup_datetime"))
+	drop, ok2 := parseDateTime(field("dropoff_datetime"))
+	if !ok1 || !ok2 {
+		return
+	}
+	duration := derivedFuncs["duration_minutes"](pickup, drop).(float64)
+	s.stats("duration_minutes").count++
+	s.stats("duration_minutes").addValue(duration)
+	if dist, err := strconv.ParseFloat(field("trip_distance"), 64); err == nil && duration > 0 {
+		speed := derivedFuncs["speed_mph"](pickup, drop, dist).(float64)
+		s.stats("speed_mph").count++
+		s.stats("speed_mph").addValue(speed)
+	}
+}
+
+// derivedFields are the derived values autoscan proposes frames for, along
+// with the fields their functions take and how to parse them.
+var derivedFields = map[string]struct{ fields, parsers []string }{
+	"duration_minutes": {[]string{"pickup_datetime", "dropoff_datetime"}, []string{"time", "time"}},
+	"speed_mph":        {[]string{"pickup_datetime", "dropoff_datetime", "trip_distance"}, []string{"time", "time", "float"}},
+}
+
+func (s *fieldScan) printStats(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "field\ttype\tvalues\tempty\tmin\tp1\tp50\tp99\tmax\t\n")
+	for _, name := range s.order {
+		st := s.fields[name]
+		kind := st.kind()
+		if _, ok := derivedFields[name]; ok {
+			kind = "derived"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.6g\t%.6g\t%.6g\t%.6g\t%.6g\t\n", name, kind, st.count, st.empty,
+			st.quantile(0), st.quantile(0.01), st.quantile(0.5), st.quantile(0.99), st.quantile(1))
+	}
+	tw.Flush()
+}
+
+// propose suggests a frame for every field autoscan knows how to map:
+//   - times get time of day, day of week, day of month, month and year frames
+//   - longitude and latitude pairs get a 100x100 grid over the middle 98% of
+//     the points
+//   - small non-negative ints are mapped as they are
+//   - other numbers get bins of about 1 unit over the middle 98% of their
+//     values, or bins holding a tenth of the values each if the values are
+//     bunched up at one end
+func (s *fieldScan) propose() *MapperConfig {
+	config := &MapperConfig{}
+	add := func(frame string, fields []string, parser string, mapper MapperSpec) {
+		config.Frames = append(config.Frames, FrameConfig{Frame: frame, Fields: fields, Parser: parser, Mapper: mapper})
+	}
+	gridded := make(map[string]bool)
+	for _, name := range s.order {
+		st := s.fields[name]
+		if d, ok := derivedFields[name]; ok {
+			config.Frames = append(config.Frames, FrameConfig{Frame: name, Fields: d.fields, Parsers: d.parsers, Func: name, Mapper: st.floatSpec()})
+			continue
+		}
+		if gridded[name] {
+			continue
+		}
+		switch kind := st.kind(); kind {
+		case "time":
+			base := strings.TrimSuffix(name, "_datetime")
+			add(base+"_time", []string{name}, kind, MapperSpec{Type: "time_of_day", Res: 48})
+			add(base+"_day", []string{name}, kind, MapperSpec{Type: "day_of_week"})
+			add(base+"_mday", []string{name}, kind, MapperSpec{Type: "day_of_month"})
+			add(base+"_month", []string{name}, kind, MapperSpec{Type: "month"})
+			add(base+"_year", []string{name}, kind, MapperSpec{Type: "year"})
+		case "int", "float":
+			if strings.HasSuffix(name, "_longitude") {
+				base := strings.TrimSuffix(name, "_longitude")
+				if lat, ok := s.fields[base+"_latitude"]; ok && lat.kind() != "string" && lat.kind() != "time" {
+					add(base+"_grid_id", []string{name, base + "_latitude"}, "float", gridSpecFor(st, lat))
+					gridded[base+"_latitude"] = true
+					continue
+				}
+			}
+			min, max := st.quantile(0), st.quantile(1)
+			if kind == "int" && min >= 0 && max <= 100 {
+				add(name, []string{name}, kind, MapperSpec{Type: "int", Min: min, Max: max})
+				continue
+			}
+			add(name, []string{name}, "float", st.floatSpec())
+		default:
+			log.Printf("autoscan: not mapping %s, it holds strings", name)
+		}
+	}
+	return config
+}
+
+// floatSpec proposes a mapper for the numeric values of s.
+func (s *fieldStats) floatSpec() MapperSpec {
+	p1, p50, p99 := s.quantile(0.01), s.quantile(0.5), s.quantile(0.99)
+	if p99 > p1 && (p50-p1 < (p99-p1)/5 || p99-p50 < (p99-p1)/5) {
+		// bunched up at one end: use deciles, ending at the extremes
+		buckets := []float64{}
+		for q := 0; q <= 10; q++ {
+			b := s.quantile(float64(q) / 10)
+			if len(buckets) == 0 || b > buckets[len(buckets)-1] {
+				buckets = append(buckets, b)
+			}
+		}
+		if len(buckets) >= 2 {
+			return MapperSpec{Type: "float_buckets", Buckets: buckets}
+		}
+	}
+	min, max := math.Floor(p1), math.Ceil(p99)
+	if max <= min {
+		max = min + 1
+	}
+	res := math.Max(10, math.Min(1000, max-min))
+	return MapperSpec{Type: "linear_float", Min: min, Max: max, Res: res}
+}
+
+// gridSpecFor proposes a grid over the middle 98% of the points. Points at 0
+// are missing locations and are left out.
+func gridSpecFor(lon, lat *fieldStats) MapperSpec {
+	bounds := func(s *fieldStats) (float64, float64) {
+		nonzero := &fieldStats{}
+		for _, v := range s.values {
+			if v != 0 {
+				nonzero.values = append(nonzero.values, v)
+			}
+		}
+		if len(nonzero.values) == 0 {
+			return 0, 1
+		}
+		min, max := nonzero.quantile(0.01), nonzero.quantile(0.99)
+		if max <= min {
+			max = min + 1
+		}
+		return min, max
+	}
+	xmin, xmax := bounds(lon)
+	ymin, ymax := bounds(lat)
+	return MapperSpec{Type: "grid", Xmin: xmin, Xmax: xmax, Xres: 100, Ymin: ymin, Ymax: ymax, Yres: 100}
+}
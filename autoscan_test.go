@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoscan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var content strings.Builder
+	content.WriteString("VendorID,tpep_pickup_datetime,tpep_dropoff_datetime,passenger_count,trip_distance,pickup_longitude,pickup_latitude,RateCodeID,store_and_fwd_flag,dropoff_longitude,dropoff_latitude,payment_type,fare_amount,extra,mta_tax,tip_amount,tolls_amount,improvement_surcharge,total_amount\n")
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 1000; i++ {
+		pickup := start.Add(time.Duration(i) * 7 * time.Minute)
+		drop := pickup.Add(time.Duration(5+i%30) * time.Minute)
+		fmt.Fprintf(&content, "%d,%s,%s,%d,%.2f,%.6f,%.6f,1,N,%.6f,%.6f,1,%.1f,0,0.5,1,0,0.3,%.2f\n",
+			1+i%2, pickup.Format(defaultTimeLayout), drop.Format(defaultTimeLayout), 1+i%6, float64(i%20)/2,
+			-74.0+float64(i%100)/1000, 40.7+float64(i%50)/1000, -73.9, 40.8, float64(5+i%40), float64(7+i%40)+0.3)
+	}
+	path := filepath.Join(dir, "yellow_tripdata_2015-01.csv")
+	if err := ioutil.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAutoscan()
+	a.Sources = []string{path}
+	a.SampleSize = 500
+	a.Output = filepath.Join(dir, "frames.json")
+	a.Stats = ioutil.Discard
+	if err := a.Run(); err != nil {
+		t.Fatal(err)
+	}
+	config, err := readMapperConfig(a.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := make(map[string]FrameConfig)
+	for _, fc := range config.Frames {
+		frames[fc.Frame] = fc
+	}
+	if fc := frames["passenger_count"]; fc.Parser != "int" || fc.Mapper.Type != "int" || fc.Mapper.Min != 1 || fc.Mapper.Max != 6 {
+		t.Errorf("unexpected passenger_count frame %+v", fc)
+	}
+	if fc := frames["pickup_day"]; fc.Parser != "time" || fc.Mapper.Type != "day_of_week" {
+		t.Errorf("unexpected pickup_day frame %+v", fc)
+	}
+	if fc := frames["pickup_grid_id"]; fc.Mapper.Type != "grid" || fc.Mapper.Xmin < -74.0 || fc.Mapper.Xmax > -73.9 || fc.Mapper.Ymin < 40.7 || fc.Mapper.Ymax > 40.75 {
+		t.Errorf("unexpected pickup_grid_id frame %+v", fc)
+	}
+	if fc := frames["duration_minutes"]; fc.Func != "duration_minutes" || fc.Mapper.Type != "linear_float" || fc.Mapper.Min != 5 || fc.Mapper.Max != 34 {
+		t.Errorf("unexpected duration_minutes frame %+v", fc)
+	}
+	if fc := frames["total_amount"]; fc.Parser != "float" || fc.Mapper.Type != "linear_float" {
+		t.Errorf("unexpected total_amount frame %+v", fc)
+	}
+	for _, name := range []string{"store_and_fwd_flag", "pickup_latitude", "improvement_surcharge"} {
+		if _, ok := frames[name]; ok {
+			t.Errorf("unexpected frame %s", name)
+		}
+	}
+}
+
+func TestFieldStatsKind(t *testing.T) {
+	for _, test := range []struct {
+		values []string
+		kind   string
+	}{
+		{[]string{"1", "2", "", "30"}, "int"},
+		{[]string{"1", "2.5", "-3e2"}, "float"},
+		{[]string{"2015-01-01 00:00:00", "2015-12-31 23:59:59"}, "time"},
+		{[]string{"CASH", "CREDIT", "1"}, "string"},
+		{[]string{""}, "string"},
+	} {
+		st := &fieldStats{}
+		for _, v := range test.values {
+			st.add(v)
+		}
+		if kind := st.kind(); kind != test.kind {
+			t.Errorf("%v: expected %s, got %s", test.values, test.kind, kind)
+		}
+	}
+}
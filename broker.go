@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Message is a message of a topic partition.
+type Message struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+}
+
+// Broker is the part of a partitioned message log, such as Kafka, the
+// Producer and Consumer use. It is satisfied by MemoryBroker, and clients of
+// real brokers can be adapted to it.
+type Broker interface {
+	// Publish appends msgs to their topics, each to the partition of its
+	// key.
+	Publish(msgs []Message) error
+	// Partitions returns the number of partitions of topic.
+	Partitions(topic string) (int, error)
+	// Fetch returns up to max messages of a partition from offset on,
+	// waiting up to wait for one if there are none yet.
+	Fetch(topic string, partition int, offset int64, max int, wait time.Duration) ([]Message, error)
+	// Commit stores offset as the next one group is to consume from a
+	// partition, and Committed returns it, 0 if none was committed yet.
+	Commit(group, topic string, partition int, offset int64) error
+	Committed(group, topic string, partition int) (int64, error)
+}
+
+// partitionFor returns the partition of n a message with key goes to.
+func partitionFor(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// MemoryBroker is a Broker keeping its topics in memory, standing in for a
+// real one in tests and single process pipelines. Topics are created with
+// DefaultPartitions partitions on first use.
+type MemoryBroker struct {
+	DefaultPartitions int
+
+	mu     sync.Mutex
+	topics map[string][][]Message
+	// offsets are the committed offsets by group, topic and partition.
+	offsets map[string]int64
+	// arrived is closed and replaced whenever messages are published.
+	arrived chan struct{}
+}
+
+// NewMemoryBroker returns an empty MemoryBroker creating topics with
+// partitions partitions.
+func NewMemoryBroker(partitions int) *MemoryBroker {
+	return &MemoryBroker{
+		DefaultPartitions: partitions,
+		topics:            make(map[string][][]Message),
+		offsets:           make(map[string]int64),
+		arrived:           make(chan struct{}),
+	}
+}
+
+// topic returns the partitions of name, creating them if needed. b.mu must
+// be held.
+func (b *MemoryBroker) topic(name string) [][]Message {
+	parts, ok := b.topics[name]
+	if !ok {
+		n := b.DefaultPartitions
+		if n < 1 {
+			n = 1
+		}
+		parts = make([][]Message, n)
+		b.topics[name] = parts
+	}
+	return parts
+}
+
+func (b *MemoryBroker) Publish(msgs []Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range msgs {
+		parts := b.topic(m.Topic)
+		m.Partition = partitionFor(m.Key, len(parts))
+		m.Offset = int64(len(parts[m.Partition]))
+		parts[m.Partition] = append(parts[m.Partition], m)
+	}
+	close(b.arrived)
+	b.arrived = make(chan struct{})
+	return nil
+}
+
+func (b *MemoryBroker) Partitions(topic string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.topic(topic)), nil
+}
+
+func (b *MemoryBroker) Fetch(topic string, partition int, offset int64, max int, wait time.Duration) ([]Message, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		parts := b.topic(topic)
+		if partition < 0 || partition >= len(parts) {
+			b.mu.Unlock()
+			return nil, fmt.Errorf("topic %s has no partition %d", topic, partition)
+		}
+		p := parts[partition]
+		if offset < 0 || offset > int64(len(p)) {
+			b.mu.Unlock()
+			return nil, fmt.Errorf("offset %d out of range for %s/%d", offset, topic, partition)
+		}
+		if offset < int64(len(p)) {
+			end := offset + int64(max)
+			if end > int64(len(p)) {
+				end = int64(len(p))
+			}
+			msgs := append([]Message(nil), p[offset:end]...)
+			b.mu.Unlock()
+			return msgs, nil
+		}
+		arrived := b.arrived
+		b.mu.Unlock()
+		select {
+		case <-arrived:
+		case <-timer.C:
+			return nil, nil
+		}
+	}
+}
+
+func (b *MemoryBroker) Commit(group, topic string, partition int, offset int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.offsets[fmt.Sprintf("%s/%s/%d", group, topic, partition)] = offset
+	return nil
+}
+
+func (b *MemoryBroker) Committed(group, topic string, partition int) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.offsets[fmt.Sprintf("%s/%s/%d", group, topic, partition)], nil
+}
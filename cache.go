@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Cache keeps local copies of remote trip files. Files are stored under the
+// sha256 of their content, and an index maps each url to its content along
+// with the ETag and Last-Modified the server reported. Cached copies are
+// revalidated with a conditional request before use, and the least recently
+// used files are evicted once the cache grows past MaxSize.
+type Cache struct {
+	Dir string
+	// MaxSize is the maximum total size of cached files in bytes, 0 for no
+	// limit.
+	MaxSize int64
+	// Offline serves only cached files and never touches the network.
+	Offline bool
+
+	fetcher *HTTPFetcher
+
+	mu    sync.Mutex
+	index map[string]*cacheEntry
+}
+
+// cacheEntry describes the cached copy of one url.
+type cacheEntry struct {
+	Hash         string    `json:"hash"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	LastUsed     time.Time `json:"last_used"`
+}
+
+// NewCache opens the cache in dir, creating it if needed. Downloads go
+// through fetcher.
+func NewCache(dir string, maxSize int64, fetcher *HTTPFetcher) (*Cache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		Dir:     dir,
+		MaxSize: maxSize,
+		fetcher: fetcher,
+		index:   make(map[string]*cacheEntry),
+	}
+	content, err := ioutil.ReadFile(c.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &c.index); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("reading cache index %s", c.indexPath()))
+		}
+	}
+	return c, nil
+}
+
+func (c *Cache) indexPath() string {
+	return filepath.Join(c.Dir, "index.json")
+}
+
+func (c *Cache) objectPath(hash string) string {
+	return filepath.Join(c.Dir, "objects", hash)
+}
+
+// Open returns the content of url, from the cache if the cached copy is
+// still current, and from the network otherwise. Content fetched from the
+// network is added to the cache once it has been read to the end. An entry
+// whose file has gone missing is dropped, so url is fetched afresh rather
+// than revalidated.
+func (c *Cache) Open(url string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	entry, ok := c.index[url]
+	if ok {
+		if _, err := os.Stat(c.objectPath(entry.Hash)); os.IsNotExist(err) {
+			log.Printf("cached copy of %s is missing, dropping it", url)
+			delete(c.index, url)
+			if err := c.saveIndex(); err != nil {
+				log.Printf("saving cache index, err: %v", err)
+			}
+			ok = false
+		}
+	}
+	var etag, lastModified string
+	if ok {
+		etag, lastModified = entry.ETag, entry.LastModified
+	}
+	c.mu.Unlock()
+
+	if c.Offline {
+		if !ok {
+			return nil, permanent(fmt.Errorf("%s is not cached", url))
+		}
+		return c.openCached(url)
+	}
+
+	body, err := c.fetcher.openIfChanged(url, etag, lastModified)
+	if err == errNotModified {
+		return c.openCached(url)
+	} else if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(c.Dir, "objects"), ".download-")
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &cachingReader{
+		cache: c,
+		url:   url,
+		body:  body,
+		tmp:   tmp,
+		hash:  sha256.New(),
+	}, nil
+}
+
+// openCached opens the cached copy of url and marks it as recently used.
+func (c *Cache) openCached(url string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.index[url]
+	if !ok {
+		return nil, fmt.Errorf("%s is not cached", url)
+	}
+	f, err := os.Open(c.objectPath(entry.Hash))
+	if err != nil {
+		return nil, err
+	}
+	entry.LastUsed = time.Now()
+	if err := c.saveIndex(); err != nil {
+		log.Printf("saving cache index, err: %v", err)
+	}
+	return f, nil
+}
+
+// add moves a completed download into the cache.
+func (c *Cache) add(url string, tmp string, entry *cacheEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmp, c.objectPath(entry.Hash)); err != nil {
+		return err
+	}
+	old, replaced := c.index[url]
+	c.index[url] = entry
+	if replaced && old.Hash != entry.Hash && !c.isUsed(old.Hash) {
+		os.Remove(c.objectPath(old.Hash))
+	}
+	c.evict(url)
+	return c.saveIndex()
+}
+
+// isUsed reports whether any url maps to the file stored under hash.
+func (c *Cache) isUsed(hash string) bool {
+	for _, entry := range c.index {
+		if entry.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// evict removes the least recently used files until the cache fits in
+// MaxSize. A file shared by several urls counts once, as recently as its most
+// recent use, and is removed along with all of them. The file for keep is
+// never removed.
+func (c *Cache) evict(keep string) {
+	if c.MaxSize <= 0 {
+		return
+	}
+	type object struct {
+		hash     string
+		size     int64
+		lastUsed time.Time
+		urls     []string
+	}
+	objects := make(map[string]*object)
+	var total int64
+	for url, entry := range c.index {
+		o, ok := objects[entry.Hash]
+		if !ok {
+			o = &object{hash: entry.Hash, size: entry.Size}
+			objects[entry.Hash] = o
+			total += entry.Size
+		}
+		if entry.LastUsed.After(o.lastUsed) {
+			o.lastUsed = entry.LastUsed
+		}
+		o.urls = append(o.urls, url)
+	}
+	lru := make([]*object, 0, len(objects))
+	for _, o := range objects {
+		lru = append(lru, o)
+	}
+	sort.Slice(lru, func(i, j int) bool {
+		return lru[i].lastUsed.Before(lru[j].lastUsed)
+	})
+
+	for _, o := range lru {
+		if total <= c.MaxSize {
+			break
+		}
+		if o.hash == c.index[keep].Hash {
+			continue
+		}
+		for _, url := range o.urls {
+			delete(c.index, url)
+		}
+		if err := os.Remove(c.objectPath(o.hash)); err != nil {
+			log.Printf("evicting %v from cache, err: %v", o.urls, err)
+		}
+		total -= o.size
+	}
+}
+
+// saveIndex writes the index to disk. c.mu must be held.
+func (c *Cache) saveIndex() error {
+	content, err := json.MarshalIndent(c.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.indexPath())
+}
+
+// cachingReader passes a download through to its reader while writing it to
+// a temporary file, which is added to the cache when the download completes.
+type cachingReader struct {
+	cache *Cache
+	url   string
+	body  *resumingReader
+	tmp   *os.File
+	hash  hash.Hash
+	size  int64
+	done  bool
+	err   error
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && r.err == nil {
+		if _, werr := r.tmp.Write(p[:n]); werr != nil {
+			r.err = werr
+		}
+		r.hash.Write(p[:n])
+		r.size += int64(n)
+	}
+	if err == io.EOF {
+		r.done = true
+	}
+	return n, err
+}
+
+// Close finishes the download. If it was read to the end, it is added to the
+// cache, otherwise it is thrown away.
+func (r *cachingReader) Close() error {
+	r.body.Close()
+	name := r.tmp.Name()
+	if err := r.tmp.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+	if !r.done || r.err != nil {
+		if r.err != nil {
+			log.Printf("not caching %s, err: %v", r.url, r.err)
+		}
+		os.Remove(name)
+		return nil
+	}
+	entry := &cacheEntry{
+		Hash:         hex.EncodeToString(r.hash.Sum(nil)),
+		Size:         r.size,
+		ETag:         r.body.etag,
+		LastModified: r.body.lastModified,
+		LastUsed:     time.Now(),
+	}
+	if err := r.cache.add(r.url, name, entry); err != nil {
+		os.Remove(name)
+		return errors.Wrap(err, fmt.Sprintf("caching %s", r.url))
+	}
+	return nil
+}
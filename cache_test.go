@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tripServer serves fixed files with ETags and counts full downloads.
+type tripServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	files     map[string]string
+	downloads map[string]int
+}
+
+func newTripServer(files map[string]string) *tripServer {
+	s := &tripServer{files: files, downloads: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		content, ok := s.files[r.URL.Path]
+		if ok && r.Header.Get("If-None-Match") == "" {
+			s.downloads[r.URL.Path]++
+		}
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	return s
+}
+
+func readCached(t *testing.T, c *Cache, url string) string {
+	body, err := c.Open(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	green := "VendorID,lpep_pickup_datetime\n2,2013-08-05 12:55:11\n"
+	ts := newTripServer(map[string]string{"/green_tripdata_2013-08.csv": green})
+	defer ts.Close()
+	url := ts.URL + "/green_tripdata_2013-08.csv"
+
+	c, err := NewCache(dir, 0, testHTTPFetcher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := readCached(t, c, url); content != green {
+		t.Fatalf("unexpected content %q", content)
+	}
+	if content := readCached(t, c, url); content != green {
+		t.Fatalf("unexpected cached content %q", content)
+	}
+	if ts.downloads["/green_tripdata_2013-08.csv"] != 1 {
+		t.Fatalf("expected 1 download, got %d", ts.downloads["/green_tripdata_2013-08.csv"])
+	}
+
+	// a cached copy gone missing is downloaded again instead of revalidated
+	if err := os.Remove(c.objectPath(c.index[url].Hash)); err != nil {
+		t.Fatal(err)
+	}
+	if content := readCached(t, c, url); content != green {
+		t.Fatalf("unexpected content after losing the cached copy %q", content)
+	}
+	if ts.downloads["/green_tripdata_2013-08.csv"] != 2 {
+		t.Fatalf("expected a second download, got %d", ts.downloads["/green_tripdata_2013-08.csv"])
+	}
+
+	// a partially read download is not cached
+	ts.files["/yellow_tripdata_2009-01.csv"] = strings.Repeat("x", 1<<16)
+	body, err := c.Open(ts.URL + "/yellow_tripdata_2009-01.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Read(make([]byte, 10))
+	body.Close()
+
+	// reopen the cache from disk and serve it without the network
+	ts.Close()
+	c, err = NewCache(dir, 0, testHTTPFetcher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Offline = true
+	if content := readCached(t, c, url); content != green {
+		t.Fatalf("unexpected offline content %q", content)
+	}
+	if _, err := c.Open(ts.URL + "/yellow_tripdata_2009-01.csv"); err == nil {
+		t.Fatalf("partial download should not be cached")
+	}
+	objects, _ := filepath.Glob(filepath.Join(dir, "objects", "*"))
+	if len(objects) != 1 {
+		t.Fatalf("expected 1 cached object, got %v", objects)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := newTripServer(map[string]string{
+		"/a.csv":      strings.Repeat("a", 100),
+		"/b.csv":      strings.Repeat("b", 100),
+		"/c.csv":      strings.Repeat("c", 100),
+		"/copy-a.csv": strings.Repeat("a", 100),
+	})
+	defer ts.Close()
+
+	c, err := NewCache(dir, 250, testHTTPFetcher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readCached(t, c, ts.URL+"/a.csv")
+	readCached(t, c, ts.URL+"/copy-a.csv")
+	readCached(t, c, ts.URL+"/b.csv")
+	// touch a, so b is the least recently used
+	readCached(t, c, ts.URL+"/a.csv")
+	readCached(t, c, ts.URL+"/c.csv")
+
+	c.Offline = true
+	for _, name := range []string{"/a.csv", "/copy-a.csv", "/c.csv"} {
+		if _, err := c.Open(ts.URL + name); err != nil {
+			t.Fatalf("%s should still be cached: %v", name, err)
+		}
+	}
+	if _, err := c.Open(ts.URL + "/b.csv"); err == nil {
+		t.Fatalf("b should have been evicted")
+	}
+	objects, _ := filepath.Glob(filepath.Join(dir, "objects", "*"))
+	if len(objects) != 2 {
+		t.Fatalf("expected 2 cached objects, got %v", objects)
+	}
+}
+
+func TestFetchOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	buf.WriteString("VendorID,lpep_pickup_datetime,Lpep_dropoff_datetime,Store_and_fwd_flag,RateCodeID,Pickup_longitude,Pickup_latitude,Dropoff_longitude,Dropoff_latitude,Passenger_count,Trip_distance,Fare_amount,Extra,MTA_tax,Tip_amount,Tolls_amount,Ehail_fee,Total_amount,Payment_type,Trip_type \n")
+	for i := 0; i < 10; i++ {
+		buf.WriteString("2,2013-08-05 12:55:11,2013-08-05 12:59:50,N,1,0,0,0,0,1,123.4,3.9,0,0,0,0,,3.9,2,,,\n")
+	}
+	ts := newTripServer(map[string]string{"/green_tripdata_2013-08.csv": buf.String()})
+	url := ts.URL + "/green_tripdata_2013-08.csv"
+
+	c, err := NewCache(dir, 0, testHTTPFetcher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readCached(t, c, url)
+	ts.Close()
+	c.Offline = true
+
+	rm := NewRecordManager()
+	rm.Cache = c
+	sources := make(chan Source, 1)
+	records := make(chan []Record, 100)
+	sources <- Source{URL: url}
+	close(sources)
+	rm.fetch(sources, records)
+	close(records)
+
+	n := 0
+	for batch := range records {
+		for _, rec := range batch {
+			if rec.Type != 'g' || rec.Schema != green2013Schema {
+				t.Fatalf("unexpected record %v", rec)
+			}
+			n++
+		}
+	}
+	if n != 10 {
+		t.Fatalf("expected 10 records, got %d", n)
+	}
+}
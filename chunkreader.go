@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// batcher collects records into batches of a fixed size.
+type batcher struct {
+	f       *RecordManager
+	records chan<- []Record
+	stop    <-chan struct{}
+	batch   []Record
+	bytes   int
+	sent    bool
+}
+
+func (f *RecordManager) newBatcher(records chan<- []Record, stop <-chan struct{}) *batcher {
+	return &batcher{
+		f:       f,
+		records: records,
+		stop:    stop,
+		batch:   make([]Record, 0, f.BatchSize),
+	}
+}
+
+// add appends rec to the current batch, sending it when it is full. It
+// returns false if the batch could not be sent because stop was closed.
+func (b *batcher) add(rec Record) bool {
+	b.batch = append(b.batch, rec)
+	b.bytes += len(rec.Val)
+	if len(b.batch) >= b.f.BatchSize {
+		return b.flush()
+	}
+	return true
+}
+
+// flush sends the current batch, if it is not empty.
+func (b *batcher) flush() bool {
+	if len(b.batch) == 0 {
+		return true
+	}
+	b.f.totalRecs.Add(len(b.batch))
+	b.f.readRecords.Add(len(b.batch))
+	b.f.AddBytes(b.bytes)
+	select {
+	case b.records <- b.batch:
+	case <-b.stop:
+		return false
+	}
+	b.sent = true
+	b.batch = make([]Record, 0, b.f.BatchSize)
+	b.bytes = 0
+	return true
+}
+
+// chunk is a byte range of a file along with the batches read from it.
+type chunk struct {
+	start, end int64
+	batches    chan []Record
+	err        error
+}
+
+// fetchChunks reads the lines of file between start and size in parallel.
+// The range is split into chunks of about ChunkSize bytes, each extended to
+// end on a line boundary, and up to ChunkConcurrency chunks are read at
+// once. Batches are sent to records in file order, numbering the records
+// as they go. It reports whether any batch was sent.
+func (f *RecordManager) fetchChunks(src Source, file *os.File, start, size int64, newRecord func(string) Record, records chan<- []Record) (bool, error) {
+	chunks := make([]*chunk, 0, (size-start)/f.ChunkSize+1)
+	for s := start; s < size; s += f.ChunkSize {
+		end := s + f.ChunkSize
+		if end > size {
+			end = size
+		}
+		chunks = append(chunks, &chunk{start: s, end: end, batches: make(chan []Record, 4)})
+	}
+
+	stop := make(chan struct{})
+	sem := make(chan struct{}, f.ChunkConcurrency)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, c := range chunks {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Add(1)
+			go func(c *chunk) {
+				defer wg.Done()
+				c.err = f.readChunk(src, file, c, start, newRecord, stop)
+				close(c.batches)
+				<-sem
+			}(c)
+		}
+	}()
+
+	sent := false
+	var err error
+	var seq uint64
+	for _, c := range chunks {
+		for batch := range c.batches {
+			for i := range batch {
+				batch[i].Seq = seq
+				seq++
+			}
+			records <- batch
+			sent = true
+		}
+		if c.err != nil {
+			err = c.err
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+	return sent, err
+}
+
+// readChunk reads every line that starts within c. Unless c starts at
+// first, the partial line it starts in belongs to the previous chunk and is
+// skipped.
+func (f *RecordManager) readChunk(src Source, file *os.File, c *chunk, first int64, newRecord func(string) Record, stop <-chan struct{}) error {
+	pos := c.start
+	if c.start > first {
+		// start one byte early, so a chunk that starts right after a newline
+		// doesn't skip its first line
+		pos = c.start - 1
+	}
+	lines := f.newLineReader(src, io.NewSectionReader(file, pos, 1<<62))
+	if pos != c.start {
+		if err := lines.skipLine(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	b := f.newBatcher(c.batches, stop)
+	for pos+lines.offset < c.end {
+		line, err := lines.ReadLine()
+		if err == io.EOF {
+			break
+		} else if err == errLineTooLong {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !b.add(newRecord(line)) {
+			return nil
+		}
+	}
+	b.flush()
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	header := "VendorID,tpep_pickup_datetime,tpep_dropoff_datetime,passenger_count,trip_distance,pickup_longitude,pickup_latitude,RateCodeID,store_and_fwd_flag,dropoff_longitude,dropoff_latitude,payment_type,fare_amount,extra,mta_tax,tip_amount,tolls_amount,improvement_surcharge,total_amount"
+	lines := make([]string, 0, 1000)
+	var content strings.Builder
+	content.WriteString(header + "\r\n")
+	for i := 0; i < 1000; i++ {
+		line := fmt.Sprintf("%d,2015-01-15 19:05:39,2015-01-15 19:23:42,1,%s", i, strings.Repeat("9", i%13))
+		lines = append(lines, line)
+		content.WriteString(line)
+		if i%2 == 0 {
+			content.WriteString("\r")
+		}
+		if i < 999 {
+			content.WriteString("\n")
+		}
+	}
+	path := filepath.Join(dir, "yellow_tripdata_2015-01.csv")
+	if err := ioutil.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunkSize := range []int64{47, 97, 4096, 1 << 20} {
+		rm := NewRecordManager()
+		rm.ChunkSize = chunkSize
+		rm.ChunkConcurrency = 4
+		rm.BatchSize = 7
+
+		sources := make(chan Source, 1)
+		records := make(chan []Record, 10)
+		sources <- Source{URL: path}
+		close(sources)
+		go func() {
+			rm.fetch(sources, records)
+			close(records)
+		}()
+
+		got := make([]string, 0, len(lines))
+		for batch := range records {
+			if len(batch) > rm.BatchSize {
+				t.Fatalf("batch of %d records is larger than %d", len(batch), rm.BatchSize)
+			}
+			for _, rec := range batch {
+				if rec.Schema != yellow2015Schema {
+					t.Fatalf("unexpected schema %v", rec.Schema)
+				}
+				got = append(got, rec.Val)
+			}
+		}
+		if len(got) != len(lines) {
+			t.Fatalf("chunk size %d: expected %d records, got %d", chunkSize, len(lines), len(got))
+		}
+		for i := range lines {
+			if got[i] != lines[i] {
+				t.Fatalf("chunk size %d: record %d is %q, expected %q", chunkSize, i, got[i], lines[i])
+			}
+		}
+		if rm.readRecords.Get() != int64(len(lines)) {
+			t.Fatalf("chunk size %d: counted %d records", chunkSize, rm.readRecords.Get())
+		}
+	}
+}
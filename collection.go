@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Collection is the part of a MongoDB collection CosmosWriter uses. It is
+// satisfied by *mgo.Collection, and by FakeCollection for tests.
+type Collection interface {
+	Insert(docs ...interface{}) error
+}
+
+// Errors as Cosmos DB returns them through the MongoDB API.
+var (
+	// errThrottled is returned when a request exceeds the provisioned
+	// throughput.
+	errThrottled = &mgo.LastError{Code: 16500, Err: "Request rate is large"}
+	// errDuplicate is returned for a document whose _id is already taken.
+	errDuplicate = &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}
+	// errTimeout is returned when the server doesn't answer in time.
+	errTimeout error = timeoutError{}
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// FakeCollection is an in-memory Collection. It keeps the documents
+// inserted into it, and can be scripted to fail inserts.
+type FakeCollection struct {
+	mu       sync.Mutex
+	docs     [][]byte
+	ids      map[interface{}]bool
+	errs     []error
+	attempts int
+}
+
+// NewFakeCollection returns an empty FakeCollection.
+func NewFakeCollection() *FakeCollection {
+	return &FakeCollection{ids: make(map[interface{}]bool)}
+}
+
+// Fail makes the next inserts fail with errs, one error per insert. A nil
+// error lets that insert through.
+func (c *FakeCollection) Fail(errs ...error) {
+	c.mu.Lock()
+	c.errs = append(c.errs, errs...)
+	c.mu.Unlock()
+}
+
+// Insert stores copies of docs, failing with the next scripted error if
+// there is one, or with a duplicate key error if a Ride's ID was inserted
+// before.
+func (c *FakeCollection) Insert(docs ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attempts++
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	for _, doc := range docs {
+		if ride, ok := doc.(*Ride); ok {
+			if c.ids[ride.ID] {
+				return errDuplicate
+			}
+			c.ids[ride.ID] = true
+		}
+		// docs may be reused once Insert returns, as rides are
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		c.docs = append(c.docs, data)
+	}
+	return nil
+}
+
+// Rides returns the rides inserted so far.
+func (c *FakeCollection) Rides() ([]Ride, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rides := make([]Ride, len(c.docs))
+	for i, data := range c.docs {
+		if err := bson.Unmarshal(data, &rides[i]); err != nil {
+			return nil, err
+		}
+	}
+	return rides, nil
+}
+
+// Attempts returns the number of calls to Insert so far.
+func (c *FakeCollection) Attempts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.attempts
+}
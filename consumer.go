@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Consumer feeds records into the import from Topic of a Broker instead of
+// from urls. Messages are CSV lines keyed by their schema, such as
+// "yellow-2015", or by the cab type alone for its default layout.
+//
+// Delivery is at least once. The offset of Group in a partition is committed
+// every CommitInterval and once the import is done, up to the first record
+// not yet written, skipped or filtered out. Records are written once
+// stored: sinks buffering them, such as Pilosa and Parquet, only settle
+// them when their buffers are flushed or files closed. A record that failed
+// to be written holds back the offset of its partition for the rest of the
+// run, so it and the records after it are consumed again next time.
+type Consumer struct {
+	Broker Broker
+	Topic  string
+	Group  string
+	// Follow keeps waiting for messages at the end of the topic instead of
+	// stopping there. Wait is how long a fetch waits for messages.
+	Follow         bool
+	Wait           time.Duration
+	CommitInterval time.Duration
+
+	// commitMu keeps commits in order, so an older offset is never
+	// committed after a newer one.
+	commitMu   sync.Mutex
+	partitions []*partitionOffsets
+}
+
+// NewConsumer returns a Consumer of topic on b for group.
+func NewConsumer(b Broker, topic, group string) *Consumer {
+	return &Consumer{
+		Broker:         b,
+		Topic:          topic,
+		Group:          group,
+		Wait:           time.Second,
+		CommitInterval: 5 * time.Second,
+	}
+}
+
+// partitionOffsets tracks the records consumed from a partition, to find
+// the offset up to which they are done with.
+type partitionOffsets struct {
+	partition int
+
+	mu sync.Mutex
+	// next is the offset of the first record not done with, and done the
+	// offsets after it that are.
+	next      int64
+	done      map[int64]bool
+	failed    bool
+	committed int64
+}
+
+// delivery is the message a record was read from.
+type delivery struct {
+	p      *partitionOffsets
+	offset int64
+}
+
+// settle tells the message of r, if any, that r is done with, or that it
+// failed to be written if ok is false.
+func (r *Record) settle(ok bool) {
+	if r.delivery != nil {
+		r.delivery.p.settle(r.delivery.offset, ok)
+	}
+}
+
+func (p *partitionOffsets) settle(offset int64, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !ok {
+		// next never moves past a failed record
+		p.failed = true
+		return
+	}
+	p.done[offset] = true
+	for p.done[p.next] {
+		delete(p.done, p.next)
+		p.next++
+	}
+}
+
+// heldRecords are records a sink buffers, to be settled once it has stored
+// them. Only those consumed from a topic are kept.
+type heldRecords struct {
+	mu         sync.Mutex
+	deliveries []*delivery
+}
+
+// hold keeps r until release.
+func (h *heldRecords) hold(r *Record) {
+	if r.delivery == nil {
+		return
+	}
+	h.mu.Lock()
+	h.deliveries = append(h.deliveries, r.delivery)
+	h.mu.Unlock()
+}
+
+// release settles the records held so far, as stored if ok.
+func (h *heldRecords) release(ok bool) {
+	h.mu.Lock()
+	deliveries := h.deliveries
+	h.deliveries = nil
+	h.mu.Unlock()
+	for _, d := range deliveries {
+		d.p.settle(d.offset, ok)
+	}
+}
+
+// messageSchema returns the cab type and schema named by a message key, or
+// 'x' if it names neither, so the record is skipped as unknown.
+func messageSchema(key string) (rune, *Schema) {
+	name, year := key, ""
+	if i := strings.Index(key, "-"); i >= 0 {
+		name, year = key[:i], key[i+1:]
+	}
+	var typ rune
+	switch name {
+	case "green":
+		typ = 'g'
+	case "yellow":
+		typ = 'y'
+	default:
+		return 'x', nil
+	}
+	if year == "" {
+		return typ, nil
+	}
+	schema, err := lookupSchema(typ, year)
+	if err != nil {
+		return 'x', nil
+	}
+	return typ, schema
+}
+
+// run sends the messages of every partition of Topic to records as
+// batches of f, from the committed offsets on, until the end of the topic
+// unless Follow is set.
+func (c *Consumer) run(f *RecordManager, records chan<- []Record) error {
+	n, err := c.Broker.Partitions(c.Topic)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("getting partitions of %s", c.Topic))
+	}
+	partitions := make([]*partitionOffsets, n)
+	for i := range partitions {
+		offset, err := c.Broker.Committed(c.Group, c.Topic, i)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("getting offset of %s/%d", c.Topic, i))
+		}
+		partitions[i] = &partitionOffsets{partition: i, next: offset, committed: offset, done: make(map[int64]bool)}
+	}
+	c.commitMu.Lock()
+	c.partitions = partitions
+	c.commitMu.Unlock()
+
+	errs := make(chan error, n)
+	for _, p := range partitions {
+		go func(p *partitionOffsets) {
+			errs <- c.consume(f, p, records)
+		}(p)
+	}
+	for range partitions {
+		if perr := <-errs; perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// consume sends the messages of p to records.
+func (c *Consumer) consume(f *RecordManager, p *partitionOffsets, records chan<- []Record) error {
+	b := f.newBatcher(records, nil)
+	offset := p.next
+	for {
+		msgs, err := c.Broker.Fetch(c.Topic, p.partition, offset, f.BatchSize, c.Wait)
+		if err != nil {
+			b.flush()
+			return errors.Wrap(err, fmt.Sprintf("fetching %s/%d at %d", c.Topic, p.partition, offset))
+		}
+		if len(msgs) == 0 {
+			// caught up, don't keep what was read waiting for more
+			b.flush()
+			if !c.Follow {
+				return nil
+			}
+			continue
+		}
+		for _, m := range msgs {
+			typ, schema := messageSchema(string(m.Key))
+			b.add(Record{
+				Type:     typ,
+				Val:      strings.TrimRight(string(m.Value), "\r\n"),
+				Schema:   schema,
+				Seq:      uint64(m.Offset),
+				delivery: &delivery{p: p, offset: m.Offset},
+			})
+			offset = m.Offset + 1
+		}
+	}
+}
+
+// commit commits the offset of every partition up to which its records
+// are done with, where it moved.
+func (c *Consumer) commit() error {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+	for _, p := range c.partitions {
+		p.mu.Lock()
+		next, committed := p.next, p.committed
+		p.mu.Unlock()
+		if next == committed {
+			continue
+		}
+		if err := c.Broker.Commit(c.Group, c.Topic, p.partition, next); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("committing %s/%d at %d", c.Topic, p.partition, next))
+		}
+		p.mu.Lock()
+		p.committed = next
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// commitEvery commits every CommitInterval until stop is closed.
+func (c *Consumer) commitEvery(stop <-chan struct{}) {
+	if c.CommitInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.CommitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.commit(); err != nil {
+				log.Printf("committing offsets, err: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// logHeld logs the partitions whose offsets are held back by failed writes.
+func (c *Consumer) logHeld() {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+	for _, p := range c.partitions {
+		p.mu.Lock()
+		if p.failed {
+			log.Printf("%s/%d held at offset %d by a failed write, later records will be consumed again", c.Topic, p.partition, p.next)
+		}
+		p.mu.Unlock()
+	}
+}
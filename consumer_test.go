@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publishFixture publishes the data lines of f to topic, keyed by key.
+func publishFixture(t *testing.T, b Broker, topic, key string, f tripFixture) int {
+	lines := strings.Split(strings.TrimSuffix(string(f.content), "\n"), "\n")[1:]
+	msgs := make([]Message, len(lines))
+	for i, line := range lines {
+		msgs[i] = Message{Topic: topic, Key: []byte(key), Value: []byte(line)}
+	}
+	if err := b.Publish(msgs); err != nil {
+		t.Fatal(err)
+	}
+	return len(lines)
+}
+
+// newConsumerMain returns a Main consuming topic of b into c.
+func newConsumerMain(dir string, b Broker, c *FakeCollection) *Main {
+	m, _ := newTestMain(dir)
+	w := NewCosmosWriterFor(c)
+	w.RetryDelay = time.Millisecond
+	m.importer = &CosmosImporter{manager: m.recordManager, writer: w}
+	m.Consumer = NewConsumer(b, "trips", "taxi")
+	m.Consumer.Wait = 50 * time.Millisecond
+	return m
+}
+
+// lag returns the number of messages of topic after the committed offsets
+// of group.
+func lag(t *testing.T, b *MemoryBroker, group, topic string) int64 {
+	n, _ := b.Partitions(topic)
+	var lag int64
+	for p := 0; p < n; p++ {
+		committed, _ := b.Committed(group, topic, p)
+		b.mu.Lock()
+		lag += int64(len(b.topics[topic][p])) - committed
+		b.mu.Unlock()
+	}
+	return lag
+}
+
+func TestConsumer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewMemoryBroker(3)
+	green, yellow := newTripFixture('g', 200), newTripFixture('y', 300)
+	total := publishFixture(t, b, "trips", "green-2013", green)
+	total += publishFixture(t, b, "trips", "yellow", yellow)
+	total += publishFixture(t, b, "trips", "purple", tripFixture{content: []byte("header\nline\n")})
+	good := green.good + yellow.good
+
+	// the first run fails to write a few rides, holding back the offsets
+	// of their partitions
+	c := NewFakeCollection()
+	c.Fail(errors.New("connection reset by peer"), errors.New("connection reset by peer"))
+	m := newConsumerMain(dir, b, c)
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	s := m.recordManager.Stats()
+	if s.Records != int64(total) || s.Written != int64(good-2) || s.BadUnknowns != 1 {
+		t.Fatalf("expected %d records and %d written, got stats %+v", total, good-2, s)
+	}
+	first := lag(t, b, "taxi", "trips")
+	if first < 2 || first >= int64(total) {
+		t.Fatalf("expected the failed rides to be consumed again, lag is %d", first)
+	}
+
+	// the second consumes the rest, from the failed rides on
+	m = newConsumerMain(dir, b, c)
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	s = m.recordManager.Stats()
+	if s.Records != first || s.FailedWrites+s.Written+s.Skipped != first {
+		t.Fatalf("expected the %d records after the committed offsets, got stats %+v", first, s)
+	}
+	if l := lag(t, b, "taxi", "trips"); l != 0 {
+		t.Fatalf("expected every offset committed, lag is %d", l)
+	}
+	// at least once: every ride got in, some of them twice
+	if len(c.docs) < good || len(c.docs) != good-2+int(s.Written) {
+		t.Fatalf("expected %d rides and the ones written again, got %d", good, len(c.docs))
+	}
+
+	// a run with nothing new commits nothing and reads nothing
+	m = newConsumerMain(dir, b, c)
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.recordManager.Stats(); s.Records != 0 {
+		t.Fatalf("expected nothing consumed, got stats %+v", s)
+	}
+}
+
+func TestPartitionOffsets(t *testing.T) {
+	p := &partitionOffsets{next: 10, committed: 10, done: make(map[int64]bool)}
+	p.settle(11, true)
+	p.settle(13, true)
+	if p.next != 10 {
+		t.Fatalf("moved past unsettled offset 10 to %d", p.next)
+	}
+	p.settle(10, true)
+	if p.next != 12 {
+		t.Fatalf("expected next 12, got %d", p.next)
+	}
+	p.settle(12, false)
+	p.settle(14, true)
+	if p.next != 12 || !p.failed {
+		t.Fatalf("moved past failed offset 12 to %d", p.next)
+	}
+}
+
+func TestMessageSchema(t *testing.T) {
+	for key, expected := range map[string]struct {
+		typ    rune
+		schema *Schema
+	}{
+		"yellow-2014": {'y', yellow2009Schema},
+		"green-2016":  {'g', green2015Schema},
+		"green":       {'g', nil},
+		"green-1999":  {'x', nil},
+		"":            {'x', nil},
+	} {
+		if typ, schema := messageSchema(key); typ != expected.typ || schema != expected.schema {
+			t.Errorf("%q: expected %c %v, got %c %v", key, expected.typ, expected.schema, typ, schema)
+		}
+	}
+}
+
+// TestConsumerBufferedWrites checks that offsets of records still buffered
+// by a sink are not committed.
+func TestConsumerBufferedWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := httptest.NewServer(&fakePilosa{requests: make(map[string]string)})
+	defer srv.Close()
+
+	for _, sink := range []string{"parquet", "pilosa"} {
+		b := NewMemoryBroker(1)
+		total := publishFixture(t, b, "trips", "yellow-2015", newTripFixture('y', 50))
+		rm := NewRecordManager()
+		var imp TaxiImporter
+		if sink == "parquet" {
+			w := NewParquetWriter(filepath.Join(dir, "parquet"))
+			w.create = createJSONFile
+			imp, err = NewParquetImporter(rm, w)
+		} else {
+			imp, err = NewPilosaImporter(rm, srv.URL, "taxi", 1000, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := NewConsumer(b, "trips", "taxi")
+		c.Wait = 10 * time.Millisecond
+		records := make(chan []Record, 100)
+		if err := c.run(rm, records); err != nil {
+			t.Fatal(err)
+		}
+		close(records)
+		imp.parse(records)
+		if err := c.commit(); err != nil {
+			t.Fatal(err)
+		}
+		if l := lag(t, b, "taxi", "trips"); l != int64(total) {
+			t.Fatalf("%s: committed offsets of buffered records, lag is %d of %d", sink, l, total)
+		}
+		imp.close()
+		if err := c.commit(); err != nil {
+			t.Fatal(err)
+		}
+		if l := lag(t, b, "taxi", "trips"); l != 0 {
+			t.Fatalf("%s: expected every offset committed once stored, lag is %d", sink, l)
+		}
+	}
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"os"
 	"time"
-
-	"github.com/Azure/go-autorest/autorest/utils"
 )
 
 // TaxiImporter imports NYC taxi ride data into cosmosdb
 type TaxiImporter interface {
-	fetch(urls <-chan string, records chan<- Record)
-	parse(records <-chan Record)
+	fetch(sources <-chan Source, records chan<- []Record)
+	parse(records <-chan []Record)
+	close()
 }
 
 // CosmosImporter struct
@@ -22,7 +23,11 @@ type CosmosImporter struct {
 // NewCosmosImporter returns an initialized TaxiImporter interface
 func NewCosmosImporter(r *RecordManager) (TaxiImporter, error) {
 
-	w, err := NewCosmosWriter(utils.GetEnvVarOrExit("AZURE_DATABASE"), utils.GetEnvVarOrExit("AZURE_DATABASE_PASSWORD"))
+	db, pw := os.Getenv("AZURE_DATABASE"), os.Getenv("AZURE_DATABASE_PASSWORD")
+	if db == "" || pw == "" {
+		return nil, fmt.Errorf("AZURE_DATABASE and AZURE_DATABASE_PASSWORD must be set")
+	}
+	w, err := NewCosmosWriter(db, pw)
 	if err != nil {
 		return nil, err
 	}
@@ -32,25 +37,25 @@ func NewCosmosImporter(r *RecordManager) (TaxiImporter, error) {
 	}, nil
 }
 
-func (i *CosmosImporter) fetch(urls <-chan string, records chan<- Record) {
+func (i *CosmosImporter) fetch(sources <-chan Source, records chan<- []Record) {
 	// TODO: add concurrency again
-	i.manager.fetch(urls, records)
+	i.manager.fetch(sources, records)
 	return
 }
 
-func (i *CosmosImporter) parse(records <-chan Record) {
+func (i *CosmosImporter) parse(records <-chan []Record) {
 
 	// TODO: add concurrency again
 	start := time.Now()
 
-	for record := range records {
-		i.manager.nexter.Next()
-		if record.Type != 'g' && record.Type != 'y' {
-			log.Printf("unknown record type %d, %v", record.Type, record)
-			i.manager.badUnknowns.Add(1)
-			i.manager.skippedRecs.Add(1)
-		} else {
-			i.writer.write(record, i.manager)
+	for batch := range records {
+		for _, record := range batch {
+			if record.Type != 'g' && record.Type != 'y' {
+				log.Printf("unknown record type %d, %v", record.Type, record)
+				i.manager.skip(&record, "unknown cab type", i.manager.badUnknowns)
+			} else {
+				i.writer.write(record, i.manager)
+			}
 		}
 	}
 	log.Printf("writing %v docs took %v\n", len(records), time.Since(start))
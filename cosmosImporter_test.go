@@ -1,32 +1,28 @@
 package main
 
 import (
-	"crypto/tls"
-	"fmt"
-	"net"
+	"errors"
 	"sync"
 	"testing"
 	"time"
-
-	mgo "gopkg.in/mgo.v2"
 )
 
-func testFetch(t *testing.T) {
-	fmt.Println("Test fetch")
-	// setup channels
-
-	//url1 := "https://s3.amazonaws.com/nyc-tlc/trip+data/green_tripdata_2013-08.csv"
-	url1 := "https://s3.amazonaws.com/nyc-tlc/trip+data/yellow_tripdata_2009-02.csv"
+func TestFetch(t *testing.T) {
+	srv := newFixtureServer()
+	defer srv.Close()
+	green := newTripFixture('g', 100)
+	yellow := newTripFixture('y', 100)
 
-	urls := make(chan string, 1)
-	recs := make(chan Record, 1000)
+	urls := make(chan Source, 2)
+	recs := make(chan []Record, 10)
 
-	i := NewCosmosImporter(NewRecordManager())
+	rm := NewRecordManager()
+	rm.MaxLineSize = fixtureMaxLine
+	i := &CosmosImporter{manager: rm, writer: NewCosmosWriterFor(NewFakeCollection())}
 
-	go func() {
-		fmt.Printf("sending Url %s\n", url1)
-		urls <- url1
-	}()
+	urls <- Source{URL: srv.add("/green_tripdata_2013-08.csv", green.content, true)}
+	urls <- Source{URL: srv.add("/yellow_tripdata_2015-01.csv", yellow.content, false, faultTruncate)}
+	close(urls)
 
 	var wg sync.WaitGroup
 
@@ -38,9 +34,12 @@ func testFetch(t *testing.T) {
 
 	var wg2 sync.WaitGroup
 	wg2.Add(1)
+	counts := make(map[rune]int)
 	go func() {
-		for record := range recs {
-			t.Logf("Received: %v\n", record)
+		for batch := range recs {
+			for _, record := range batch {
+				counts[record.Type]++
+			}
 		}
 		wg2.Done()
 	}()
@@ -48,6 +47,10 @@ func testFetch(t *testing.T) {
 	wg.Wait()
 	close(recs)
 	wg2.Wait()
+
+	if counts['g'] != green.good+green.bad || counts['y'] != yellow.good+yellow.bad {
+		t.Fatalf("unexpected record counts %v", counts)
+	}
 }
 
 func TestParseGreen(t *testing.T) {
@@ -55,7 +58,7 @@ func TestParseGreen(t *testing.T) {
 	// from https://s3.amazonaws.com/nyc-tlc/trip+data/green_tripdata_2013-08.csv
 	var s = "2,2013-08-05 12:55:11,2013-08-05 12:59:50,N,1,0,0,0,0,1,123.4,3.9,0,0,0,0,,3.9,2,,,"
 
-	rec := &Record{'g', s}
+	rec := &Record{Type: 'g', Val: s}
 
 	ride, err := rec.toRide()
 	if ride == nil {
@@ -132,7 +135,7 @@ func TestParseGreen(t *testing.T) {
 func TestParseYellow(t *testing.T) {
 	// from https://s3.amazonaws.com/nyc-tlc/trip+data/yellow_tripdata_2009-02.csv
 	s := "DDS,2009-02-03 08:25:00,2009-02-03 08:33:39,12,1.6000000000000001,-73.992767999999998,40.758324999999999,,,-73.994709999999998,40.739722999999998,CASH,6.9000000000000004,0,,0,0,6.9000000000000004"
-	rec := &Record{'y', s}
+	rec := &Record{Type: 'y', Val: s, Schema: yellow2009Schema}
 
 	ride, err := rec.toRide()
 	if err != nil {
@@ -225,72 +228,92 @@ func compareYellowRide(ride *Ride, t *testing.T) {
 }
 
 func TestWriteToCosmos(t *testing.T) {
-
-	t.Log("Writing to Cosmos")
-	// from https://s3.amazonaws.com/nyc-tlc/trip+data/yellow_tripdata_2009-02.csv
-
 	s := "2,2013-08-01 08:14:37,2013-08-01 09:09:06,N,1,0,0,0,0,1,.00,21.25,0,0,0,0,,21.25,2,,,"
-	rec := &Record{'g', s}
-
-	// s := "DDS,2009-02-03 08:25:00,2009-02-03 08:33:39,12,1.6000000000000001,-73.992767999999998,40.758324999999999,,,-73.994709999999998,40.739722999999998,CASH,6.9000000000000004,0,,0,0,6.9000000000000004"
-	// rec := &Record{'y', s}
-
-	db := "xtoph-pilosa"
-	pw := "UUEkv5WaMIytWXYiK6qZfnAPt4vwujN6f4PrsVZ08Dx4PQp0JYB1fcRjYZ4HWiLcDDcsPGzLj82laLFxXTEKng=="
-
-	i := &mgo.DialInfo{
-		Addrs:    []string{fmt.Sprintf("%s.documents.azure.com:10255", db)}, // Get HOST + PORT
-		Timeout:  60 * time.Second,
-		Database: db, // It can be anything
-		Username: db, // Username
-		Password: pw, // PASSWORD
-		DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
-			return tls.Dial("tcp", addr.String(), &tls.Config{})
-		},
-	}
+	rec := &Record{Type: 'g', Val: s}
 
-	session, err := mgo.DialWithInfo(i)
-	if err != nil {
-		t.Fatalf("Can't connect to mongo, go error %v\n", err)
+	c := NewFakeCollection()
+	w := NewCosmosWriterFor(c)
+	if err := w.WriteToCosmos(rec); err != nil {
+		t.Fatal(err)
 	}
-	session.SetMode(mgo.Strong, true)
-	session.SetSafe(&mgo.Safe{})
-
-	c := session.DB(db).C("ridesColl")
 
-	defer func() {
-		fmt.Println("Cleaning Collection")
-		c.RemoveAll(nil)
-		session.Close()
-	}()
-
-	// query ... should be empty
-	n, err := c.Find(nil).Count()
+	rides, err := c.Rides()
 	if err != nil {
-		t.Fatalf("Problem getting rides")
+		t.Fatal(err)
 	}
-	if n != 0 {
-		t.Fatalf("Collection not empty")
+	if len(rides) != 1 {
+		t.Fatalf("expected 1 ride, found %v", len(rides))
 	}
+	if rides[0].TotalDollars != 21.25 || rides[0].ID == "" || rides[0].PickupTime == nil {
+		t.Fatalf("unexpected ride %+v", rides[0])
+	}
+}
 
-	w, _ := NewCosmosWriter(db, pw)
-	w.WriteToCosmos(rec)
-
-	// Now query
-	newRide := &Ride{}
-	n, err = c.Find(nil).Count()
-	if err != nil {
-		t.Fatalf("Problem getting rides")
+func TestCosmosWriterRetries(t *testing.T) {
+	rec := &Record{Type: 'g', Val: "2,2013-08-01 08:14:37,2013-08-01 09:09:06,N,1,0,0,0,0,1,.00,21.25,0,0,0,0,,21.25,2,,,"}
+	permanent := errors.New("not authorized")
+
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		rides    int
+		fails    bool
+	}{
+		{name: "throttled", errs: []error{errThrottled, errThrottled}, attempts: 3, rides: 1},
+		{name: "timeout", errs: []error{errTimeout}, attempts: 2, rides: 1},
+		{name: "permanent", errs: []error{permanent}, attempts: 1, fails: true},
+		{name: "give up", errs: []error{errThrottled, errTimeout, errThrottled}, attempts: 3, fails: true},
+		// the timed out insert got through after all
+		{name: "duplicate after timeout", errs: []error{errTimeout, errDuplicate}, attempts: 2},
+		{name: "duplicate", errs: []error{errDuplicate}, attempts: 1, fails: true},
+	}
+	for _, test := range tests {
+		c := NewFakeCollection()
+		c.Fail(test.errs...)
+		w := NewCosmosWriterFor(c)
+		w.MaxAttempts = 3
+		w.RetryDelay = time.Millisecond
+		err := w.WriteToCosmos(rec)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		rides, _ := c.Rides()
+		if c.Attempts() != test.attempts || len(rides) != test.rides {
+			t.Errorf("%s: expected %d attempts and %d rides, got %d and %d", test.name, test.attempts, test.rides, c.Attempts(), len(rides))
+		}
 	}
-	if n != 1 {
-		t.Fatalf("Collection not empty, expected 1 found %v\n", n)
-	} else {
-		t.Log("Found inserted record")
+}
+
+func TestCosmosImporter(t *testing.T) {
+	c := NewFakeCollection()
+	// one ride is throttled twice, another fails for good
+	c.Fail(errThrottled, nil, errThrottled, nil, errors.New("document too large"))
+	w := NewCosmosWriterFor(c)
+	w.RetryDelay = time.Millisecond
+	rm := NewRecordManager()
+	importer := &CosmosImporter{manager: rm, writer: w}
+
+	records := make(chan []Record, 11)
+	var batch []Record
+	for i := 0; i < 100; i++ {
+		batch = append(batch, Record{Type: 'g', Val: "2,2013-08-01 08:14:37,2013-08-01 09:09:06,N,1,0,0,0,0,1,.00,21.25,0,0,0,0,,21.25,2,,,"})
+		if len(batch) == 10 {
+			records <- batch
+			batch = nil
+		}
 	}
+	records <- []Record{{Type: 'x', Val: "1,2,3"}}
+	close(records)
+	importer.parse(records)
+	importer.close()
 
-	err = c.Find(nil).One(newRide)
+	rides, err := c.Rides()
 	if err != nil {
-		t.Fatal(err.Error())
+		t.Fatal(err)
+	}
+	s := rm.Stats()
+	if len(rides) != 99 || s.Written != 99 || s.FailedWrites != 1 || s.BadUnknowns != 1 {
+		t.Fatalf("expected 99 rides, got %d, stats %+v", len(rides), s)
 	}
-	//compareYellowRide(newRide, t)
 }
@@ -3,18 +3,31 @@ package main
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type CosmosWriter struct {
 	info       *mgo.DialInfo
 	session    *mgo.Session
-	collection *mgo.Collection
+	collection Collection
+
+	// MaxAttempts bounds the inserts tried per ride. Throttled and timed out
+	// inserts are retried after RetryDelay times the number of attempts so
+	// far.
+	MaxAttempts int
+	RetryDelay  time.Duration
+
+	// pending counts the writes still in flight.
+	pending sync.WaitGroup
 }
 
 func NewCosmosWriter(db string, pw string) (*CosmosWriter, error) {
@@ -41,27 +54,38 @@ func NewCosmosWriter(db string, pw string) (*CosmosWriter, error) {
 	s.SetMode(mgo.Eventual, false)
 	s.SetSafe(&mgo.Safe{})
 
-	c := s.DB(db).C("ridesColl")
+	w := NewCosmosWriterFor(s.DB(db).C("ridesColl"))
+	w.info = i
+	w.session = s
+	return w, nil
+}
 
+// NewCosmosWriterFor returns a CosmosWriter inserting into c.
+func NewCosmosWriterFor(c Collection) *CosmosWriter {
 	return &CosmosWriter{
-		info:       i,
-		session:    s,
-		collection: c,
-	}, nil
+		collection:  c,
+		MaxAttempts: 10,
+		RetryDelay:  100 * time.Millisecond,
+	}
 }
 
+// write inserts record in the background, counting it as written or failed
+// once done.
 func (w *CosmosWriter) write(record Record, recordManager *RecordManager) error {
-	cancel := make(chan error, 1)
+	w.pending.Add(1)
 	go func() {
+		defer w.pending.Done()
 		err := w.WriteToCosmos(&record)
-
-		recordManager.writtenRecords.Add(1)
 		if err != nil {
-			fmt.Printf("ERROR Inserting %s\n", err.Error())
-			select {
-			case cancel <- err:
+			if _, bad := err.(badRideError); bad {
+				recordManager.skip(&record, "unparseable ride", nil)
+				return
 			}
+			log.Printf("inserting record %d, err: %v", record.Seq, err)
+			recordManager.failed(&record)
+			return
 		}
+		recordManager.written(&record)
 	}()
 	return nil
 }
@@ -70,31 +94,57 @@ func (w *CosmosWriter) write(record Record, recordManager *RecordManager) error
 func (w *CosmosWriter) WriteToCosmos(rec *Record) error {
 	// insert documents into ToCosmoscollection
 
-	ride, err := rec.toRide()
+	ride, err := parseRide(rec)
 	if err != nil {
-		return err
+		return badRideError{err}
 	}
+	defer releaseRide(ride)
+	ride.ID = bson.NewObjectId()
 
-	for i := 0; i < 10; i++ {
+	for attempt := 1; ; attempt++ {
 		err = w.collection.Insert(ride)
-		if err != nil {
-			if strings.Contains(err.Error(), "Request rate is large") == true {
-				var j int
-				for j = 1; j <= i+1; j++ {
-					time.Sleep(100 * time.Millisecond)
-				}
-				fmt.Printf("Waiting %d00ms\n", j)
-			} else {
-				fmt.Println(err.Error(), ride)
-				return errors.Wrap(err, "inserting ride")
-			}
-		} else {
-			break
+		switch {
+		case err == nil:
+			return nil
+		case mgo.IsDup(err) && attempt > 1:
+			// an earlier attempt that seemed to fail got through
+			return nil
+		case !retryable(err):
+			return errors.Wrap(err, "inserting ride")
+		case attempt >= w.MaxAttempts:
+			return errors.Wrap(err, fmt.Sprintf("inserting ride, giving up after %d attempts", attempt))
 		}
+		time.Sleep(time.Duration(attempt) * w.RetryDelay)
 	}
-	return nil
 }
 
+// badRideError is returned by WriteToCosmos for records that don't parse.
+type badRideError struct {
+	error
+}
+
+// retryable reports whether an insert failing with err may succeed later:
+// when Cosmos DB throttled it, or it timed out.
+func retryable(err error) bool {
+	if strings.Contains(err.Error(), "Request rate is large") {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// Close waits for the writes in flight and closes the session, if any,
+// and the collection, if it can be closed.
 func (w *CosmosWriter) Close() {
-	w.session.Close()
+	w.pending.Wait()
+	if w.session != nil {
+		w.session.Close()
+	}
+	if c, ok := w.collection.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("closing collection, err: %v", err)
+		}
+	}
 }
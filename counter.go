@@ -1,21 +1,52 @@
 package main
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
+// counterShards is the number of slots a Counter spreads its additions
+// over. It only needs to be around the number of Ps that add at once.
+const counterShards = 32
+
+// Counter is a statistic many goroutines add to. Additions go to one of
+// several cache line sized shards, picked per P, so they rarely contend;
+// Get adds the shards up without stopping anyone.
 type Counter struct {
-	num  int64
-	lock sync.Mutex
+	shards [counterShards]counterShard
+}
+
+type counterShard struct {
+	n int64
+	_ [56]byte
 }
 
 func (c *Counter) Add(n int) {
-	c.lock.Lock()
-	c.num += int64(n)
-	c.lock.Unlock()
+	atomic.AddInt64(&c.shards[shardIndex()].n, int64(n))
 }
 
 func (c *Counter) Get() (ret int64) {
-	c.lock.Lock()
-	ret = c.num
-	c.lock.Unlock()
+	for i := range c.shards {
+		ret += atomic.LoadInt64(&c.shards[i].n)
+	}
 	return
 }
+
+var nextShard uint32
+
+// shardHints hands out shard indexes. A sync.Pool keeps a cache per P, so
+// goroutines running on the same P mostly get the same index back, and
+// different Ps get different ones.
+var shardHints = sync.Pool{
+	New: func() interface{} {
+		i := int(atomic.AddUint32(&nextShard, 1) % counterShards)
+		return &i
+	},
+}
+
+func shardIndex() int {
+	h := shardHints.Get().(*int)
+	i := *h
+	shardHints.Put(h)
+	return i
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	c := &Counter{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				c.Add(2)
+			}
+		}()
+	}
+	wg.Wait()
+	if c.Get() != 160000 {
+		t.Fatalf("expected 160000, got %d", c.Get())
+	}
+}
+
+func TestIDRange(t *testing.T) {
+	n := &Nexter{}
+	first := n.Next()
+	ids := make([][]uint64, 8)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := n.NewRange(7)
+			for j := 0; j < 1000; j++ {
+				ids[i] = append(ids[i], r.Next())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[uint64]bool{first: true}
+	for _, worker := range ids {
+		for _, id := range worker {
+			if seen[id] {
+				t.Fatalf("id %d handed out twice", id)
+			}
+			seen[id] = true
+		}
+	}
+	if n.Used() != 8001 {
+		t.Fatalf("expected 8001 ids used, got %d", n.Used())
+	}
+	// 8 workers reserve 143 blocks of 7 each
+	if next := n.Next(); next != 1+8*143*7 {
+		t.Fatalf("unexpected id %d after ranges", next)
+	}
+}
+
+func BenchmarkCounterAdd(b *testing.B) {
+	c := &Counter{}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Add(1)
+		}
+	})
+}
+
+func BenchmarkIDRangeNext(b *testing.B) {
+	n := &Nexter{}
+	b.RunParallel(func(pb *testing.PB) {
+		r := n.NewRange(1000)
+		for pb.Next() {
+			r.Next()
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// DryRunImporter checks records the way the Pilosa and Cosmos DB importers
+// do, mapping them to bits and parsing them into rides, without writing them
+// anywhere. Records that pass are counted as written.
+type DryRunImporter struct {
+	manager *RecordManager
+	writer  *PilosaWriter
+}
+
+// NewDryRunImporter returns a DryRunImporter mapping records with the frames
+// described by config.
+func NewDryRunImporter(r *RecordManager, config *MapperConfig) (TaxiImporter, error) {
+	if config == nil {
+		config = defaultMapperConfig
+	}
+	bms, err := config.schemaBitMappers()
+	if err != nil {
+		return nil, err
+	}
+	ifs, err := schemaIntFields(config)
+	if err != nil {
+		return nil, err
+	}
+	return &DryRunImporter{
+		manager: r,
+		writer:  &PilosaWriter{bms: bms, ifs: ifs},
+	}, nil
+}
+
+func (i *DryRunImporter) fetch(sources <-chan Source, records chan<- []Record) {
+	i.manager.fetch(sources, records)
+}
+
+func (i *DryRunImporter) parse(records <-chan []Record) {
+	start := time.Now()
+	n := 0
+	for batch := range records {
+		for j := range batch {
+			i.check(&batch[j])
+			n++
+		}
+	}
+	log.Printf("checking %v rides took %v\n", n, time.Since(start))
+}
+
+// check counts record as written if it would be imported, or as skipped
+// for the reason it wouldn't.
+func (i *DryRunImporter) check(record *Record) {
+	if record.Type != 'g' && record.Type != 'y' {
+		i.manager.skip(record, "unknown cab type", i.manager.badUnknowns)
+		return
+	}
+	if _, ok := i.writer.bits(record, i.manager); !ok {
+		return
+	}
+	// ids are taken from the Nexter only when importing, so only ranges
+	// can be checked
+	if record.IDs != nil && record.Seq >= record.IDs.Size {
+		i.manager.skip(record, "column out of range", i.manager.badColumnIDs)
+		return
+	}
+	if ifs := i.writer.ifs[record.schema()]; len(ifs) > 0 {
+		fields, _ := record.Clean()
+		for _, f := range ifs {
+			if _, err := f.value(fields); err != nil {
+				// the ride would still be imported
+				i.manager.badValues.Add(1)
+			}
+		}
+	}
+	ride, err := parseRide(record)
+	if err != nil {
+		i.manager.skip(record, "unparseable ride", nil)
+		return
+	}
+	releaseRide(ride)
+	i.manager.written(record)
+}
+
+func (i *DryRunImporter) close() {}
+
+// writeReport writes the counts of records read, passed and skipped for
+// each reason, and the lines kept in samples.
+func writeReport(w io.Writer, s Stats, samples *RejectSamples) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "records\t%d\t\n", s.Records)
+	fmt.Fprintf(tw, "filtered\t%d\t\n", s.Filtered)
+	fmt.Fprintf(tw, "passed\t%d\t\n", s.Written)
+	fmt.Fprintf(tw, "skipped\t%d\t\n", s.Skipped)
+	for _, c := range []struct {
+		name string
+		n    int64
+	}{
+		{"long lines", s.LongLines},
+		{"null locations", s.NullLocs},
+		{"bad locations", s.BadLocs},
+		{"bad speeds", s.BadSpeeds},
+		{"bad total amounts", s.BadTotalAmnts},
+		{"bad durations", s.BadDurations},
+		{"bad passenger counts", s.BadPassCounts},
+		{"bad distances", s.BadDist},
+		{"bad column ids", s.BadColumnIDs},
+		{"unknown", s.BadUnknowns},
+	} {
+		fmt.Fprintf(tw, "  %s\t%d\t\n", c.name, c.n)
+	}
+	fmt.Fprintf(tw, "bad int values\t%d\t\n", s.BadValues)
+	fmt.Fprintf(tw, "failed sources\t%d\t\n", s.FailedSources)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if samples == nil {
+		return nil
+	}
+	for _, reason := range samples.Reasons() {
+		if _, err := fmt.Fprintf(w, "\n%s: %d\n", reason, samples.Count(reason)); err != nil {
+			return err
+		}
+		for _, line := range samples.Lines(reason) {
+			if _, err := fmt.Fprintf(w, "  %s\n", line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runValidate runs the validate command, a dry run of an import, with the
+// given arguments.
+func runValidate(args []string) error {
+	m := NewMain()
+	m.DryRun = true
+	m.DebugAddr = ""
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.StringVar(&m.URLFile, "urls", "", "file listing the sources to check")
+	fs.StringVar(&m.MapperFile, "mapper", "", "JSON mapper config (default the built-in frames)")
+	fs.StringVar(&m.FilterFile, "filter", "", "JSON filter config selecting the records to check")
+	fs.StringVar(&m.CacheDir, "cache", "", "directory keeping downloaded files")
+	fs.BoolVar(&m.Offline, "offline", false, "only read files already in the cache")
+	fs.StringVar(&m.RejectFile, "rejects", "", "file to write rejected lines to")
+	fs.IntVar(&m.FetchConcurrency, "fetch", m.FetchConcurrency, "sources fetched at once")
+	fs.IntVar(&m.Concurrency, "concurrency", m.Concurrency, "goroutines checking records")
+	fs.IntVar(&m.RejectSamples, "samples", m.RejectSamples, "rejected lines shown per reason")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s validate [flags] [source ...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	m.Sources = fs.Args()
+	return m.Run()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dryrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFixtureServer()
+	defer srv.Close()
+
+	g := NewGenerate()
+	g.Rows = 1000
+	g.DefectRate = 0.3
+	g.Output = filepath.Join(dir, "yellow_tripdata_2015-01.csv")
+	g.Stats = nil
+	defects, err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := newTripFixture('g', 200)
+	m, c := newTestMain(dir, g.Output, srv.add("/green_tripdata_2013-08.csv", fixture.content, false))
+	m.importer = nil
+	m.DryRun = true
+	m.RejectSamples = 2
+	m.IDFile = filepath.Join(dir, "ids")
+	var report bytes.Buffer
+	m.Report = &report
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := m.recordManager.Stats()
+	good := int64(defects[noDefect] + fixture.good)
+	if s.Written != good || s.Skipped != int64(1000+200)-good {
+		t.Errorf("expected %d records to pass, got stats %+v", good, s)
+	}
+	if s.NullLocs != int64(defects[nullCoordinates]) || s.BadDurations != int64(defects[negativeDuration]) ||
+		s.BadPassCounts != int64(defects[badPassengerCount]) || s.LongLines != int64(fixture.long) {
+		t.Errorf("expected defects %v, got stats %+v", defects, s)
+	}
+	if c.Attempts() != 0 {
+		t.Errorf("dry run wrote %d times", c.Attempts())
+	}
+	if _, err := os.Stat(m.IDFile); !os.IsNotExist(err) {
+		t.Errorf("dry run saved the id high-water mark, err: %v", err)
+	}
+	if n := m.recordManager.nexter.Used(); n != 0 {
+		t.Errorf("dry run took %d ids", n)
+	}
+
+	samples := m.recordManager.Samples
+	for reason, n := range map[string]int{
+		"null location":       defects[nullCoordinates],
+		"bad duration":        defects[negativeDuration],
+		"bad passenger count": defects[badPassengerCount],
+		"unparseable field":   fixture.bad,
+	} {
+		if samples.Count(reason) != int64(n) || len(samples.Lines(reason)) != 2 {
+			t.Errorf("%s: expected %d rejects with 2 samples, got %d, %q", reason, n, samples.Count(reason), samples.Lines(reason))
+		}
+	}
+	for _, line := range []string{
+		`records\s+1200\n`,
+		`passed\s+` + fmt.Sprint(good) + `\n`,
+		`null locations\s+` + fmt.Sprint(defects[nullCoordinates]) + `\n`,
+		`long lines\s+` + fmt.Sprint(fixture.long) + `\n`,
+		`\nbad passenger count: ` + fmt.Sprint(defects[badPassengerCount]) + `\n`,
+		`\n  ` + regexp.QuoteMeta(samples.Lines("unparseable field")[0]) + `\n`,
+	} {
+		if !regexp.MustCompile(line).MatchString(report.String()) {
+			t.Errorf("report doesn't match %q:\n%s", line, report.String())
+		}
+	}
+}
+
+func TestRejectSamples(t *testing.T) {
+	var nilSamples *RejectSamples
+	nilSamples.Add("bad", "line")
+
+	s := NewRejectSamples(1)
+	s.Add("b", "1")
+	s.Add("a", "2")
+	s.Add("c", "3")
+	s.Add("c", "4")
+	if reasons := s.Reasons(); strings.Join(reasons, ",") != "c,a,b" {
+		t.Fatalf("expected reasons by count and name, got %v", reasons)
+	}
+	if lines := s.Lines("c"); len(lines) != 1 || lines[0] != "3" || s.Count("c") != 2 {
+		t.Fatalf("expected the first line kept, got %v of %d", lines, s.Count("c"))
+	}
+}
+
+func TestDryRunIntFields(t *testing.T) {
+	config := *defaultMapperConfig
+	config.IntFields = []IntFieldConfig{{Field: "short_dist", Fields: []string{"trip_distance"}, Parser: "float", Max: 2}}
+	rm := NewRecordManager()
+	imp, err := NewDryRunImporter(rm, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outOfRange := mapperRecords[1].rec
+	outOfRange.IDs = &ColumnRange{Start: 100, Size: 1}
+	outOfRange.Seq = 1
+	records := make(chan []Record, 1)
+	records <- []Record{mapperRecords[0].rec, mapperRecords[1].rec, outOfRange}
+	close(records)
+	imp.parse(records)
+
+	// the 5 mile ride doesn't fit, but would be imported all the same
+	if s := rm.Stats(); s.Written != 2 || s.BadValues != 1 || s.BadColumnIDs != 1 {
+		t.Fatalf("expected 2 rides passing with 1 bad value, got stats %+v", s)
+	}
+	if n := rm.nexter.Used(); n != 0 {
+		t.Fatalf("dry run took %d ids", n)
+	}
+}
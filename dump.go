@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FileCollection is a Collection writing the documents inserted into it to
+// files instead of a database: as NDJSON in MongoDB extended JSON, for
+// mongoimport, or as BSON the way mongodump writes it, for mongorestore.
+// Files are named like
+//
+//	<Prefix>-00000.json
+//	<Prefix>-00001.bson.gz
+//
+// and a new one is started once MaxSize bytes were written to one, before
+// compression. Numbering starts after the files already there.
+type FileCollection struct {
+	Prefix string
+	// Format is "ndjson" or "bson".
+	Format  string
+	MaxSize int64
+	Gzip    bool
+
+	mu sync.Mutex
+	// n is the number of the next file, and size the bytes written to the
+	// current one.
+	n    int
+	size int64
+	file *os.File
+	zw   *gzip.Writer
+	w    *bufio.Writer
+	buf  bytes.Buffer
+}
+
+// NewFileCollection returns a FileCollection writing files named after
+// prefix, in format.
+func NewFileCollection(prefix, format string) (*FileCollection, error) {
+	if format != "ndjson" && format != "bson" {
+		return nil, fmt.Errorf("unknown dump format %q, expected ndjson or bson", format)
+	}
+	return &FileCollection{
+		Prefix:  prefix,
+		Format:  format,
+		MaxSize: 1 << 30,
+	}, nil
+}
+
+// Insert appends docs to the current file, starting a new one if it is
+// full.
+func (c *FileCollection) Insert(docs ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, doc := range docs {
+		c.buf.Reset()
+		if c.Format == "bson" {
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			c.buf.Write(data)
+		} else {
+			if err := writeExtendedJSON(&c.buf, reflect.ValueOf(doc)); err != nil {
+				return err
+			}
+			c.buf.WriteByte('\n')
+		}
+
+		if c.w != nil && c.MaxSize > 0 && c.size >= c.MaxSize {
+			if err := c.closeFile(); err != nil {
+				return err
+			}
+		}
+		if c.w == nil {
+			if err := c.openFile(); err != nil {
+				return err
+			}
+		}
+		if _, err := c.w.Write(c.buf.Bytes()); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("writing %s", c.file.Name()))
+		}
+		c.size += int64(c.buf.Len())
+	}
+	return nil
+}
+
+// path returns the name of file n.
+func (c *FileCollection) path(n int) string {
+	ext := ".json"
+	if c.Format == "bson" {
+		ext = ".bson"
+	}
+	if c.Gzip {
+		ext += ".gz"
+	}
+	return fmt.Sprintf("%s-%05d%s", c.Prefix, n, ext)
+}
+
+func (c *FileCollection) openFile() error {
+	for {
+		if _, err := os.Stat(c.path(c.n)); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		c.n++
+	}
+	f, err := os.Create(c.path(c.n))
+	if err != nil {
+		return err
+	}
+	c.n++
+	c.file = f
+	c.size = 0
+	var w io.Writer = f
+	if c.Gzip {
+		c.zw = gzip.NewWriter(f)
+		w = c.zw
+	}
+	c.w = bufio.NewWriterSize(w, 1<<16)
+	return nil
+}
+
+// closeFile flushes and closes the current file.
+func (c *FileCollection) closeFile() error {
+	err := c.w.Flush()
+	if c.zw != nil {
+		if zerr := c.zw.Close(); err == nil {
+			err = zerr
+		}
+	}
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("closing %s", c.file.Name()))
+	}
+	c.file, c.zw, c.w = nil, nil, nil
+	return err
+}
+
+// Close finishes the current file, if any.
+func (c *FileCollection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w == nil {
+		return nil
+	}
+	return c.closeFile()
+}
+
+// isZero reports whether v is the zero value of its type.
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+var (
+	objectIDType = reflect.TypeOf(bson.ObjectId(""))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// writeExtendedJSON writes v as MongoDB extended JSON, naming struct fields
+// as bson does: ObjectIds are {"$oid": ...} and times {"$date": ...}.
+func writeExtendedJSON(buf *bytes.Buffer, v reflect.Value) error {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch {
+	case v.Type() == objectIDType:
+		fmt.Fprintf(buf, `{"$oid":"%s"}`, v.Interface().(bson.ObjectId).Hex())
+		return nil
+	case v.Type() == timeType:
+		t := v.Interface().(time.Time).UTC()
+		fmt.Fprintf(buf, `{"$date":"%s"}`, t.Format("2006-01-02T15:04:05.000Z"))
+		return nil
+	case v.Kind() == reflect.Float64 || v.Kind() == reflect.Float32:
+		// JSON has no infinities, zero length rides have infinite speeds
+		f := v.Float()
+		switch {
+		case math.IsInf(f, 1):
+			buf.WriteString(`{"$numberDouble":"Infinity"}`)
+		case math.IsInf(f, -1):
+			buf.WriteString(`{"$numberDouble":"-Infinity"}`)
+		case math.IsNaN(f):
+			buf.WriteString(`{"$numberDouble":"NaN"}`)
+		default:
+			buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+		return nil
+	case v.Kind() != reflect.Struct:
+		data, err := json.Marshal(v.Interface())
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		return nil
+	}
+
+	buf.WriteByte('{')
+	first := true
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		opts := strings.Split(f.Tag.Get("bson"), ",")
+		name := opts[0]
+		if name == "-" {
+			continue
+		}
+		if len(opts) > 1 && opts[1] == "omitempty" && isZero(v.Field(i)) {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		if err := writeExtendedJSON(buf, v.Field(i)); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// readDump returns the content of the dump files matching pattern,
+// ungzipped, in order.
+func readDump(t *testing.T, pattern string) [][]byte {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	var files [][]byte
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if filepath.Ext(path) == ".gz" {
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		content, err := ioutil.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		files = append(files, content)
+	}
+	return files
+}
+
+func TestDumpNDJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFixtureServer()
+	defer srv.Close()
+
+	fixtures := []tripFixture{newTripFixture('g', 300), newTripFixture('y', 300)}
+	m, _ := newTestMain(dir,
+		srv.add("/green_tripdata_2013-08.csv", fixtures[0].content, false),
+		srv.add("/yellow_tripdata_2015-01.csv", fixtures[1].content, false),
+	)
+	m.importer = nil
+	m.DumpPrefix = filepath.Join(dir, "rides")
+	m.DumpMaxSize = 50000
+	m.DumpGzip = true
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readDump(t, m.DumpPrefix+"-*.json.gz")
+	if len(files) < 2 {
+		t.Fatalf("expected the dump to rotate, got %d files", len(files))
+	}
+	oid := regexp.MustCompile(`^[0-9a-f]{24}$`)
+	ids := make(map[string]bool)
+	for _, content := range files {
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			var doc struct {
+				ID struct {
+					Oid string `json:"$oid"`
+				} `json:"_id"`
+				PickupTime struct {
+					Date string `json:"$date"`
+				} `json:"pickup_time"`
+				CabType *int `json:"cab_type"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				t.Fatalf("bad line %s: %v", scanner.Text(), err)
+			}
+			if !oid.MatchString(doc.ID.Oid) || ids[doc.ID.Oid] {
+				t.Fatalf("bad or repeated id in %s", scanner.Text())
+			}
+			ids[doc.ID.Oid] = true
+			if _, err := time.Parse("2006-01-02T15:04:05.000Z", doc.PickupTime.Date); err != nil || doc.CabType == nil {
+				t.Fatalf("bad document %s", scanner.Text())
+			}
+		}
+	}
+	if good := fixtures[0].good + fixtures[1].good; len(ids) != good || m.recordManager.Stats().Written != int64(good) {
+		t.Fatalf("expected %d documents, got %d, stats %+v", good, len(ids), m.recordManager.Stats())
+	}
+}
+
+func TestDumpBSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewFileCollection(filepath.Join(dir, "rides"), "csv"); err == nil {
+		t.Fatalf("expected an error for an unknown format")
+	}
+	c, err := NewFileCollection(filepath.Join(dir, "rides"), "bson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an earlier dump is kept
+	if err := ioutil.WriteFile(c.path(0), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := NewCosmosWriterFor(c)
+	for _, mr := range mapperRecords {
+		if err := w.WriteToCosmos(&mr.rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	files := readDump(t, filepath.Join(dir, "rides-*.bson"))
+	if len(files) != 2 || len(files[0]) != 0 {
+		t.Fatalf("expected a second file, got %d", len(files))
+	}
+	// mongodump files are BSON documents one after the other, each
+	// starting with its length
+	var rides []Ride
+	for data := files[1]; len(data) > 0; {
+		n := int(binary.LittleEndian.Uint32(data))
+		var ride Ride
+		if err := bson.Unmarshal(data[:n], &ride); err != nil {
+			t.Fatal(err)
+		}
+		rides = append(rides, ride)
+		data = data[n:]
+	}
+	if len(rides) != 2 || rides[0].PassengerCount != 3 || rides[1].TotalDollars != 17.05 || rides[0].ID == rides[1].ID {
+		t.Fatalf("unexpected rides %+v", rides)
+	}
+}
+
+func TestWriteExtendedJSON(t *testing.T) {
+	pickup := time.Date(2015, 1, 15, 19, 5, 39, 0, time.FixedZone("EST", -5*3600))
+	var buf bytes.Buffer
+	doc := &struct {
+		ID      bson.ObjectId `bson:"_id"`
+		Speed   float64       `bson:"speed_mph"`
+		Pickup  *time.Time    `bson:"pickup_time"`
+		Drop    *time.Time    `bson:"drop_time"`
+		Vendor  string
+		Skipped int `bson:"-"`
+		hidden  int
+	}{ID: bson.ObjectId("\x54\x12\x34\x56\x78\x9a\xbc\xde\xf0\x12\x34\x56"), Speed: math.Inf(1), Pickup: &pickup, Vendor: "VTS"}
+	if err := writeExtendedJSON(&buf, reflect.ValueOf(doc)); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"_id":{"$oid":"54123456789abcdef0123456"},"speed_mph":{"$numberDouble":"Infinity"},` +
+		`"pickup_time":{"$date":"2015-01-16T00:05:39.000Z"},"drop_time":null,"vendor":"VTS"}`
+	if buf.String() != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
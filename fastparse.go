@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rideLayout holds the column indexes toRide needs, looked up once per
+// schema instead of once per field and record.
+type rideLayout struct {
+	vendorID     int
+	pickupTime   int
+	dropTime     int
+	passengers   int
+	distance     int
+	pickupLat    int
+	pickupLon    int
+	dropLat      int
+	dropLon      int
+	totalAmount  int
+	fieldsNeeded int
+}
+
+func newRideLayout(fields map[string]int) rideLayout {
+	l := rideLayout{
+		vendorID:    fields["vendor_id"],
+		pickupTime:  fields["pickup_datetime"],
+		dropTime:    fields["dropoff_datetime"],
+		passengers:  fields["passenger_count"],
+		distance:    fields["trip_distance"],
+		pickupLat:   fields["pickup_latitude"],
+		pickupLon:   fields["pickup_longitude"],
+		dropLat:     fields["dropoff_latitude"],
+		dropLon:     fields["dropoff_longitude"],
+		totalAmount: fields["total_amount"],
+	}
+	for _, i := range []int{l.vendorID, l.pickupTime, l.dropTime, l.passengers, l.distance, l.pickupLat, l.pickupLon, l.dropLat, l.dropLon, l.totalAmount} {
+		if i+1 > l.fieldsNeeded {
+			l.fieldsNeeded = i + 1
+		}
+	}
+	return l
+}
+
+func init() {
+	for _, s := range schemas {
+		s.layout = newRideLayout(s.Fields)
+	}
+}
+
+// rideParser turns records into Rides without allocating. It splits a record
+// into field offsets instead of substrings, and reuses the offsets between
+// records, so a rideParser must not be shared between goroutines.
+type rideParser struct {
+	// ends holds the index one past the end of each field.
+	ends []int
+}
+
+var parserPool = sync.Pool{
+	New: func() interface{} { return &rideParser{ends: make([]int, 0, 32)} },
+}
+
+var ridePool = sync.Pool{
+	New: func() interface{} { return &Ride{} },
+}
+
+// parseRide is a faster toRide. It does not set the Ride's ID. The Ride comes
+// from a pool and should be handed back with releaseRide once it is no
+// longer used.
+func parseRide(r *Record) (*Ride, error) {
+	p := parserPool.Get().(*rideParser)
+	ride := ridePool.Get().(*Ride)
+	err := p.parse(r, ride)
+	parserPool.Put(p)
+	if err != nil {
+		releaseRide(ride)
+		return nil, err
+	}
+	return ride, nil
+}
+
+// releaseRide returns a Ride from parseRide to the pool.
+func releaseRide(ride *Ride) {
+	*ride = Ride{}
+	ridePool.Put(ride)
+}
+
+// split records the end of every comma separated field in s.
+func (p *rideParser) split(s string) {
+	p.ends = p.ends[:0]
+	for i := 0; i < len(s); i++ {
+		if s[i] == ',' {
+			p.ends = append(p.ends, i)
+		}
+	}
+	p.ends = append(p.ends, len(s))
+}
+
+// field returns field i of s, which must have been split.
+func (p *rideParser) field(s string, i int) string {
+	start := 0
+	if i > 0 {
+		start = p.ends[i-1] + 1
+	}
+	return s[start:p.ends[i]]
+}
+
+// parse fills ride from r. It accepts and rejects the same records as
+// toRide and produces the same values.
+func (p *rideParser) parse(r *Record, ride *Ride) (err error) {
+	schema := r.schema()
+	if schema == nil {
+		return fmt.Errorf("Bad Record Type %v", r.Type)
+	}
+	if len(r.Val) == 0 {
+		return fmt.Errorf("Empty record")
+	}
+	l := &schema.layout
+	s := r.Val
+	p.split(s)
+	if len(p.ends) < l.fieldsNeeded {
+		return fmt.Errorf("Bad index %d, max Index %d", l.fieldsNeeded-1, len(p.ends))
+	}
+
+	if r.Type == 'g' {
+		ride.CabType = 0
+	} else {
+		ride.CabType = 1
+	}
+	ride.Event = r.Event
+	ride.VendorID = p.field(s, l.vendorID)
+
+	ride.pickupTime, err = parseTimeField(p.field(s, l.pickupTime), "pickup_datetime")
+	if err != nil {
+		return err
+	}
+	ride.PickupTime = &ride.pickupTime
+	ride.PickupDay = ride.pickupTime.Day()
+	ride.PickupMonth = int(ride.pickupTime.Month())
+	ride.PickupYear = ride.pickupTime.Year()
+
+	ride.dropTime, err = parseTimeField(p.field(s, l.dropTime), "dropoff_datetime")
+	if err != nil {
+		return err
+	}
+	ride.DropTime = &ride.dropTime
+	ride.DropDay = ride.dropTime.Day()
+	ride.DropMonth = int(ride.dropTime.Month())
+	ride.DropYear = ride.dropTime.Year()
+
+	passengers := p.field(s, l.passengers)
+	if len(passengers) == 0 {
+		return fmt.Errorf("Empty record for passenger_count")
+	}
+	ride.PassengerCount, err = strconv.Atoi(passengers)
+	if err != nil {
+		return fmt.Errorf("Error parsing passenger_count: %v", err)
+	}
+
+	if ride.DistMiles, err = parseFloatField(p.field(s, l.distance), "trip_distance"); err != nil {
+		return err
+	}
+	if ride.PickupLat, err = parseFloatField(p.field(s, l.pickupLat), "pickup_latitude"); err != nil {
+		return err
+	}
+	if ride.PickupLon, err = parseFloatField(p.field(s, l.pickupLon), "pickup_longitude"); err != nil {
+		return err
+	}
+	if ride.DropLat, err = parseFloatField(p.field(s, l.dropLat), "dropoff_latitude"); err != nil {
+		return err
+	}
+	if ride.DropLon, err = parseFloatField(p.field(s, l.dropLon), "dropoff_longitude"); err != nil {
+		return err
+	}
+
+	duration := ride.dropTime.Sub(ride.pickupTime)
+	ride.SpeedMph = ride.DistMiles / duration.Hours()
+	if ride.TotalDollars, err = parseFloatField(p.field(s, l.totalAmount), "total_amount"); err != nil {
+		return err
+	}
+	ride.DurationMinutes = duration.Minutes()
+	return nil
+}
+
+func parseFloatField(field string, name string) (float64, error) {
+	if len(field) == 0 {
+		return -1, fmt.Errorf("Empty record for %s", name)
+	}
+	f, err := strconv.ParseFloat(field, 64)
+	if err != nil {
+		return -1, fmt.Errorf("Error parsing %s: %v", name, err)
+	}
+	return f, nil
+}
+
+func parseTimeField(field string, name string) (time.Time, error) {
+	if len(field) == 0 {
+		return time.Time{}, fmt.Errorf("Empty record for %s", name)
+	}
+	if t, ok := parseDateTime(field); ok {
+		return t, nil
+	}
+	// let time.Parse deal with anything unusual, and explain what's wrong
+	t, err := time.Parse("2006-01-02 15:04:05", field)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Error parsing %s: %v", name, err)
+	}
+	return t, nil
+}
+
+// parseDateTime parses the 2006-01-02 15:04:05 layout. It only handles
+// well formed, in range values and reports false for anything else.
+func parseDateTime(s string) (time.Time, bool) {
+	if len(s) != 19 || s[4] != '-' || s[7] != '-' || s[10] != ' ' || s[13] != ':' || s[16] != ':' {
+		return time.Time{}, false
+	}
+	year, ok1 := digits(s[0:4])
+	month, ok2 := digits(s[5:7])
+	day, ok3 := digits(s[8:10])
+	hour, ok4 := digits(s[11:13])
+	min, ok5 := digits(s[14:16])
+	sec, ok6 := digits(s[17:19])
+	if !(ok1 && ok2 && ok3 && ok4 && ok5 && ok6) {
+		return time.Time{}, false
+	}
+	if month < 1 || month > 12 || day < 1 || day > daysIn(time.Month(month), year) || hour > 23 || min > 59 || sec > 59 {
+		return time.Time{}, false
+	}
+	return time.Date(year, time.Month(month), day, hour, min, sec, 0, time.UTC), true
+}
+
+func digits(s string) (int, bool) {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+func daysIn(m time.Month, year int) int {
+	return time.Date(year, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
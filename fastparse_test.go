@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var parseSamples = []Record{
+	{Type: 'g', Val: "2,2013-08-05 12:55:11,2013-08-05 12:59:50,N,1,-73.95,40.71,-73.94,40.72,1,123.4,3.9,0,0,0,0,,3.9,2,,,"},
+	{Type: 'g', Val: "2,2013-08-01 08:14:37,2013-08-01 09:09:06,N,1,0,0,0,0,1,.00,21.25,0,0,0,0,,21.25,2,,,"},
+	{Type: 'y', Schema: yellow2009Schema, Val: "DDS,2009-02-03 08:25:00,2009-02-03 08:33:39,12,1.6000000000000001,-73.992767999999998,40.758324999999999,,,-73.994709999999998,40.739722999999998,CASH,6.9000000000000004,0,,0,0,6.9000000000000004"},
+	{Type: 'y', Val: "2,2015-01-15 19:05:39,2015-01-15 19:23:42,1,1.59,-73.993896484375,40.750110626220703,1,N,-73.974784851074219,40.750617980957031,1,12,1,0.5,3.25,0,0.3,17.05"},
+	// zero duration, so an infinite speed
+	{Type: 'y', Val: "2,2015-01-15 19:05:39,2015-01-15 19:05:39,1,1.59,-73.99,40.75,1,N,-73.97,40.75,1,12,1,0.5,3.25,0,0.3,17.05"},
+	// fractional seconds are accepted by time.Parse
+	{Type: 'y', Val: "2,2015-01-15 19:05:39.5,2015-01-15 19:23:42,1,1.59,-73.99,40.75,1,N,-73.97,40.75,1,12,1,0.5,3.25,0,0.3,17.05"},
+}
+
+var badParseSamples = []Record{
+	{Type: 'g', Val: "2,,2013-08-05 12:59:50,N,1,0,0,0,0,1,123.4,3.9,0,0,0,0,,3.9,2,,,"},
+	{Type: 'g', Val: "2,2013-02-30 12:55:11,2013-08-05 12:59:50,N,1,0,0,0,0,1,123.4,3.9,0,0,0,0,,3.9,2,,,"},
+	{Type: 'g', Val: "2,2013-08-05 24:55:11,2013-08-05 12:59:50,N,1,0,0,0,0,1,123.4,3.9,0,0,0,0,,3.9,2,,,"},
+	{Type: 'g', Val: "2,2013-08-05 12:55:11,2013-08-05 12:59:50,N,1,0,0,0,0,one,123.4,3.9,0,0,0,0,,3.9,2,,,"},
+	{Type: 'g', Val: "2,2013-08-05 12:55:11,2013-08-05 12:59:50,N,1,0,0,0,0,1,,3.9,0,0,0,0,,3.9,2,,,"},
+	{Type: 'g', Val: "2,2013-08-05 12:55:11,2013-08-05 12:59:50,N,1,0,0,0,0,1,123.4,3.9,0,0,0,0,,x,2,,,"},
+	{Type: 'g', Val: "2,2013-08-05 12:55:11,2013-08-05 12:59:50,N,1,0,0,0,0,1,123.4"},
+	{Type: 'y', Schema: yellow2009Schema, Val: "DDS,2009-02-03T08:25:00,2009-02-03 08:33:39,12,1.6,-73.99,40.75,,,-73.99,40.73,CASH,6.9,0,,0,0,6.9"},
+}
+
+func TestParseRideMatchesToRide(t *testing.T) {
+	for i, rec := range parseSamples {
+		expected, err := rec.toRide()
+		if err != nil {
+			t.Fatalf("sample %d: toRide failed: %v", i, err)
+		}
+		ride, err := parseRide(&rec)
+		if err != nil {
+			t.Fatalf("sample %d: parseRide failed: %v", i, err)
+		}
+		ride.ID = expected.ID
+		if !ridesEqual(ride, expected) {
+			t.Errorf("sample %d: parseRide gave\n%+v\ntoRide gave\n%+v", i, ride, expected)
+		}
+		releaseRide(ride)
+	}
+
+	for i, rec := range badParseSamples {
+		if _, err := rec.toRide(); err == nil {
+			t.Fatalf("bad sample %d: toRide succeeded", i)
+		}
+		if ride, err := parseRide(&rec); err == nil {
+			t.Errorf("bad sample %d: parseRide succeeded with %+v", i, ride)
+		}
+	}
+}
+
+// ridesEqual compares the exported fields of two rides, including the times
+// their pointers refer to.
+func ridesEqual(a, b *Ride) bool {
+	if !a.PickupTime.Equal(*b.PickupTime) || !a.DropTime.Equal(*b.DropTime) {
+		return false
+	}
+	a2, b2 := *a, *b
+	a2.PickupTime, a2.DropTime, b2.PickupTime, b2.DropTime = nil, nil, nil, nil
+	a2.pickupTime, a2.dropTime, b2.pickupTime, b2.dropTime = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	if math.IsInf(a2.SpeedMph, 0) && a2.SpeedMph == b2.SpeedMph {
+		a2.SpeedMph, b2.SpeedMph = 0, 0
+	}
+	return reflect.DeepEqual(a2, b2)
+}
+
+func TestParseRideAllocs(t *testing.T) {
+	rec := parseSamples[3]
+	allocs := testing.AllocsPerRun(1000, func() {
+		ride, err := parseRide(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releaseRide(ride)
+	})
+	if allocs != 0 {
+		t.Fatalf("parseRide allocated %v times per record", allocs)
+	}
+}
+
+func BenchmarkToRide(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rec := parseSamples[i%4]
+		if _, err := rec.toRide(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseRide(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rec := parseSamples[i%4]
+		ride, err := parseRide(&rec)
+		if err != nil {
+			b.Fatal(err)
+		}
+		releaseRide(ride)
+	}
+}
+
+func BenchmarkParseRideParallel(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			rec := parseSamples[i%4]
+			ride, err := parseRide(&rec)
+			if err != nil {
+				b.Fatal(err)
+			}
+			releaseRide(ride)
+			i++
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FilterConfig selects the records to import. Records failing any of the
+// conditions set are dropped before they reach a writer and counted as
+// filtered. Records whose fields can't be read are let through, for the
+// writer to skip.
+type FilterConfig struct {
+	// SampleRate keeps that share of records, chosen by a hash of the line
+	// and SampleSeed, so every run keeps the same ones. Zero keeps all.
+	SampleRate float64 `json:"sample_rate"`
+	SampleSeed uint64  `json:"sample_seed"`
+	// PickupFrom and PickupTo bound the pickup time, from inclusive and to
+	// exclusive. They are dates, or times in defaultTimeLayout.
+	PickupFrom string `json:"pickup_from"`
+	PickupTo   string `json:"pickup_to"`
+	// Bounds, if set, is the box pickups must be in.
+	Bounds *BoundingBox `json:"bounds"`
+	// CabTypes, if set, are the cab types kept, green or yellow.
+	CabTypes []string `json:"cab_types"`
+}
+
+// BoundingBox is a range of longitudes and latitudes, inclusive.
+type BoundingBox struct {
+	MinLon float64 `json:"min_lon"`
+	MinLat float64 `json:"min_lat"`
+	MaxLon float64 `json:"max_lon"`
+	MaxLat float64 `json:"max_lat"`
+}
+
+func (b *BoundingBox) contains(lon, lat float64) bool {
+	return lon >= b.MinLon && lon <= b.MaxLon && lat >= b.MinLat && lat <= b.MaxLat
+}
+
+// readFilterConfig reads a JSON FilterConfig from path and checks it.
+func readFilterConfig(path string) (*recordFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := &FilterConfig{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("reading filter config %s", path))
+	}
+	filter, err := newRecordFilter(config)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("filter config %s", path))
+	}
+	return filter, nil
+}
+
+// recordFilter decides which records a FilterConfig keeps.
+type recordFilter struct {
+	config *FilterConfig
+	// threshold is the largest line hash kept, if sampling.
+	threshold uint64
+	from, to  time.Time
+	cabTypes  map[rune]bool
+}
+
+func newRecordFilter(c *FilterConfig) (*recordFilter, error) {
+	f := &recordFilter{config: c}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return nil, fmt.Errorf("sample rate %v is not between 0 and 1", c.SampleRate)
+	}
+	if c.SampleRate > 0 && c.SampleRate < 1 {
+		f.threshold = uint64(c.SampleRate * math.MaxUint64)
+	}
+	var err error
+	if f.from, err = parseFilterTime(c.PickupFrom); err != nil {
+		return nil, err
+	}
+	if f.to, err = parseFilterTime(c.PickupTo); err != nil {
+		return nil, err
+	}
+	if !f.from.IsZero() && !f.to.IsZero() && !f.from.Before(f.to) {
+		return nil, fmt.Errorf("pickup_from %s is not before pickup_to %s", c.PickupFrom, c.PickupTo)
+	}
+	if b := c.Bounds; b != nil && (b.MinLon > b.MaxLon || b.MinLat > b.MaxLat) {
+		return nil, fmt.Errorf("empty bounding box %+v", *b)
+	}
+	if len(c.CabTypes) > 0 {
+		f.cabTypes = make(map[rune]bool)
+		for _, name := range c.CabTypes {
+			typ, err := parseCabType(name)
+			if err != nil {
+				return nil, err
+			}
+			f.cabTypes[typ] = true
+		}
+	}
+	return f, nil
+}
+
+// parseFilterTime parses a date or a time in defaultTimeLayout, returning
+// the zero time for an empty string.
+func parseFilterTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(defaultTimeLayout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q, expected YYYY-MM-DD or %q", s, defaultTimeLayout)
+	}
+	return t, nil
+}
+
+// keep reports whether r passes the filter.
+func (f *recordFilter) keep(r *Record) bool {
+	if f.cabTypes != nil && !f.cabTypes[r.Type] {
+		return false
+	}
+	if f.threshold != 0 && f.hash(r.Val) > f.threshold {
+		return false
+	}
+	if f.from.IsZero() && f.to.IsZero() && f.config.Bounds == nil {
+		return true
+	}
+
+	schema := r.schema()
+	if schema == nil {
+		return true
+	}
+	fields, ok := r.Clean()
+	if !ok {
+		return true
+	}
+	if !f.from.IsZero() || !f.to.IsZero() {
+		if s, ok := fieldValue(fields, schema, "pickup_datetime"); ok {
+			t, err := time.Parse(defaultTimeLayout, s)
+			if err == nil && (t.Before(f.from) || !f.to.IsZero() && !t.Before(f.to)) {
+				return false
+			}
+		}
+	}
+	if b := f.config.Bounds; b != nil {
+		lon, lonOK := fieldValue(fields, schema, "pickup_longitude")
+		lat, latOK := fieldValue(fields, schema, "pickup_latitude")
+		if lonOK && latOK {
+			x, xerr := strconv.ParseFloat(lon, 64)
+			y, yerr := strconv.ParseFloat(lat, 64)
+			if xerr == nil && yerr == nil && !b.contains(x, y) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hash hashes line with the sample seed.
+func (f *recordFilter) hash(line string) uint64 {
+	h := fnv.New64a()
+	var seed [8]byte
+	binary.LittleEndian.PutUint64(seed[:], f.config.SampleSeed)
+	h.Write(seed[:])
+	h.Write([]byte(line))
+	return h.Sum64()
+}
+
+// fieldValue returns the named field, trimmed, reporting false if the
+// schema doesn't have it or the line is too short.
+func fieldValue(fields []string, schema *Schema, name string) (string, bool) {
+	i, ok := schema.Fields[name]
+	if !ok || i >= len(fields) {
+		return "", false
+	}
+	return strings.TrimSpace(fields[i]), true
+}
+
+// filter passes on the records in batches from in that filter keeps,
+// counting the others.
+func (f *RecordManager) filter(filter *recordFilter, in <-chan []Record, out chan<- []Record) {
+	for batch := range in {
+		kept := batch[:0]
+		for _, r := range batch {
+			if filter.keep(&r) {
+				kept = append(kept, r)
+			} else {
+				r.settle(true)
+			}
+		}
+		f.filteredRecs.Add(len(batch) - len(kept))
+		if len(kept) > 0 {
+			out <- kept
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordFilter(t *testing.T) {
+	green := Record{Type: 'g', Schema: green2013Schema, Val: "2,2013-08-31 23:50:00,2013-09-01 00:10:00,N,1,-74.0,40.752,-73.95,40.781,3,5.0,18.5,0.5,0.5,1.8,0,,21.3,1,,,"}
+	yellow := Record{Type: 'y', Schema: yellow2015Schema, Val: "2,2015-01-15 19:05:39,2015-01-15 19:23:42,1,1.59,-73.993896484375,40.750110626220703,1,N,-73.974784851074219,40.750617980957031,1,12,1,0.5,3.25,0,0.3,17.05"}
+	badTime := Record{Type: 'y', Schema: yellow2015Schema, Val: "2,2015-01-15,2015-01-15 19:23:42,1,1.59,x,40.75,1,N,-73.97,40.75,1,12,1,0.5,3.25,0,0.3,17.05"}
+	for _, test := range []struct {
+		config FilterConfig
+		keep   []bool
+	}{
+		{FilterConfig{}, []bool{true, true, true}},
+		{FilterConfig{CabTypes: []string{"yellow"}}, []bool{false, true, true}},
+		{FilterConfig{CabTypes: []string{"g", "y"}}, []bool{true, true, true}},
+		{FilterConfig{PickupFrom: "2015-01-01"}, []bool{false, true, true}},
+		{FilterConfig{PickupTo: "2013-08-31 23:50:00"}, []bool{false, false, true}},
+		{FilterConfig{PickupFrom: "2013-08-31 23:50:00", PickupTo: "2013-09-01"}, []bool{true, false, true}},
+		{FilterConfig{Bounds: &BoundingBox{MinLon: -74.01, MinLat: 40.7, MaxLon: -73.99, MaxLat: 40.8}}, []bool{true, true, true}},
+		{FilterConfig{Bounds: &BoundingBox{MinLon: -73.995, MinLat: 40.7, MaxLon: -73.99, MaxLat: 40.8}}, []bool{false, true, true}},
+		{FilterConfig{Bounds: &BoundingBox{MinLon: -74.01, MinLat: 40.751, MaxLon: -73.99, MaxLat: 40.8}}, []bool{true, false, true}},
+	} {
+		f, err := newRecordFilter(&test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, rec := range []Record{green, yellow, badTime} {
+			if f.keep(&rec) != test.keep[i] {
+				t.Errorf("%+v: expected keep %v for record %d", test.config, test.keep[i], i)
+			}
+		}
+	}
+
+	for _, config := range []FilterConfig{
+		{SampleRate: 1.5},
+		{SampleRate: -0.1},
+		{PickupFrom: "2015-01"},
+		{PickupFrom: "2015-02-01", PickupTo: "2015-01-01"},
+		{Bounds: &BoundingBox{MinLon: -73, MaxLon: -74}},
+		{CabTypes: []string{"fhv"}},
+	} {
+		if _, err := newRecordFilter(&config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestRecordFilterSample(t *testing.T) {
+	var buf bytes.Buffer
+	g := NewGenerate()
+	g.Rows = 20000
+	if _, err := g.write(&buf, yellow2015Schema); err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))[1:]
+
+	sample := func(config FilterConfig) map[string]bool {
+		f, err := newRecordFilter(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := make(map[string]bool)
+		for _, line := range lines {
+			rec := Record{Type: 'y', Schema: yellow2015Schema, Val: string(line)}
+			if f.keep(&rec) {
+				kept[rec.Val] = true
+			}
+		}
+		return kept
+	}
+	a := sample(FilterConfig{SampleRate: 0.05})
+	if len(a) < 850 || len(a) > 1150 {
+		t.Fatalf("expected about 1000 of 20000 records, got %d", len(a))
+	}
+	b := sample(FilterConfig{SampleRate: 0.05})
+	if len(a) != len(b) {
+		t.Fatalf("samples differ between runs")
+	}
+	for line := range a {
+		if !b[line] {
+			t.Fatalf("samples differ between runs")
+		}
+	}
+	c := sample(FilterConfig{SampleRate: 0.05, SampleSeed: 1})
+	same := 0
+	for line := range c {
+		if a[line] {
+			same++
+		}
+	}
+	if same > len(a)/5 {
+		t.Fatalf("another seed kept %d of the same %d records", same, len(a))
+	}
+	if n := len(sample(FilterConfig{SampleRate: 1})); n != len(lines) {
+		t.Fatalf("a rate of 1 kept %d of %d records", n, len(lines))
+	}
+}
+
+func TestMainRunFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFixtureServer()
+	defer srv.Close()
+
+	green := newTripFixture('g', 200)
+	yellow := newTripFixture('y', 300)
+	m, c := newTestMain(dir,
+		srv.add("/green_tripdata_2013-08.csv", green.content, false),
+		srv.add("/yellow_tripdata_2015-01.csv", yellow.content, false),
+	)
+	m.FilterFile = filepath.Join(dir, "filter.json")
+	if err := ioutil.WriteFile(m.FilterFile, []byte(`{"cab_types": ["green"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	rides, err := c.Rides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := m.recordManager.Stats()
+	if len(rides) != green.good || s.Filtered != int64(yellow.good+yellow.bad) || s.Skipped != int64(green.bad+green.long+yellow.long) {
+		t.Fatalf("expected %d green rides, got %d, stats %+v", green.good, len(rides), s)
+	}
+	for _, ride := range rides {
+		if ride.CabType != 0 {
+			t.Fatalf("yellow ride written: %+v", ride)
+		}
+	}
+
+	if err := ioutil.WriteFile(m.FilterFile, []byte(`{"cab_type": "green"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, _ = newTestMain(dir, srv.URL+"/green_tripdata_2013-08.csv")
+	m.FilterFile = filepath.Join(dir, "filter.json")
+	if err := m.Run(); err == nil {
+		t.Fatalf("expected an error for an unknown filter field")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tripFixture is a synthetic trip file and the number of each kind of line
+// in it.
+type tripFixture struct {
+	content []byte
+	// good lines parse, bad ones have an unparseable passenger count and
+	// long ones are longer than fixtureMaxLine.
+	good, bad, long int
+}
+
+// fixtureMaxLine is the MaxLineSize fixtures are meant to be read with.
+const fixtureMaxLine = 1000
+
+// newTripFixture returns a green 2013 or yellow 2015 file with n data
+// lines, every 10th of them bad and every 25th long.
+func newTripFixture(typ rune, n int) tripFixture {
+	var f tripFixture
+	var buf bytes.Buffer
+	if typ == 'g' {
+		buf.WriteString(green2013Schema.Header + "\n")
+	} else {
+		buf.WriteString(yellow2015Schema.Header + "\n")
+	}
+	for i := 0; i < n; i++ {
+		minute := i % 60
+		switch {
+		case i%25 == 24:
+			buf.WriteString(strings.Repeat("9", 2*fixtureMaxLine) + "\n")
+			f.long++
+		case typ == 'g':
+			passengers := "1"
+			if i%10 == 9 {
+				passengers = "x"
+				f.bad++
+			} else {
+				f.good++
+			}
+			fmt.Fprintf(&buf, "2,2013-08-01 08:%02d:37,2013-08-01 09:09:06,N,1,-73.95,40.81,-73.94,40.80,%s,1.5,21.25,0,0,0,0,,21.25,2,,,\n", minute, passengers)
+		default:
+			passengers := "1"
+			if i%10 == 9 {
+				passengers = "x"
+				f.bad++
+			} else {
+				f.good++
+			}
+			fmt.Fprintf(&buf, "2,2015-01-15 19:%02d:39,2015-01-15 20:23:42,%s,1.59,-73.99,40.75,1,N,-73.97,40.75,1,12,1,0.5,3.25,0,0.3,17.05\r\n", minute, passengers)
+		}
+	}
+	f.content = buf.Bytes()
+	return f
+}
+
+// fault is a way for a fixtureServer response to go wrong.
+type fault int
+
+const (
+	// faultNone serves the file, honoring Range requests.
+	faultNone fault = iota
+	// fault5xx answers 503 Service Unavailable.
+	fault5xx
+	// faultTruncate sends half the body and drops the connection.
+	faultTruncate
+	// faultTrickle sends the body a few bytes at a time.
+	faultTrickle
+	// faultStall sends half the body and then nothing until the client
+	// gives up.
+	faultStall
+	// faultDown answers 503 to this and every later request.
+	faultDown
+)
+
+// fixtureServer serves trip files over HTTP, failing requests as scripted.
+type fixtureServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	files    map[string][]byte
+	gzipped  map[string]bool
+	faults   map[string][]fault
+	requests map[string]int
+}
+
+func newFixtureServer() *fixtureServer {
+	s := &fixtureServer{
+		files:    make(map[string][]byte),
+		gzipped:  make(map[string]bool),
+		faults:   make(map[string][]fault),
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// add serves content at path, which is gzip encoded for clients accepting
+// it if gzipped is set. The first requests fail with faults, one each.
+func (s *fixtureServer) add(path string, content []byte, gzipped bool, faults ...fault) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = content
+	s.gzipped[path] = gzipped
+	s.faults[path] = faults
+	return s.URL + path
+}
+
+func (s *fixtureServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, ok := s.files[r.URL.Path]
+	gzipped := s.gzipped[r.URL.Path]
+	f := faultNone
+	if faults := s.faults[r.URL.Path]; len(faults) > 0 {
+		f = faults[0]
+		if f != faultDown {
+			s.faults[r.URL.Path] = faults[1:]
+		}
+	}
+	s.requests[r.URL.Path]++
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch f {
+	case fault5xx, faultDown:
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	case faultTruncate, faultStall:
+		if r.Header.Get("Range") != "" {
+			break
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		if f == faultStall {
+			<-r.Context().Done()
+		}
+		panic(http.ErrAbortHandler)
+	case faultTrickle:
+		for i := 0; i < len(content); i += 512 {
+			end := i + 512
+			if end > len(content) {
+				end = len(content)
+			}
+			w.Write(content[i:end])
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond)
+		}
+		return
+	}
+
+	if gzipped && r.Header.Get("Range") == "" && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write(content)
+		zw.Close()
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// requestCount returns the number of requests for path so far.
+func (s *fixtureServer) requestCount(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Generate writes synthetic trip files, for load tests that can't use the
+// published data. Rides have plausible pickup times, locations inside the
+// grid, distances, durations and fares, and a share of them can be made
+// defective the way real files are.
+type Generate struct {
+	// Type is the cab type, 'g' or 'y'.
+	Type rune
+	// Month is the month the rides start in, which also picks the schema.
+	Month time.Time
+	Rows  int
+	// DefectRate is the share of rows with a defect: null coordinates, a
+	// negative duration or a bad passenger count.
+	DefectRate float64
+	Seed       int64
+	// Output is the file written to, stdout if empty.
+	Output string
+	// Stats, if set, gets a summary of what was written.
+	Stats io.Writer
+}
+
+// NewGenerate returns a Generate with default settings.
+func NewGenerate() *Generate {
+	return &Generate{
+		Type:       'y',
+		Month:      time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+		Rows:       100000,
+		DefectRate: 0.01,
+		Seed:       1,
+		Stats:      os.Stderr,
+	}
+}
+
+// runGenerate runs the generate command with the given arguments.
+func runGenerate(args []string) error {
+	g := NewGenerate()
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	typ := fs.String("type", "yellow", "cab type, green or yellow")
+	month := fs.String("month", g.Month.Format("2006-01"), "month the rides start in, which picks the schema")
+	fs.IntVar(&g.Rows, "n", g.Rows, "number of rows")
+	fs.Float64Var(&g.DefectRate, "defects", g.DefectRate, "share of defective rows")
+	fs.Int64Var(&g.Seed, "seed", g.Seed, "random seed")
+	fs.StringVar(&g.Output, "o", "", "file to write (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s generate [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var err error
+	g.Type, err = parseCabType(*typ)
+	if err != nil {
+		return err
+	}
+	g.Month, err = time.Parse("2006-01", *month)
+	if err != nil {
+		return fmt.Errorf("bad month %q, expected YYYY-MM", *month)
+	}
+	_, err = g.Run()
+	return err
+}
+
+// defect is a way a generated row can be broken.
+type defect int
+
+const (
+	noDefect defect = iota
+	nullCoordinates
+	negativeDuration
+	badPassengerCount
+	numDefects
+)
+
+func (d defect) String() string {
+	return [...]string{"none", "null coordinates", "negative duration", "bad passenger count"}[d]
+}
+
+// Run writes the file, returning the number of rows with each defect.
+func (g *Generate) Run() (map[defect]int, error) {
+	if g.DefectRate < 0 || g.DefectRate > 1 {
+		return nil, fmt.Errorf("defect rate %v is not between 0 and 1", g.DefectRate)
+	}
+	schema, err := lookupSchema(g.Type, g.Month.Format("2006"))
+	if err != nil {
+		return nil, err
+	}
+
+	var counts map[defect]int
+	if g.Output == "" {
+		counts, err = g.write(os.Stdout, schema)
+	} else {
+		var f *os.File
+		f, err = os.Create(g.Output)
+		if err != nil {
+			return nil, err
+		}
+		counts, err = g.write(f, schema)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if g.Stats != nil {
+		fmt.Fprintf(g.Stats, "wrote %d %s rows in schema %s", g.Rows, cabTypeName(g.Type), schema)
+		for d := nullCoordinates; d < numDefects; d++ {
+			fmt.Fprintf(g.Stats, ", %s: %d", d, counts[d])
+		}
+		fmt.Fprintln(g.Stats)
+	}
+	return counts, nil
+}
+
+func (g *Generate) write(out io.Writer, schema *Schema) (map[defect]int, error) {
+	w := bufio.NewWriterSize(out, 1<<16)
+	gen := newTripGenerator(schema, g.Month, g.Seed)
+	counts := make(map[defect]int)
+	if _, err := w.WriteString(schema.Header + "\n"); err != nil {
+		return nil, err
+	}
+	for i := 0; i < g.Rows; i++ {
+		d := noDefect
+		if gen.rand.Float64() < g.DefectRate {
+			d = defect(1 + gen.rand.Intn(int(numDefects)-1))
+		}
+		counts[d]++
+		if _, err := w.WriteString(gen.row(d) + "\n"); err != nil {
+			return nil, err
+		}
+	}
+	return counts, w.Flush()
+}
+
+// hourWeights is the relative number of pickups in each hour of the day.
+var hourWeights = [24]float64{
+	5, 3.5, 2.5, 1.8, 1.3, 1.2, 2.5, 4.5, 5.5, 5.5, 5.2, 5.4,
+	5.7, 5.7, 6, 5.8, 5, 6, 7, 7.2, 6.7, 6.6, 6.4, 5.7,
+}
+
+// tripGenerator makes up rides in a schema.
+type tripGenerator struct {
+	schema *Schema
+	month  time.Time
+	rand   *rand.Rand
+	// hours is the cumulative share of pickups up to each hour.
+	hours  [24]float64
+	fields []string
+}
+
+func newTripGenerator(schema *Schema, month time.Time, seed int64) *tripGenerator {
+	g := &tripGenerator{
+		schema: schema,
+		month:  time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC),
+		rand:   rand.New(rand.NewSource(seed)),
+		fields: make([]string, schema.Columns),
+	}
+	var total float64
+	for _, w := range hourWeights {
+		total += w
+	}
+	var sum float64
+	for h, w := range hourWeights {
+		sum += w
+		g.hours[h] = sum / total
+	}
+	return g
+}
+
+// row returns a ride with defect d as a line of the schema.
+func (g *tripGenerator) row(d defect) string {
+	for i := range g.fields {
+		g.fields[i] = ""
+	}
+	r := g.rand
+
+	pickup := g.pickupTime()
+	// distances are roughly log-normal, a couple of miles typically
+	dist := math.Min(math.Exp(0.6+0.75*r.NormFloat64()), 60)
+	dist = math.Max(math.Floor(dist*100)/100, 0.01)
+	mph := math.Max(4, 12+4*r.NormFloat64())
+	duration := time.Duration(dist/mph*float64(time.Hour)) + time.Minute
+	duration = duration.Truncate(time.Second)
+	dropoff := pickup.Add(duration)
+	if d == negativeDuration {
+		dropoff = pickup.Add(-duration)
+	}
+
+	pickupLon, pickupLat := g.pickupLocation()
+	// head off in a random direction, a little further than the crow flies
+	angle := 2 * math.Pi * r.Float64()
+	crow := dist / 1.3
+	dropLon := clamp(pickupLon+crow/52.4*math.Cos(angle), gridSpec.Xmin, gridSpec.Xmax)
+	dropLat := clamp(pickupLat+crow/69*math.Sin(angle), gridSpec.Ymin, gridSpec.Ymax)
+	if d == nullCoordinates {
+		pickupLon, pickupLat = 0, 0
+	}
+
+	passengers := strconv.Itoa(g.passengers())
+	if d == badPassengerCount {
+		passengers = strconv.Itoa(10 + r.Intn(246))
+	}
+
+	// standard metered fare, with the night and rush hour surcharges
+	fare := math.Round((2.5+2.5*dist+0.2*duration.Minutes())*2) / 2
+	extra := 0.0
+	if h := pickup.Hour(); h >= 20 || h < 6 {
+		extra = 0.5
+	} else if h >= 16 && pickup.Weekday() != time.Saturday && pickup.Weekday() != time.Sunday {
+		extra = 1
+	}
+	tolls := 0.0
+	if dist > 10 && r.Float64() < 0.3 {
+		tolls = 5.54
+	}
+	credit := r.Float64() < 0.6
+	tip := 0.0
+	if credit {
+		tip = math.Round(fare*(0.1+0.15*r.Float64())*100) / 100
+	}
+	surcharge := 0.0
+	if _, ok := g.schema.Fields["improvement_surcharge"]; ok {
+		surcharge = 0.3
+	}
+	total := fare + extra + 0.5 + tip + tolls + surcharge
+
+	vendor, payment := "2", "2"
+	if r.Float64() < 0.45 {
+		vendor = "1"
+	}
+	if credit {
+		payment = "1"
+	}
+	if g.schema == yellow2009Schema {
+		vendor, payment = "VTS", "CASH"
+		if r.Float64() < 0.45 {
+			vendor = "CMT"
+		}
+		if credit {
+			payment = "Credit"
+		}
+	}
+
+	g.set("vendor_id", vendor)
+	g.set("pickup_datetime", pickup.Format(defaultTimeLayout))
+	g.set("dropoff_datetime", dropoff.Format(defaultTimeLayout))
+	g.set("passenger_count", passengers)
+	g.set("trip_distance", strconv.FormatFloat(dist, 'f', 2, 64))
+	g.set("pickup_longitude", formatCoordinate(pickupLon))
+	g.set("pickup_latitude", formatCoordinate(pickupLat))
+	g.set("ratecode_id", "1")
+	g.set("store_and_fwd_flag", "N")
+	g.set("dropoff_longitude", formatCoordinate(dropLon))
+	g.set("dropoff_latitude", formatCoordinate(dropLat))
+	g.set("payment_type", payment)
+	g.set("fare_amount", formatDollars(fare))
+	g.set("extra", formatDollars(extra))
+	g.set("mta_tax", "0.5")
+	g.set("tip_amount", formatDollars(tip))
+	g.set("tolls_amount", formatDollars(tolls))
+	g.set("improvement_surcharge", formatDollars(surcharge))
+	g.set("total_amount", formatDollars(total))
+	if g.schema.Type == 'g' {
+		// green files end with the trip type, street hail or dispatch
+		g.fields[len(g.fields)-1] = "1"
+	}
+	return strings.Join(g.fields, ",")
+}
+
+func (g *tripGenerator) set(field, value string) {
+	if i, ok := g.schema.Fields[field]; ok {
+		g.fields[i] = value
+	}
+}
+
+// pickupTime returns a time in the month, busier in the evening than at
+// night.
+func (g *tripGenerator) pickupTime() time.Time {
+	days := g.month.AddDate(0, 1, 0).Sub(g.month).Hours() / 24
+	day := g.rand.Intn(int(days))
+	x := g.rand.Float64()
+	hour := 0
+	for hour < 23 && g.hours[hour] < x {
+		hour++
+	}
+	secs := g.rand.Intn(3600)
+	return g.month.AddDate(0, 0, day).Add(time.Duration(hour)*time.Hour + time.Duration(secs)*time.Second)
+}
+
+// pickupLocation returns a point in the grid, mostly around Midtown.
+func (g *tripGenerator) pickupLocation() (lon, lat float64) {
+	lon = clamp(-73.98+0.025*g.rand.NormFloat64(), gridSpec.Xmin, gridSpec.Xmax)
+	lat = clamp(40.755+0.035*g.rand.NormFloat64(), gridSpec.Ymin, gridSpec.Ymax)
+	return lon, lat
+}
+
+// passengers returns a passenger count, mostly lone riders.
+func (g *tripGenerator) passengers() int {
+	x := g.rand.Float64()
+	switch {
+	case x < 0.7:
+		return 1
+	case x < 0.85:
+		return 2
+	case x < 0.9:
+		return 3
+	case x < 0.93:
+		return 4
+	case x < 0.97:
+		return 5
+	}
+	return 6
+}
+
+// clamp keeps x inside the open interval (min, max).
+func clamp(x, min, max float64) float64 {
+	const margin = 1e-6
+	return math.Max(min+margin, math.Min(max-margin, x))
+}
+
+func formatCoordinate(x float64) string {
+	if x == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(x, 'f', 6, 64)
+}
+
+func formatDollars(x float64) string {
+	return strconv.FormatFloat(x, 'f', 2, 64)
+}
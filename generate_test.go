@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "generate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(&fakePilosa{requests: make(map[string]string)})
+	defer srv.Close()
+	w, err := NewPilosaWriter(srv.URL, "taxi", 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, schema := range schemas {
+		g := NewGenerate()
+		g.Type = schema.Type
+		g.Month, _ = time.Parse("2006-01", schema.Name+"-08")
+		g.Rows = 2000
+		g.DefectRate = 0.1
+		g.Output = filepath.Join(dir, schema.String()+".csv")
+		var stats bytes.Buffer
+		g.Stats = &stats
+		counts, err := g.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(stats.String(), "wrote 2000") {
+			t.Errorf("%s: unexpected stats %q", schema, stats.String())
+		}
+		for d := nullCoordinates; d < numDefects; d++ {
+			if counts[d] < 40 || counts[d] > 100 {
+				t.Errorf("%s: %d rows with %s", schema, counts[d], d)
+			}
+		}
+
+		content, err := ioutil.ReadFile(g.Output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		if len(lines) != 2001 {
+			t.Fatalf("%s: expected 2001 lines, got %d", schema, len(lines))
+		}
+		found, err := checkHeader(schema.Type, nil, lines[0])
+		if err != nil || found != schema {
+			t.Fatalf("%s: header matches %v, err: %v", schema, found, err)
+		}
+
+		// the defective rows are skipped for the reasons real ones are, and
+		// only those
+		rm := NewRecordManager()
+		for i, line := range lines[1:] {
+			rec := Record{Type: schema.Type, Schema: schema, Val: line}
+			w.bits(&rec, rm)
+			if _, err := parseRide(&rec); err != nil {
+				t.Fatalf("%s: row %d doesn't parse: %v", schema, i, err)
+			}
+		}
+		s := rm.Stats()
+		if s.NullLocs != int64(counts[nullCoordinates]) || s.BadDurations != int64(counts[negativeDuration]) ||
+			s.BadPassCounts != int64(counts[badPassengerCount]) || s.Skipped != int64(2000-counts[noDefect]) {
+			t.Errorf("%s: expected defects %v, got stats %+v", schema, counts, s)
+		}
+	}
+}
+
+func TestGenerateDeterministic(t *testing.T) {
+	var a, b bytes.Buffer
+	g := NewGenerate()
+	g.Rows = 100
+	if _, err := g.write(&a, yellow2015Schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.write(&b, yellow2015Schema); err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != b.String() {
+		t.Fatalf("same seed gave different files")
+	}
+	g.Seed = 2
+	b.Reset()
+	if _, err := g.write(&b, yellow2015Schema); err != nil {
+		t.Fatal(err)
+	}
+	if a.String() == b.String() {
+		t.Fatalf("different seeds gave the same file")
+	}
+}
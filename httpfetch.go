@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPFetcher opens remote trip files. Transient failures, including
+// connections dropped part way through a body, are retried with exponential
+// backoff, and interrupted downloads resume with a Range request from the
+// last byte read.
+type HTTPFetcher struct {
+	Client *http.Client
+	// ReadTimeout is how long a body may go without delivering any bytes
+	// before the connection is considered dead.
+	ReadTimeout time.Duration
+	// MaxRetries bounds the number of consecutive failed attempts.
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled for each retry
+	// after that up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewHTTPFetcher returns an HTTPFetcher with conservative timeouts.
+func NewHTTPFetcher() *HTTPFetcher {
+	return &HTTPFetcher{
+		Client: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 60 * time.Second,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		ReadTimeout: 2 * time.Minute,
+		MaxRetries:  5,
+		Backoff:     time.Second,
+		MaxBackoff:  time.Minute,
+	}
+}
+
+// statusError is an unexpected HTTP response status.
+type statusError struct {
+	url    string
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("fetching %s: unexpected status %d %s", e.url, e.status, http.StatusText(e.status))
+}
+
+// temporary reports whether retrying the request might succeed.
+func (e *statusError) temporary() bool {
+	return e.status >= 500 || e.status == http.StatusTooManyRequests || e.status == http.StatusRequestTimeout
+}
+
+// errNotModified is returned when a conditional request finds the remote
+// file unchanged.
+var errNotModified = errors.New("not modified")
+
+// Open starts downloading url. The returned ReadCloser transparently resumes
+// the download if the connection is lost.
+func (h *HTTPFetcher) Open(url string) (io.ReadCloser, error) {
+	return h.openIfChanged(url, "", "")
+}
+
+// openIfChanged is like Open, but returns errNotModified if the remote file
+// still has the given ETag or has not been modified since lastModified.
+func (h *HTTPFetcher) openIfChanged(url, etag, lastModified string) (*resumingReader, error) {
+	r := &resumingReader{fetcher: h, url: url, size: -1, ifNoneMatch: etag, ifModifiedSince: lastModified}
+	if err := r.retry(r.open); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// backoff returns how long to wait before retry number attempt, starting
+// at 1.
+func (h *HTTPFetcher) backoff(attempt int) time.Duration {
+	d := h.Backoff
+	for i := 1; i < attempt && d < h.MaxBackoff; i++ {
+		d *= 2
+	}
+	if h.MaxBackoff > 0 && d > h.MaxBackoff {
+		d = h.MaxBackoff
+	}
+	return d
+}
+
+// resumingReader reads the body of an HTTP response, reissuing the request
+// with a Range header when the body fails part way through.
+type resumingReader struct {
+	fetcher *HTTPFetcher
+	url     string
+
+	body   io.ReadCloser
+	cancel context.CancelFunc
+	timer  *time.Timer
+	// offset is the number of bytes delivered so far.
+	offset int64
+	// size is the full length of the file, or -1 if unknown.
+	size int64
+	// validator is the ETag or Last-Modified of the first response, used to
+	// make sure a resumed download continues the same file.
+	validator string
+	// etag and lastModified are the validators of the first response.
+	etag         string
+	lastModified string
+	// ifNoneMatch and ifModifiedSince make the first request conditional.
+	ifNoneMatch     string
+	ifModifiedSince string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// retry calls fn until it succeeds, fails permanently, or the retry budget
+// is exhausted.
+func (r *resumingReader) retry(fn func() error) error {
+	var err error
+	for attempt := 0; attempt <= r.fetcher.MaxRetries; attempt++ {
+		if attempt > 0 {
+			wait := r.fetcher.backoff(attempt)
+			log.Printf("retrying %s at byte %d in %v, err: %v", r.url, r.offset, wait, err)
+			time.Sleep(wait)
+		}
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if se, ok := err.(*statusError); ok && !se.temporary() {
+			return err
+		}
+		if err == errNotModified {
+			return err
+		}
+		if r.isClosed() {
+			return err
+		}
+	}
+	return errors.Wrap(err, fmt.Sprintf("giving up on %s after %d retries", r.url, r.fetcher.MaxRetries))
+}
+
+// open issues a request for the remainder of the file, starting at offset.
+func (r *resumingReader) open() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		cancel()
+		return err
+	}
+	req = req.WithContext(ctx)
+	if r.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		if r.validator != "" {
+			req.Header.Set("If-Range", r.validator)
+		}
+	} else {
+		if r.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", r.ifNoneMatch)
+		}
+		if r.ifModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", r.ifModifiedSince)
+		}
+	}
+
+	resp, err := r.fetcher.Client.Do(req)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && r.offset == 0:
+		resp.Body.Close()
+		cancel()
+		return errNotModified
+	case resp.StatusCode == http.StatusPartialContent && r.offset > 0:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != r.offset {
+			resp.Body.Close()
+			cancel()
+			return fmt.Errorf("fetching %s: asked for byte %d, got Content-Range %q", r.url, r.offset, resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		if r.offset > 0 {
+			if r.validator != "" && r.validator != validator(resp) {
+				resp.Body.Close()
+				cancel()
+				return &statusError{url: r.url, status: http.StatusPreconditionFailed}
+			}
+			// the server ignored the Range header, skip what we already have
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, r.offset); err != nil {
+				resp.Body.Close()
+				cancel()
+				return err
+			}
+		} else {
+			r.size = resp.ContentLength
+			r.validator = validator(resp)
+			r.etag = resp.Header.Get("ETag")
+			r.lastModified = resp.Header.Get("Last-Modified")
+		}
+	default:
+		resp.Body.Close()
+		cancel()
+		return &statusError{url: r.url, status: resp.StatusCode}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		resp.Body.Close()
+		cancel()
+		return fmt.Errorf("fetching %s: closed", r.url)
+	}
+	r.body = resp.Body
+	r.cancel = cancel
+	if r.fetcher.ReadTimeout > 0 {
+		r.timer = time.AfterFunc(r.fetcher.ReadTimeout, cancel)
+	}
+	return nil
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if n > 0 && r.timer != nil {
+		r.timer.Reset(r.fetcher.ReadTimeout)
+	}
+	if err == io.EOF && (r.size < 0 || r.offset >= r.size) {
+		return n, io.EOF
+	}
+	if err == nil {
+		return n, nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if r.isClosed() {
+		return n, err
+	}
+
+	// the connection dropped, pick up where it left off
+	r.release()
+	err = r.retry(r.open)
+	if err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// release closes the current response body.
+func (r *resumingReader) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.body != nil {
+		r.body.Close()
+	}
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+func (r *resumingReader) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func (r *resumingReader) Close() error {
+	r.release()
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	return nil
+}
+
+// validator returns the ETag of resp if it has a strong one, or its
+// Last-Modified date.
+func validator(resp *http.Response) string {
+	etag := resp.Header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// contentRangeStart parses the first byte position out of a Content-Range
+// header like "bytes 100-199/200".
+func contentRangeStart(header string) (int64, error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, fmt.Errorf("bad Content-Range %q", header)
+	}
+	dash := strings.Index(header, "-")
+	if dash == -1 {
+		return 0, fmt.Errorf("bad Content-Range %q", header)
+	}
+	return strconv.ParseInt(header[len("bytes "):dash], 10, 64)
+}
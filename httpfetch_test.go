@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testHTTPFetcher() *HTTPFetcher {
+	h := NewHTTPFetcher()
+	h.ReadTimeout = time.Second
+	h.MaxRetries = 3
+	h.Backoff = time.Millisecond
+	h.MaxBackoff = 5 * time.Millisecond
+	return h
+}
+
+func TestHTTPFetcherStatus(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	_, err := testHTTPFetcher().Open(ts.URL + "/yellow_tripdata_2009-01.csv")
+	if err == nil {
+		t.Fatalf("404 should fail")
+	}
+	if requests != 1 {
+		t.Fatalf("404 should not be retried, got %d requests", requests)
+	}
+}
+
+func TestHTTPFetcherRetry(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("vendor_id\n"))
+	}))
+	defer ts.Close()
+
+	body, err := testHTTPFetcher().Open(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "vendor_id\n" || requests != 3 {
+		t.Fatalf("unexpected content %q after %d requests", content, requests)
+	}
+
+	ts5xx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts5xx.Close()
+	if _, err := testHTTPFetcher().Open(ts5xx.URL); err == nil {
+		t.Fatalf("persistent 500 should fail")
+	}
+}
+
+func TestHTTPFetcherResume(t *testing.T) {
+	data := []byte(strings.Repeat("2,2013-08-05 12:55:11,2013-08-05 12:59:50,N,1,0,0,0,0,1,123.4,3.9,0,0,0,0,,3.9,2,,,\n", 1000))
+	modified := time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC)
+	var requests int32
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		ranges = append(ranges, r.Header.Get("Range"))
+		if n <= 2 {
+			// drop the connection a third of the way through what's left
+			start := 0
+			if rng := r.Header.Get("Range"); rng != "" {
+				start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+				w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(len(data)-1)+"/"+strconv.Itoa(len(data)))
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+				w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+				w.WriteHeader(http.StatusPartialContent)
+			} else {
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+			}
+			w.Write(data[start : start+(len(data)-start)/3])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "", modified, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	body, err := testHTTPFetcher().Open(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("resumed content differs, got %d bytes, expected %d", len(content), len(data))
+	}
+	if requests != 3 || ranges[0] != "" || ranges[1] == "" || ranges[2] == "" {
+		t.Fatalf("expected a full request and two ranged ones, got %q", ranges)
+	}
+}
+
+func TestHTTPFetcherStall(t *testing.T) {
+	data := []byte(strings.Repeat("x", 4096))
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data[:100])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	h := testHTTPFetcher()
+	h.ReadTimeout = 50 * time.Millisecond
+	body, err := h.Open(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("got %d bytes after stall, expected %d", len(content), len(data))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ColumnRange is a block of Pilosa column ids reserved for a source. Record
+// n of the source gets column Start+n, so a source keeps its columns across
+// runs, and sources loaded on different machines don't collide.
+type ColumnRange struct {
+	Start uint64
+	Size  uint64
+}
+
+func (r *ColumnRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.Start+r.Size-1)
+}
+
+// end returns the id after the last one in r.
+func (r *ColumnRange) end() uint64 {
+	return r.Start + r.Size
+}
+
+// parseColumnRange parses an inclusive range of ids like 1000000-1999999.
+func parseColumnRange(s string) (*ColumnRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("bad id range %q, expected first-last", s)
+	}
+	first, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("bad id range %q", s))
+	}
+	last, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("bad id range %q", s))
+	}
+	if last < first {
+		return nil, fmt.Errorf("id range %q ends before it starts", s)
+	}
+	return &ColumnRange{Start: first, Size: last - first + 1}, nil
+}
+
+// split divides r into n consecutive ranges of equal size.
+func (r *ColumnRange) split(n int) ([]*ColumnRange, error) {
+	size := r.Size / uint64(n)
+	if size == 0 {
+		return nil, fmt.Errorf("id range %s is too small for %d sources", r, n)
+	}
+	ranges := make([]*ColumnRange, n)
+	for i := range ranges {
+		ranges[i] = &ColumnRange{Start: r.Start + uint64(i)*size, Size: size}
+	}
+	return ranges, nil
+}
+
+// columnID returns the Pilosa column for r: its place in the column range
+// of its source if there is one, otherwise the next id from ids. It reports
+// false if r doesn't fit in its source's range.
+func columnID(r *Record, ids *IDRange) (uint64, bool) {
+	if r.IDs == nil {
+		return ids.Next(), true
+	}
+	if r.Seq >= r.IDs.Size {
+		return 0, false
+	}
+	return r.IDs.Start + r.Seq, true
+}
+
+// readHighWater reads the id high-water mark stored at path. It returns 0 if
+// there is no such file yet.
+func readHighWater(path string) (uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("reading id high-water mark from %s", path))
+	}
+	return id, nil
+}
+
+// writeHighWater stores id at path, replacing it atomically so a crash
+// can't leave a truncated file behind.
+func writeHighWater(path string, id uint64) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(tmp, "%d\n", id); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourceColumnRanges(t *testing.T) {
+	sources, err := parseSourceLine("ids=1000-1999 url=https://example.com/trips_{2014-01..2014-04}.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, src := range sources {
+		if src.IDs.Start != uint64(1000+250*i) || src.IDs.Size != 250 {
+			t.Fatalf("unexpected id range %s for %s", src.IDs, src)
+		}
+	}
+
+	rm := NewRecordManager()
+	ids := rm.nexter.NewRange(10)
+	rec := &Record{Seq: 249, IDs: sources[1].IDs}
+	if id, ok := columnID(rec, ids); !ok || id != 1499 {
+		t.Fatalf("expected column 1499, got %d %v", id, ok)
+	}
+	rec.Seq = 250
+	if _, ok := columnID(rec, ids); ok {
+		t.Fatalf("record past the end of its range should have no column")
+	}
+	if id, _ := columnID(&Record{}, ids); id != 0 {
+		t.Fatalf("expected the first id from the range, got %d", id)
+	}
+	if n := rm.nexter.Used(); n != 1 {
+		t.Fatalf("expected 1 id used, got %d", n)
+	}
+}
+
+func TestRecordSeq(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var content strings.Builder
+	content.WriteString("VendorID,tpep_pickup_datetime,tpep_dropoff_datetime,passenger_count,trip_distance,pickup_longitude,pickup_latitude,RateCodeID,store_and_fwd_flag,dropoff_longitude,dropoff_latitude,payment_type,fare_amount,extra,mta_tax,tip_amount,tolls_amount,improvement_surcharge,total_amount\n")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&content, "%d,2015-01-15 19:05:39,2015-01-15 19:23:42\n", i)
+	}
+	path := filepath.Join(dir, "yellow_tripdata_2015-01.csv")
+	if err := ioutil.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ids := &ColumnRange{Start: 5000, Size: 1000}
+
+	// sequential and chunked reads number records the same way
+	for _, chunkSize := range []int64{1 << 30, 200} {
+		rm := NewRecordManager()
+		rm.ChunkSize = chunkSize
+		rm.ChunkConcurrency = 4
+		rm.BatchSize = 9
+		sources := make(chan Source, 1)
+		records := make(chan []Record, 100)
+		sources <- Source{URL: path, IDs: ids}
+		close(sources)
+		go func() {
+			rm.fetch(sources, records)
+			close(records)
+		}()
+
+		n := 0
+		for batch := range records {
+			for _, rec := range batch {
+				id, ok := columnID(&rec, nil)
+				if !ok || id != 5000+uint64(n) || !strings.HasPrefix(rec.Val, fmt.Sprintf("%d,", n)) {
+					t.Fatalf("chunk size %d: record %.10q got column %d", chunkSize, rec.Val, id)
+				}
+				n++
+			}
+		}
+		if n != 500 {
+			t.Fatalf("chunk size %d: expected 500 records, got %d", chunkSize, n)
+		}
+	}
+}
+
+func TestHighWater(t *testing.T) {
+	dir, err := ioutil.TempDir("", "highwater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ids")
+
+	if id, err := readHighWater(path); err != nil || id != 0 {
+		t.Fatalf("expected 0 without a file, got %d, %v", id, err)
+	}
+	if err := writeHighWater(path, 123456789); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := readHighWater(path); err != nil || id != 123456789 {
+		t.Fatalf("expected 123456789, got %d, %v", id, err)
+	}
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readHighWater(path); err == nil {
+		t.Fatalf("expected an error for a corrupt file")
+	}
+}
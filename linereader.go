@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// errLineTooLong is returned by lineReader.ReadLine in place of a line
+// longer than its maximum.
+var errLineTooLong = errors.New("line too long")
+
+// lineReader reads lines of at most max bytes, not counting the line ending.
+// Unlike bufio.Scanner it doesn't give up on the rest of the input when it
+// meets a longer line: the long line is streamed to the writer tooLong
+// returns, without ever being held in memory, and reading can carry on with
+// the next line.
+type lineReader struct {
+	r   *bufio.Reader
+	max int
+	// tooLong is called once for each line longer than max. It may be nil,
+	// in which case long lines are dropped.
+	tooLong func() io.WriteCloser
+	// offset is the number of bytes consumed so far.
+	offset int64
+	buf    []byte
+}
+
+func newLineReader(r io.Reader, max int, tooLong func() io.WriteCloser) *lineReader {
+	return &lineReader{
+		r:       bufio.NewReaderSize(r, 1<<16),
+		max:     max,
+		tooLong: tooLong,
+	}
+}
+
+// ReadLine returns the next line without its line ending. It returns io.EOF
+// once there are no more lines, and errLineTooLong after skipping a line
+// longer than max.
+func (l *lineReader) ReadLine() (string, error) {
+	l.buf = l.buf[:0]
+	var long io.WriteCloser
+	for {
+		frag, err := l.r.ReadSlice('\n')
+		l.offset += int64(len(frag))
+		more := err == bufio.ErrBufferFull
+		if more {
+			err = nil
+		}
+		if !more {
+			frag = dropEOL(frag)
+		}
+
+		if long == nil {
+			l.buf = append(l.buf, frag...)
+			// a trailing \r may still turn out to be part of the line ending
+			if n := len(l.buf); n > l.max && !(more && n == l.max+1 && l.buf[n-1] == '\r') {
+				long = nopWriteCloser{}
+				if l.tooLong != nil {
+					long = l.tooLong()
+				}
+				long.Write(l.buf)
+				l.buf = l.buf[:0]
+			}
+		} else {
+			long.Write(frag)
+		}
+
+		if more {
+			continue
+		}
+		if long != nil {
+			long.Close()
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			return "", errLineTooLong
+		}
+		if err == io.EOF && len(l.buf) > 0 {
+			// last line without a line ending
+			return string(l.buf), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(l.buf), nil
+	}
+}
+
+// skipLine discards input up to and including the next newline.
+func (l *lineReader) skipLine() error {
+	for {
+		frag, err := l.r.ReadSlice('\n')
+		l.offset += int64(len(frag))
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// dropEOL removes a trailing \n or \r\n.
+func dropEOL(b []byte) []byte {
+	if len(b) > 0 && b[len(b)-1] == '\n' {
+		b = b[:len(b)-1]
+		if len(b) > 0 && b[len(b)-1] == '\r' {
+			b = b[:len(b)-1]
+		}
+	}
+	return b
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineReader(t *testing.T) {
+	huge := strings.Repeat("x", 200000)
+	input := "short\r\n" + huge + "\r\n\n" + "0123456789\n" + "01234567890\r\n" + "01234567\r\r\n" + huge + "\nlast"
+
+	var long []string
+	r := newLineReader(strings.NewReader(input), 10, func() io.WriteCloser {
+		buf := &bytes.Buffer{}
+		long = append(long, "")
+		i := len(long) - 1
+		return writeCloserFunc{buf, func() { long[i] = buf.String() }}
+	})
+	var got []string
+	skipped := 0
+	for {
+		line, err := r.ReadLine()
+		if err == io.EOF {
+			break
+		} else if err == errLineTooLong {
+			skipped++
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, line)
+	}
+
+	expected := []string{"short", "", "0123456789", "01234567\r", "last"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected lines %q, got %q", expected, got)
+	}
+	if skipped != 3 || len(long) != 3 || long[0] != huge || long[1] != "01234567890" || long[2] != huge {
+		t.Fatalf("unexpected long lines, skipped %d: %d %d", skipped, len(long), len(long[0]))
+	}
+	if r.offset != int64(len(input)) {
+		t.Fatalf("expected offset %d, got %d", len(input), r.offset)
+	}
+}
+
+type writeCloserFunc struct {
+	io.Writer
+	close func()
+}
+
+func (w writeCloserFunc) Close() error {
+	w.close()
+	return nil
+}
+
+func TestFetchLongLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "longlines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	header := "VendorID,tpep_pickup_datetime,tpep_dropoff_datetime,passenger_count,trip_distance,pickup_longitude,pickup_latitude,RateCodeID,store_and_fwd_flag,dropoff_longitude,dropoff_latitude,payment_type,fare_amount,extra,mta_tax,tip_amount,tolls_amount,improvement_surcharge,total_amount"
+	huge := strings.Repeat("9", 300000)
+	var content strings.Builder
+	content.WriteString(header + "\n")
+	for i := 0; i < 100; i++ {
+		if i%10 == 5 {
+			content.WriteString(huge + "\n")
+		}
+		fmt.Fprintf(&content, "%d,2015-01-15 19:05:39,2015-01-15 19:23:42\n", i)
+	}
+	path := filepath.Join(dir, "yellow_tripdata_2015-01.csv")
+	if err := ioutil.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunkSize := range []int64{1 << 30, 4096} {
+		var rejected bytes.Buffer
+		rm := NewRecordManager()
+		rm.MaxLineSize = 1000
+		rm.Rejects = NewRejectLog(&rejected)
+		rm.ChunkSize = chunkSize
+		rm.ChunkConcurrency = 4
+
+		sources := make(chan Source, 1)
+		records := make(chan []Record, 200)
+		sources <- Source{URL: path}
+		close(sources)
+		rm.fetch(sources, records)
+		close(records)
+		if err := rm.Rejects.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		n := 0
+		for batch := range records {
+			for _, rec := range batch {
+				if !strings.HasPrefix(rec.Val, fmt.Sprintf("%d,", n)) {
+					t.Fatalf("chunk size %d: record %d is %.20q", chunkSize, n, rec.Val)
+				}
+				n++
+			}
+		}
+		if n != 100 {
+			t.Fatalf("chunk size %d: expected 100 records, got %d", chunkSize, n)
+		}
+		if rm.longLines.Get() != 10 || rm.skippedRecs.Get() != 10 {
+			t.Fatalf("chunk size %d: expected 10 long lines, got %d", chunkSize, rm.longLines.Get())
+		}
+		rejects := strings.Split(strings.TrimSuffix(rejected.String(), "\n"), "\n")
+		if len(rejects) != 10 {
+			t.Fatalf("chunk size %d: expected 10 rejects, got %d", chunkSize, len(rejects))
+		}
+		for _, line := range rejects {
+			if line != path+"\tline longer than 1000 bytes\t"+huge {
+				t.Fatalf("chunk size %d: unexpected reject %.100q", chunkSize, line)
+			}
+		}
+	}
+}
+
+func TestRejectLogQuarantine(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRejectLog(&buf)
+	q := l.quarantine("a.csv", "long")
+	if _, err := q.Write([]byte("xxx")); err != nil {
+		t.Fatal(err)
+	}
+	// a line still coming in doesn't hold up the others
+	done := make(chan struct{})
+	go func() {
+		l.Reject("b.csv", "bad", "line")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Reject blocked on a quarantined line")
+	}
+	if _, err := q.Write([]byte("yyy")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "b.csv\tbad\tline\na.csv\tlong\txxxyyy\n"; buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -25,6 +25,25 @@ use case implementation
 ***********************/
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "autoscan" {
+		if err := runAutoscan(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		if err := runValidate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		if err := runGenerate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	m := NewMain()
 	m.URLFile = "yellow1.txt"
 	err := m.Run()
@@ -33,12 +52,9 @@ func main() {
 	}
 }
 
-// TODO autoscan 1. determine field type by attempting conversions
-// TODO autoscan 2. determine field mapping by looking at statistics (for floatmapper, intmapper)
-// TODO autoscan 3. write results from ^^ to config file
-// TODO read ParserMapper config from file (cant do CustomMapper)
-
 type Main struct {
+	// PilosaHost, if set, imports into Index on that Pilosa server instead
+	// of Cosmos DB.
 	PilosaHost       string
 	URLFile          string
 	FetchConcurrency int
@@ -47,36 +63,208 @@ type Main struct {
 	BufferSize       int
 	UseReadAll       bool
 
-	urls []string
+	// Sources are parsed like the lines of URLFile and added after them.
+	Sources []string
+
+	// CacheDir, if set, keeps downloaded files so later runs can skip the
+	// download. CacheSize caps its size in bytes, and Offline only reads
+	// files already in it.
+	CacheDir  string
+	CacheSize int64
+	Offline   bool
+
+	// MaxAttempts is how often a source is tried before giving up on it,
+	// waiting RetryDelay times the number of attempts so far in between.
+	MaxAttempts int
+	RetryDelay  time.Duration
+
+	// RejectFile, if set, collects lines that couldn't be imported, such as
+	// lines longer than MaxLineSize bytes.
+	RejectFile  string
+	MaxLineSize int
+
+	// IDFile, if set, keeps the Pilosa column id high-water mark between
+	// runs, so rides from sources without an ids range in the manifest get
+	// new columns instead of overwriting those of earlier runs. Machines
+	// loading in parallel should use ids ranges instead.
+	IDFile string
+
+	// PostgresURL, if set, imports into PostgresTable in that PostGIS
+	// database instead of Cosmos DB, partitioned by pickup month if
+	// PostgresPartitioned is set.
+	PostgresURL         string
+	PostgresTable       string
+	PostgresPartitioned bool
+
+	// ParquetDir, if set, has rides written to Parquet files under it
+	// instead of Cosmos DB, in row groups of ParquetRowGroupSize bytes
+	// compressed with ParquetCompression.
+	ParquetDir          string
+	ParquetRowGroupSize int64
+	ParquetCompression  string
+
+	// DumpPrefix, if set, has the documents meant for Cosmos DB written to
+	// files named after it instead, in DumpFormat, ndjson or bson. Files
+	// are rotated at DumpMaxSize bytes and gzipped if DumpGzip is set.
+	DumpPrefix  string
+	DumpFormat  string
+	DumpMaxSize int64
+	DumpGzip    bool
+
+	// Producer, if set, has rides published to its topic instead of written
+	// to Cosmos DB.
+	Producer *Producer
+
+	// Consumer, if set, feeds the import from its topic instead of URLFile
+	// and Sources, committing offsets as records are written. A dry run
+	// commits none.
+	Consumer *Consumer
+
+	// Replay, if set, has the records of the run sorted by pickup time and
+	// sent to the sink as its virtual clock reaches them. Sinks writing in
+	// order, such as Producer with a Concurrency of 1, keep that order.
+	// Replaying separate pickup and dropoff events needs a sink writing
+	// documents: Cosmos DB, DumpPrefix or Producer.
+	Replay *Replay
+
+	// MapperFile, if set, is a JSON MapperConfig describing the Pilosa
+	// frames, replacing the default mappers.
+	MapperFile string
+
+	// FilterFile, if set, is a JSON FilterConfig selecting the records to
+	// import.
+	FilterFile string
+
+	// DebugAddr is where net/http/pprof is served, if set.
+	DebugAddr string
+
+	// DryRun, if set, checks every record the way an import would without
+	// writing anything, then writes a report of how many records pass and
+	// why the others don't to Report, with up to RejectSamples lines for
+	// each reason. The IDFile is read but not updated.
+	DryRun        bool
+	Report        io.Writer
+	RejectSamples int
+
+	urls []Source
+
+	mapperConfig *MapperConfig
+	filter       *recordFilter
+
+	// importer, if set, is used instead of Pilosa or Cosmos DB.
+	importer TaxiImporter
 
 	recordManager *RecordManager
 }
 
 func NewMain() *Main {
 	m := &Main{
-		Concurrency:      1,
-		FetchConcurrency: 1,
-		urls:             make([]string, 0),
-		recordManager:    NewRecordManager(),
+		Concurrency:         1,
+		FetchConcurrency:    1,
+		MaxAttempts:         10,
+		RetryDelay:          10 * time.Second,
+		MaxLineSize:         1 << 20,
+		DebugAddr:           "localhost:6060",
+		Report:              os.Stdout,
+		RejectSamples:       5,
+		Index:               "taxi",
+		PostgresTable:       "rides",
+		PostgresPartitioned: true,
+		ParquetRowGroupSize: 128 << 20,
+		ParquetCompression:  "snappy",
+		DumpFormat:          "ndjson",
+		DumpMaxSize:         1 << 30,
+		BufferSize:          1000000,
+		urls:                make([]Source, 0),
+		recordManager:       NewRecordManager(),
 	}
 
 	return m
 }
 
 func (m *Main) Run() error {
-	go func() {
-		log.Println(http.ListenAndServe("localhost:6060", nil))
-	}()
+	if m.DebugAddr != "" {
+		go func() {
+			log.Println(http.ListenAndServe(m.DebugAddr, nil))
+		}()
+	}
 
 	err := m.readURLs()
 	if err != nil {
 		return err
 	}
 
+	if err := m.checkReplay(); err != nil {
+		return err
+	}
+
+	m.mapperConfig = defaultMapperConfig
+	if m.MapperFile != "" {
+		m.mapperConfig, err = readMapperConfig(m.MapperFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.FilterFile != "" {
+		m.filter, err = readFilterConfig(m.FilterFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.CacheDir != "" {
+		cache, err := NewCache(m.CacheDir, m.CacheSize, m.recordManager.HTTP)
+		if err != nil {
+			return err
+		}
+		cache.Offline = m.Offline
+		m.recordManager.Cache = cache
+	} else if m.Offline {
+		return fmt.Errorf("Offline mode needs a CacheDir")
+	}
+
+	m.recordManager.Retries.MaxAttempts = m.MaxAttempts
+	m.recordManager.Retries.Delay = m.RetryDelay
+	m.recordManager.MaxLineSize = m.MaxLineSize
+
+	if m.RejectFile != "" {
+		rejects, err := CreateRejectLog(m.RejectFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := rejects.Close(); err != nil {
+				log.Printf("closing %s, err: %v", m.RejectFile, err)
+			}
+		}()
+		m.recordManager.Rejects = rejects
+	}
+
+	if m.IDFile != "" {
+		start, err := readHighWater(m.IDFile)
+		if err != nil {
+			return err
+		}
+		for _, src := range m.urls {
+			if src.IDs != nil && src.IDs.end() > start {
+				start = src.IDs.end()
+			}
+		}
+		m.recordManager.nexter = &Nexter{id: start}
+		if !m.DryRun {
+			defer m.saveHighWater()
+		}
+	}
+
+	if m.DryRun {
+		m.recordManager.Samples = NewRejectSamples(m.RejectSamples)
+	}
+
 	ticker := m.recordManager.printStats()
 
-	urls := make(chan string, 100)
-	records := make(chan Record, 20000)
+	urls := make(chan Source, 100)
+	records := make(chan []Record, 20)
 
 	go func() {
 		for _, url := range m.urls {
@@ -89,56 +277,188 @@ func (m *Main) Run() error {
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		for range c {
-			log.Printf("Rides: %d, Bytes: %s", m.recordManager.nexter.Last(), pdk.Bytes(m.recordManager.BytesProcessed()))
+			s := m.recordManager.Stats()
+			log.Printf("Rides: %d, Bytes: %s", s.Rides, pdk.Bytes(s.Bytes))
+			if m.IDFile != "" && !m.DryRun {
+				m.saveHighWater()
+			}
 			os.Exit(0)
 		}
 	}()
 
 	var wg sync.WaitGroup
 
-	importer, err := NewCosmosImporter(m.recordManager)
+	importer := m.importer
+	if importer == nil {
+		importer, err = m.newImporter()
+	}
 	if err != nil {
 		log.Panicf("Can't Open Importer: %s", err.Error())
 	}
 
-	for i := 0; i < m.FetchConcurrency; i++ {
+	var consumeErr error
+	stopCommits := make(chan struct{})
+	if m.Consumer != nil {
 		wg.Add(1)
 		go func() {
-			importer.fetch(urls, records)
+			consumeErr = m.Consumer.run(m.recordManager, records)
 			wg.Done()
 		}()
+		if !m.DryRun {
+			go m.Consumer.commitEvery(stopCommits)
+		}
+	} else {
+		for i := 0; i < m.FetchConcurrency; i++ {
+			wg.Add(1)
+			go func() {
+				importer.fetch(urls, records)
+				wg.Done()
+			}()
+		}
+	}
+	// the filter, if any, sits between the fetchers and the parsers
+	filtered := records
+	var wgf sync.WaitGroup
+	if m.filter != nil {
+		filtered = make(chan []Record, 20)
+		for i := 0; i < m.Concurrency; i++ {
+			wgf.Add(1)
+			go func() {
+				m.recordManager.filter(m.filter, records, filtered)
+				wgf.Done()
+			}()
+		}
+	}
+	// the replay, if any, holds them back until they are due
+	replayed := filtered
+	if m.Replay != nil {
+		replayed = make(chan []Record, 20)
+		go func() {
+			m.Replay.run(filtered, replayed, m.recordManager.BatchSize)
+			close(replayed)
+		}()
 	}
 	var wg2 sync.WaitGroup
 	for i := 0; i < m.Concurrency; i++ {
 		wg2.Add(1)
 		go func() {
-			importer.parse(records)
+			importer.parse(replayed)
 			wg2.Done()
 		}()
 	}
 	wg.Wait()
 	close(records)
+	if m.filter != nil {
+		wgf.Wait()
+		close(filtered)
+	}
 	wg2.Wait()
-
-	time.Sleep(30 * time.Second)
+	// close waits for the writes still in flight
+	importer.close()
 	ticker.Stop()
+	close(stopCommits)
+	if m.Consumer != nil && !m.DryRun {
+		m.Consumer.logHeld()
+		if err := m.Consumer.commit(); err != nil {
+			return err
+		}
+	}
+	if consumeErr != nil {
+		return consumeErr
+	}
+
+	if m.DryRun {
+		if err := writeReport(m.Report, m.recordManager.Stats(), m.recordManager.Samples); err != nil {
+			log.Printf("writing report, err: %v", err)
+		}
+	}
+
+	failed := m.recordManager.Retries.Failed()
+	for _, f := range failed {
+		log.Printf("FAILED %s after %d attempts, err: %v", f.Source, f.Attempts, f.Err)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d sources failed", len(failed), len(m.urls))
+	}
 	return err
 }
 
+// newImporter returns the importer for a dry run, for PilosaHost,
+// PostgresURL, ParquetDir, DumpPrefix or Producer if set, or Cosmos DB.
+func (m *Main) newImporter() (TaxiImporter, error) {
+	if m.DryRun {
+		return NewDryRunImporter(m.recordManager, m.mapperConfig)
+	}
+	if m.PilosaHost != "" {
+		return NewPilosaImporter(m.recordManager, m.PilosaHost, m.Index, m.BufferSize, m.mapperConfig)
+	}
+	if m.PostgresURL != "" {
+		return NewPostGISImporter(m.recordManager, m.PostgresURL, m.PostgresTable, m.PostgresPartitioned)
+	}
+	if m.ParquetDir != "" {
+		w := NewParquetWriter(m.ParquetDir)
+		w.RowGroupSize = m.ParquetRowGroupSize
+		w.Compression = m.ParquetCompression
+		return NewParquetImporter(m.recordManager, w)
+	}
+	if m.DumpPrefix != "" {
+		c, err := NewFileCollection(m.DumpPrefix, m.DumpFormat)
+		if err != nil {
+			return nil, err
+		}
+		c.MaxSize = m.DumpMaxSize
+		c.Gzip = m.DumpGzip
+		return &CosmosImporter{manager: m.recordManager, writer: NewCosmosWriterFor(c)}, nil
+	}
+	if m.Producer != nil {
+		return NewProducerImporter(m.recordManager, m.Producer), nil
+	}
+	return NewCosmosImporter(m.recordManager)
+}
+
+// checkReplay returns an error if Replay can't be used with the sources and
+// sink of m.
+func (m *Main) checkReplay() error {
+	if m.Replay == nil {
+		return nil
+	}
+	if m.Consumer != nil {
+		// every record would have to be consumed before the first is due
+		return fmt.Errorf("replay needs sources, not a topic")
+	}
+	if m.Replay.Events && m.importer == nil && (m.DryRun || m.PilosaHost != "" || m.PostgresURL != "" || m.ParquetDir != "") {
+		return fmt.Errorf("replaying pickup and dropoff events needs Cosmos DB, a dump or a topic to write to")
+	}
+	return nil
+}
+
+// saveHighWater stores the first column id not used yet in IDFile.
+func (m *Main) saveHighWater() {
+	if err := writeHighWater(m.IDFile, m.recordManager.nexter.Reserved()); err != nil {
+		log.Printf("saving id high-water mark to %s, err: %v", m.IDFile, err)
+	}
+}
+
 func (m *Main) readURLs() error {
-	if m.URLFile == "" {
-		return fmt.Errorf("Need to specify a URL File")
+	if m.Consumer != nil {
+		return nil
 	}
-	f, err := os.Open(m.URLFile)
-	if err != nil {
-		return err
+	if m.URLFile == "" && len(m.Sources) == 0 {
+		return fmt.Errorf("Need to specify a URL File")
 	}
-	s := bufio.NewScanner(f)
-	for s.Scan() {
-		m.urls = append(m.urls, s.Text())
+	if m.URLFile != "" {
+		urls, err := readSourceFile(m.URLFile)
+		if err != nil {
+			return err
+		}
+		m.urls = append(m.urls, urls...)
 	}
-	if err := s.Err(); err != nil {
-		return err
+	for _, spec := range m.Sources {
+		urls, err := parseSourceLine(spec)
+		if err != nil {
+			return err
+		}
+		m.urls = append(m.urls, urls...)
 	}
 	return nil
 }
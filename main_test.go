@@ -1,6 +1,16 @@
 package main
 
-import "testing"
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pilosa/pdk"
+)
 
 func TestFetchAndParse(t *testing.T) {
 	/*
@@ -24,55 +34,328 @@ func TestFetchAndParse(t *testing.T) {
 	*/
 }
 
+// newTestMain returns a Main reading sources with short timeouts and
+// writing to a fake collection, with rejects in dir.
+func newTestMain(dir string, sources ...string) (*Main, *FakeCollection) {
+	m := NewMain()
+	m.DebugAddr = ""
+	m.Sources = sources
+	m.FetchConcurrency = 2
+	m.Concurrency = 2
+	m.MaxAttempts = 3
+	m.RetryDelay = time.Millisecond
+	m.MaxLineSize = fixtureMaxLine
+	m.RejectFile = filepath.Join(dir, "rejects.tsv")
+
+	rm := m.recordManager
+	rm.HTTP.ReadTimeout = 200 * time.Millisecond
+	rm.HTTP.MaxRetries = 3
+	rm.HTTP.Backoff = time.Millisecond
+	rm.HTTP.MaxBackoff = 10 * time.Millisecond
+
+	c := NewFakeCollection()
+	w := NewCosmosWriterFor(c)
+	w.RetryDelay = time.Millisecond
+	m.importer = &CosmosImporter{manager: rm, writer: w}
+	return m, c
+}
+
+func TestMainRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mainrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFixtureServer()
+	defer srv.Close()
+
+	fixtures := []tripFixture{
+		newTripFixture('g', 200),
+		newTripFixture('y', 300),
+		newTripFixture('y', 400),
+		newTripFixture('g', 500),
+		newTripFixture('y', 600),
+	}
+	sources := []string{
+		srv.add("/green_tripdata_2013-08.csv", fixtures[0].content, false, fault5xx, fault5xx),
+		srv.add("/yellow_tripdata_2015-01.csv", fixtures[1].content, true),
+		srv.add("/yellow_tripdata_2015-02.csv", fixtures[2].content, false, faultTruncate),
+		srv.add("/green_tripdata_2013-09.csv", fixtures[3].content, false, faultTrickle),
+		srv.add("/yellow_tripdata_2015-03.csv", fixtures[4].content, false, faultStall),
+	}
+	m, c := newTestMain(dir, sources...)
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var good, bad, long int
+	for _, f := range fixtures {
+		good += f.good
+		bad += f.bad
+		long += f.long
+	}
+	rides, err := c.Rides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := m.recordManager.Stats()
+	if len(rides) != good || s.Written != int64(good) {
+		t.Errorf("expected %d rides written, got %d, stats %+v", good, len(rides), s)
+	}
+	if s.FailedWrites != 0 || s.Skipped != int64(bad+long) || s.LongLines != int64(long) || s.Read != int64(good+bad) || s.FailedSources != 0 {
+		t.Errorf("expected %d unparseable rides and %d long lines skipped, got stats %+v", bad, long, s)
+	}
+	rejects, err := ioutil.ReadFile(m.RejectFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(rejects), "\tline longer than 1000 bytes\t"); n != long {
+		t.Errorf("expected %d rejects, got %d", long, n)
+	}
+	if n := srv.requestCount("/green_tripdata_2013-08.csv"); n != 3 {
+		t.Errorf("expected 3 requests for the file failing twice, got %d", n)
+	}
+	if n := srv.requestCount("/yellow_tripdata_2015-02.csv"); n != 2 {
+		t.Errorf("expected 2 requests for the truncated file, got %d", n)
+	}
+}
+
+func TestMainRunGzipGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mainrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fixtures := map[string]tripFixture{
+		"yellow_tripdata_2015-01.csv.gz": newTripFixture('y', 200),
+		"yellow_tripdata_2015-02.csv.gz": newTripFixture('y', 300),
+	}
+	good := 0
+	for name, f := range fixtures {
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := gzip.NewWriter(file)
+		if _, err := zw.Write(f.content); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal(err)
+		}
+		good += f.good
+	}
+
+	// the files are small enough to be read in chunks, were they not gzipped
+	m, c := newTestMain(dir, filepath.Join(dir, "yellow_*.csv.gz"))
+	m.recordManager.ChunkSize = 100
+	m.recordManager.ChunkConcurrency = 4
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	rides, err := c.Rides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := m.recordManager.Stats(); len(rides) != good || s.Written != int64(good) || s.FailedSources != 0 {
+		t.Fatalf("expected %d rides written, got %d, stats %+v", good, len(rides), s)
+	}
+}
+
+func TestMainRunFailedSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mainrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFixtureServer()
+	defer srv.Close()
+
+	ok := newTripFixture('y', 100)
+	m, c := newTestMain(dir,
+		srv.add("/yellow_tripdata_2015-01.csv", ok.content, false),
+		srv.add("/yellow_tripdata_2015-02.csv", newTripFixture('y', 100).content, false, faultDown),
+		srv.URL+"/yellow_tripdata_2015-03.csv",
+	)
+	err = m.Run()
+	if err == nil || err.Error() != "2 of 3 sources failed" {
+		t.Fatalf("expected 2 failed sources, got %v", err)
+	}
+	rides, err := c.Rides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := m.recordManager.Stats()
+	if len(rides) != ok.good || s.Skipped != int64(ok.bad+ok.long) || s.LongLines != int64(ok.long) {
+		t.Fatalf("expected %d rides, got %d, stats %+v", ok.good, len(rides), s)
+	}
+	// 404s are permanent, 503s are retried by the fetcher and the queue
+	if n := srv.requestCount("/yellow_tripdata_2015-03.csv"); n != 1 {
+		t.Errorf("expected 1 request for the missing file, got %d", n)
+	}
+	if n := srv.requestCount("/yellow_tripdata_2015-02.csv"); n != 3*4 {
+		t.Errorf("expected 12 requests for the failing file, got %d", n)
+	}
+}
+
+// mapperRecords are known rides along with the bits the mapper table should
+// give them. The green ride crosses midnight at the end of a month, and
+// picks up and drops off in different grid cells, so frames reading the
+// wrong field show up.
+var mapperRecords = []struct {
+	rec  Record
+	bits map[string]uint64
+}{
+	{
+		rec: Record{Type: 'g', Schema: green2013Schema, Val: "2,2013-08-31 23:50:00,2013-09-01 00:10:00,N,1,-74.0,40.752,-73.95,40.781,3,5.0,18.5,0.5,0.5,1.8,0,,21.3,1,,,"},
+		bits: map[string]uint64{
+			"cab_type":             0,
+			"passenger_count":      3,
+			"total_amount_dollars": 21,
+			"pickup_time":          47,
+			"pickup_day":           6,
+			"pickup_mday":          31,
+			"pickup_month":         8,
+			"pickup_year":          2013,
+			"drop_time":            0,
+			"drop_day":             0,
+			"drop_mday":            1,
+			"drop_month":           9,
+			"drop_year":            2013,
+			"dist_miles":           5,
+			"duration_minutes":     20,
+			"speed_mph":            15,
+			"pickup_grid_id":       4660,
+			"drop_grid_id":         5566,
+			"pickup_elevation":     elevationBit(4660),
+			"drop_elevation":       elevationBit(5566),
+		},
+	},
+	{
+		rec: Record{Type: 'y', Schema: yellow2015Schema, Val: "2,2015-01-15 19:05:39,2015-01-15 19:23:42,1,1.59,-73.993896484375,40.750110626220703,1,N,-73.974784851074219,40.750617980957031,1,12,1,0.5,3.25,0,0.3,17.05"},
+		bits: map[string]uint64{
+			"cab_type":             1,
+			"passenger_count":      1,
+			"total_amount_dollars": 17,
+			"pickup_time":          38,
+			"pickup_day":           4,
+			"pickup_mday":          15,
+			"pickup_month":         1,
+			"pickup_year":          2015,
+			"drop_time":            38,
+			"drop_day":             4,
+			"drop_mday":            15,
+			"drop_month":           1,
+			"drop_year":            2015,
+			"dist_miles":           2,
+			"duration_minutes":     18,
+			"speed_mph":            5,
+			"pickup_grid_id":       4760,
+			"drop_grid_id":         5060,
+			"pickup_elevation":     elevationBit(4760),
+			"drop_elevation":       elevationBit(5060),
+		},
+	},
+}
+
+// elevationBit is the elevation frame bit for grid cell id.
+func elevationBit(id int) uint64 {
+	return uint64(46 * (elevations[id] + 32) / 227)
+}
+
+// mapRecord returns the bits the mapper table sets for rec, by frame.
+func mapRecord(t *testing.T, rec Record) map[string]uint64 {
+	w := &PilosaWriter{bms: getSchemaBitMappers()}
+	bits, ok := w.bits(&rec, NewRecordManager())
+	if !ok {
+		t.Fatalf("record was skipped: %v", rec)
+	}
+	frames := make(map[string]uint64, len(bits))
+	for _, bit := range bits {
+		if _, ok := frames[bit.Frame]; ok {
+			t.Fatalf("several bits in frame %s", bit.Frame)
+		}
+		frames[bit.Frame] = bit.Bit
+	}
+	return frames
+}
+
+// checkFrames compares the bits in frames for every known record.
+func checkFrames(t *testing.T, frames ...string) {
+	for _, known := range mapperRecords {
+		bits := mapRecord(t, known.rec)
+		for _, frame := range frames {
+			got, ok := bits[frame]
+			if !ok {
+				t.Errorf("%c: no bit in frame %s", known.rec.Type, frame)
+			} else if got != known.bits[frame] {
+				t.Errorf("%c: frame %s got bit %d, expected %d", known.rec.Type, frame, got, known.bits[frame])
+			}
+		}
+	}
+}
+
+func TestMapperTable(t *testing.T) {
+	for _, known := range mapperRecords {
+		bits := mapRecord(t, known.rec)
+		if len(bits) != len(known.bits) {
+			t.Errorf("%c: expected bits in %d frames, got %v", known.rec.Type, len(known.bits), bits)
+		}
+	}
+}
+
 func TestTimeMapper(t *testing.T) {
-	// TODO implement
+	checkFrames(t, "pickup_time", "drop_time")
 }
 
 func TestDayMapper(t *testing.T) {
-	// TODO implement
+	checkFrames(t, "pickup_day", "drop_day", "pickup_mday", "drop_mday")
 }
 
 func TestMonthMapper(t *testing.T) {
-	// TODO implement
+	checkFrames(t, "pickup_month", "drop_month", "pickup_year", "drop_year")
 }
 
 func TestIntMapper(t *testing.T) {
-	// TODO implement
+	checkFrames(t, "cab_type", "passenger_count")
 }
 
 func TestSparseIntMapper(t *testing.T) {
-	// TODO implement
+	checkFrames(t, "pickup_grid_id", "drop_grid_id")
 }
 
 func TestFloatMapper(t *testing.T) {
-	// TODO implement
+	checkFrames(t, "total_amount_dollars", "dist_miles")
 }
 
 func TestArbitraryFloatMapper(t *testing.T) {
-	// TODO implement
-}
-
-// func TestGridMapper(t *testing.T) {
-// 	gm := pdk.GridMapper{
-// 		Xmin: -5,
-// 		Xmax: 5,
-// 		Xres: 100,
-// 		Ymin: -5,
-// 		Ymax: 5,
-// 		Yres: 100,
-// 	}
-
-// 	gmid, err := gm.ID(pdk.Point{X: -5, Y: -5})
-// 	if err != nil || gmid != 0 {
-// 		t.Fatalf("invalid results from gm.ID: %v, %v", gmid, err)
-// 	}
-// 	gmid, err = gm.ID(pdk.Point{X: -2.5, Y: 4.3})
-// 	if err != nil || gmid != 2593 {
-// 		t.Fatalf("invalid results from gm.ID: %v, %v", gmid, err)
-// 	}
-// 	gmid, err = gm.ID(pdk.Point{X: 0, Y: 8})
-// 	if err == nil {
-// 		t.Fatalf("out of bounds error not raised: %v", gmid)
-// 	}
-
-// }
+	checkFrames(t, "duration_minutes", "speed_mph", "pickup_elevation", "drop_elevation")
+}
+
+func TestGridMapper(t *testing.T) {
+	gm := pdk.GridMapper{
+		Xmin: -5,
+		Xmax: 5,
+		Xres: 100,
+		Ymin: -5,
+		Ymax: 5,
+		Yres: 100,
+	}
+
+	gmid, err := gm.ID(-5.0, -5.0)
+	if err != nil || gmid[0] != 0 {
+		t.Fatalf("invalid results from gm.ID: %v, %v", gmid, err)
+	}
+	gmid, err = gm.ID(-2.5, 4.3)
+	if err != nil || gmid[0] != 2593 {
+		t.Fatalf("invalid results from gm.ID: %v, %v", gmid, err)
+	}
+	gmid, err = gm.ID(0.0, 8.0)
+	if err == nil {
+		t.Fatalf("out of bounds error not raised: %v", gmid)
+	}
+}
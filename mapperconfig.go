@@ -0,0 +1,610 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pilosa/pdk"
+	"github.com/pkg/errors"
+)
+
+// MapperConfig describes the Pilosa frames and how a record's fields map to
+// bits in them, so binning can change without recompiling. It is read from
+// JSON like
+//
+//	{"frames": [
+//	    {"frame": "passenger_count", "fields": ["passenger_count"], "parser": "int",
+//	     "mapper": {"type": "int", "min": 0, "max": 9}},
+//	    {"frame": "duration_minutes", "fields": ["pickup_datetime", "dropoff_datetime"],
+//	     "parser": "time", "func": "duration_minutes",
+//	     "mapper": {"type": "linear_float", "min": -0.5, "max": 3600.5, "res": 3601}}
+//	]}
+//
+// The cab_type frame is always set and isn't part of the config.
+//
+// IntFields are range-encoded integer fields, which keep exact values
+// instead of bins, e.g.
+//
+//	{"field": "total_amount_cents", "fields": ["total_amount"], "parser": "float",
+//	 "scale": 100, "min": -1000000, "max": 1000000}
+//
+// Frames with a time_quantum get their bits at the time in TimeField,
+// pickup_datetime unless set.
+//
+// ColumnAttrs keep raw values of each ride as attributes of its column, e.g.
+//
+//	{"attr": "fare", "field": "fare_amount", "parser": "float"}
+type MapperConfig struct {
+	Frames      []FrameConfig    `json:"frames"`
+	IntFields   []IntFieldConfig `json:"int_fields,omitempty"`
+	TimeField   string           `json:"time_field,omitempty"`
+	ColumnAttrs []AttrConfig     `json:"column_attrs,omitempty"`
+}
+
+// FrameConfig maps the named fields of a record to a frame. Fields are
+// parsed with Parser, or with the matching entry of Parsers. If Func is
+// set, the parsed fields are combined into a single value by the derived
+// function of that name before being mapped. RowAttrs describes each row of
+// the frame with attributes, such as the center of a grid cell or the range
+// of a bin.
+type FrameConfig struct {
+	Frame       string     `json:"frame"`
+	Fields      []string   `json:"fields"`
+	Parser      string     `json:"parser,omitempty"`
+	Parsers     []string   `json:"parsers,omitempty"`
+	Layout      string     `json:"layout,omitempty"`
+	Func        string     `json:"func,omitempty"`
+	Mapper      MapperSpec `json:"mapper"`
+	TimeQuantum string     `json:"time_quantum,omitempty"`
+	RowAttrs    bool       `json:"row_attrs,omitempty"`
+}
+
+// IntFieldConfig describes a range-encoded integer field, in a frame of the
+// same name. The fields are parsed and combined as for a FrameConfig, and
+// the value is multiplied by Scale, 1 unless set, and rounded. Values
+// outside Min..Max aren't stored.
+type IntFieldConfig struct {
+	Field   string   `json:"field"`
+	Fields  []string `json:"fields"`
+	Parser  string   `json:"parser,omitempty"`
+	Parsers []string `json:"parsers,omitempty"`
+	Layout  string   `json:"layout,omitempty"`
+	Func    string   `json:"func,omitempty"`
+	Scale   float64  `json:"scale,omitempty"`
+	Min     int64    `json:"min"`
+	Max     int64    `json:"max"`
+}
+
+// AttrConfig stores the named field of a record as the column attribute
+// Attr. The value is kept as a string unless Parser is int or float.
+type AttrConfig struct {
+	Attr   string `json:"attr"`
+	Field  string `json:"field"`
+	Parser string `json:"parser,omitempty"`
+}
+
+// MapperSpec describes a pdk.Mapper. Type is one of
+//   - int: Min..Max
+//   - linear_float: Res equal bins between Min and Max
+//   - float_buckets: bins between consecutive Buckets
+//   - time_of_day: Res bins per day
+//   - day_of_week, day_of_month, month, year
+//   - grid: Xres by Yres cells between Xmin..Xmax and Ymin..Ymax; Lookup
+//     optionally names a table describing the cells in row attributes
+//   - grid_lookup: the grid cell is looked up in the table named Lookup and
+//     the value mapped with Values
+type MapperSpec struct {
+	Type    string      `json:"type"`
+	Min     float64     `json:"min,omitempty"`
+	Max     float64     `json:"max,omitempty"`
+	Res     float64     `json:"res,omitempty"`
+	Buckets []float64   `json:"buckets,omitempty"`
+	Xmin    float64     `json:"xmin,omitempty"`
+	Xmax    float64     `json:"xmax,omitempty"`
+	Xres    int64       `json:"xres,omitempty"`
+	Ymin    float64     `json:"ymin,omitempty"`
+	Ymax    float64     `json:"ymax,omitempty"`
+	Yres    int64       `json:"yres,omitempty"`
+	Lookup  string      `json:"lookup,omitempty"`
+	Values  *MapperSpec `json:"values,omitempty"`
+}
+
+const defaultTimeLayout = "2006-01-02 15:04:05"
+
+// derivedFuncs are the functions a FrameConfig can name to compute a value
+// from several fields.
+var derivedFuncs = map[string]func(fields ...interface{}) interface{}{
+	// duration_minutes takes the pickup and dropoff times.
+	"duration_minutes": func(fields ...interface{}) interface{} {
+		start := fields[0].(time.Time)
+		end := fields[1].(time.Time)
+		return end.Sub(start).Minutes()
+	},
+	// speed_mph takes the pickup and dropoff times and the distance in miles.
+	"speed_mph": func(fields ...interface{}) interface{} {
+		start := fields[0].(time.Time)
+		end := fields[1].(time.Time)
+		dist := fields[2].(float64)
+		return dist / end.Sub(start).Hours()
+	},
+}
+
+// derivedFuncArgs is the number of fields each derived function takes.
+var derivedFuncArgs = map[string]int{
+	"duration_minutes": 2,
+	"speed_mph":        3,
+}
+
+// lookupTables are the tables a grid_lookup mapper can name.
+var lookupTables = map[string][]float64{
+	"elevations": elevations,
+}
+
+// lookupAttrs are the row attributes holding a lookup table's value for a
+// grid cell.
+var lookupAttrs = map[string]string{
+	"elevations": "elevation",
+}
+
+// readMapperConfig reads a MapperConfig from a JSON file and checks it.
+func readMapperConfig(path string) (*MapperConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := &MapperConfig{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("reading mapper config %s", path))
+	}
+	for _, schema := range schemas {
+		if _, err := config.bitMappers(schema.Fields); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("mapper config %s, schema %s", path, schema))
+		}
+		if _, err := config.intFields(schema.Fields); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("mapper config %s, schema %s", path, schema))
+		}
+		if _, err := config.attrMappers(schema.Fields); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("mapper config %s, schema %s", path, schema))
+		}
+	}
+	for _, fc := range config.Frames {
+		if !validTimeQuantum(fc.TimeQuantum) {
+			return nil, fmt.Errorf("mapper config %s: bad time quantum %q for frame %s", path, fc.TimeQuantum, fc.Frame)
+		}
+	}
+	if _, err := config.rowAttrs(); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("mapper config %s", path))
+	}
+	return config, nil
+}
+
+// frames returns the names of all frames the config sets bits or values in.
+func (c *MapperConfig) frames() []string {
+	frames := []string{"cab_type"}
+	for _, fc := range c.Frames {
+		frames = append(frames, fc.Frame)
+	}
+	for _, ic := range c.IntFields {
+		frames = append(frames, ic.Field)
+	}
+	return frames
+}
+
+// timeField returns the field holding the time of timed bits.
+func (c *MapperConfig) timeField() string {
+	if c.TimeField == "" {
+		return "pickup_datetime"
+	}
+	return c.TimeField
+}
+
+// validTimeQuantum reports whether q is empty or a Pilosa time quantum: Y,
+// M, D and H, in that order, without gaps.
+func validTimeQuantum(q string) bool {
+	return q == "" || strings.Contains("YMDH", q)
+}
+
+// schemaBitMappers returns the bit mappers for every schema.
+func (c *MapperConfig) schemaBitMappers() (map[*Schema][]pdk.BitMapper, error) {
+	bms := make(map[*Schema][]pdk.BitMapper, len(schemas))
+	for _, schema := range schemas {
+		var err error
+		bms[schema], err = c.bitMappers(schema.Fields)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("schema %s", schema))
+		}
+	}
+	return bms, nil
+}
+
+// schemaAttrMappers returns the column attribute mappers for every schema.
+func (c *MapperConfig) schemaAttrMappers() (map[*Schema][]attrMapper, error) {
+	ams := make(map[*Schema][]attrMapper, len(schemas))
+	for _, schema := range schemas {
+		var err error
+		ams[schema], err = c.attrMappers(schema.Fields)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("schema %s", schema))
+		}
+	}
+	return ams, nil
+}
+
+// bitMappers builds the bit mappers for a schema with the given fields.
+func (c *MapperConfig) bitMappers(fields map[string]int) ([]pdk.BitMapper, error) {
+	seen := make(map[string]bool)
+	bms := make([]pdk.BitMapper, 0, len(c.Frames))
+	for _, fc := range c.Frames {
+		if fc.Frame == "" || fc.Frame == "cab_type" || seen[fc.Frame] {
+			return nil, fmt.Errorf("bad or duplicate frame name %q", fc.Frame)
+		}
+		seen[fc.Frame] = true
+		bm, err := fc.bitMapper(fields)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("frame %s", fc.Frame))
+		}
+		bms = append(bms, bm)
+	}
+	return bms, nil
+}
+
+func (fc FrameConfig) bitMapper(fields map[string]int) (pdk.BitMapper, error) {
+	bm := pdk.BitMapper{Frame: fc.Frame}
+	var err error
+	var f func(...interface{}) interface{}
+	bm.Fields, bm.Parsers, f, err = fc.inputs(fields)
+	if err != nil {
+		return bm, err
+	}
+	bm.Mapper, err = fc.Mapper.mapper()
+	if err != nil {
+		return bm, err
+	}
+	if f != nil {
+		bm.Mapper = pdk.CustomMapper{Func: f, Mapper: bm.Mapper}
+	}
+	return bm, nil
+}
+
+// inputs returns the indexes of the fields fc reads, their parsers and the
+// derived function combining them, if any.
+func (fc FrameConfig) inputs(fields map[string]int) ([]int, []pdk.Parser, func(...interface{}) interface{}, error) {
+	if len(fc.Fields) == 0 {
+		return nil, nil, nil, fmt.Errorf("no fields")
+	}
+	indexes := make([]int, 0, len(fc.Fields))
+	for _, name := range fc.Fields {
+		i, ok := fields[name]
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("unknown field %s", name)
+		}
+		indexes = append(indexes, i)
+	}
+
+	names := fc.Parsers
+	if len(names) == 0 {
+		if fc.Parser == "" {
+			return nil, nil, nil, fmt.Errorf("no parser")
+		}
+		for range fc.Fields {
+			names = append(names, fc.Parser)
+		}
+	}
+	if len(names) != len(fc.Fields) {
+		return nil, nil, nil, fmt.Errorf("%d parsers for %d fields", len(names), len(fc.Fields))
+	}
+	parsers := make([]pdk.Parser, 0, len(names))
+	for _, name := range names {
+		p, err := fc.parser(name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		parsers = append(parsers, p)
+	}
+
+	if fc.Func == "" {
+		return indexes, parsers, nil, nil
+	}
+	f, ok := derivedFuncs[fc.Func]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("unknown func %s", fc.Func)
+	}
+	if derivedFuncArgs[fc.Func] != len(fc.Fields) {
+		return nil, nil, nil, fmt.Errorf("func %s takes %d fields", fc.Func, derivedFuncArgs[fc.Func])
+	}
+	return indexes, parsers, f, nil
+}
+
+// intField is an IntFieldConfig resolved against a schema.
+type intField struct {
+	name    string
+	fields  []int
+	parsers []pdk.Parser
+	f       func(...interface{}) interface{}
+	scale   float64
+	min     int64
+	max     int64
+}
+
+// intFields resolves the int fields for a schema with the given fields.
+func (c *MapperConfig) intFields(fields map[string]int) ([]intField, error) {
+	seen := make(map[string]bool)
+	for _, fc := range c.Frames {
+		seen[fc.Frame] = true
+	}
+	ifs := make([]intField, 0, len(c.IntFields))
+	for _, ic := range c.IntFields {
+		if ic.Field == "" || ic.Field == "cab_type" || seen[ic.Field] {
+			return nil, fmt.Errorf("bad or duplicate field name %q", ic.Field)
+		}
+		seen[ic.Field] = true
+		if ic.Max < ic.Min {
+			return nil, fmt.Errorf("field %s: max is less than min", ic.Field)
+		}
+		fc := FrameConfig{Frame: ic.Field, Fields: ic.Fields, Parser: ic.Parser, Parsers: ic.Parsers, Layout: ic.Layout, Func: ic.Func}
+		indexes, parsers, f, err := fc.inputs(fields)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("field %s", ic.Field))
+		}
+		scale := ic.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		ifs = append(ifs, intField{name: ic.Field, fields: indexes, parsers: parsers, f: f, scale: scale, min: ic.Min, max: ic.Max})
+	}
+	return ifs, nil
+}
+
+// value computes the field's value from the fields of a record.
+func (f intField) value(fields []string) (int64, error) {
+	parsed := make([]interface{}, 0, len(f.fields))
+	for n, i := range f.fields {
+		if i >= len(fields) {
+			return 0, fmt.Errorf("field index %d out of range", i)
+		}
+		v, err := f.parsers[n].Parse(fields[i])
+		if err != nil {
+			return 0, err
+		}
+		parsed = append(parsed, v)
+	}
+	v := parsed[0]
+	if f.f != nil {
+		v = f.f(parsed...)
+	}
+	var x float64
+	switch v := v.(type) {
+	case int64:
+		x = float64(v)
+	case float64:
+		x = v
+	default:
+		return 0, fmt.Errorf("can't store %v as an int", v)
+	}
+	x = math.Floor(x*f.scale + 0.5)
+	if math.IsNaN(x) || x < float64(f.min) || x > float64(f.max) {
+		return 0, fmt.Errorf("value %v out of range", x)
+	}
+	return int64(x), nil
+}
+
+func (fc FrameConfig) parser(name string) (pdk.Parser, error) {
+	switch name {
+	case "int":
+		return pdk.IntParser{}, nil
+	case "float":
+		return pdk.FloatParser{}, nil
+	case "string":
+		return pdk.StringParser{}, nil
+	case "time":
+		layout := fc.Layout
+		if layout == "" {
+			layout = defaultTimeLayout
+		}
+		return pdk.TimeParser{Layout: layout}, nil
+	}
+	return nil, fmt.Errorf("unknown parser %s", name)
+}
+
+func (s *MapperSpec) mapper() (pdk.Mapper, error) {
+	switch s.Type {
+	case "int":
+		return pdk.IntMapper{Min: int64(s.Min), Max: int64(s.Max)}, nil
+	case "linear_float":
+		if s.Res <= 0 || s.Max <= s.Min {
+			return nil, fmt.Errorf("linear_float needs min < max and res > 0")
+		}
+		return pdk.LinearFloatMapper{Min: s.Min, Max: s.Max, Res: s.Res}, nil
+	case "float_buckets":
+		if len(s.Buckets) < 2 {
+			return nil, fmt.Errorf("float_buckets needs at least 2 buckets")
+		}
+		return pdk.FloatMapper{Buckets: s.Buckets}, nil
+	case "time_of_day":
+		if s.Res <= 0 {
+			return nil, fmt.Errorf("time_of_day needs res > 0")
+		}
+		return pdk.TimeOfDayMapper{Res: int64(s.Res)}, nil
+	case "day_of_week":
+		return pdk.DayOfWeekMapper{}, nil
+	case "day_of_month":
+		return pdk.DayOfMonthMapper{}, nil
+	case "month":
+		return pdk.MonthMapper{}, nil
+	case "year":
+		return pdk.YearMapper{}, nil
+	case "grid":
+		return s.grid()
+	case "grid_lookup":
+		gm, err := s.grid()
+		if err != nil {
+			return nil, err
+		}
+		table, ok := lookupTables[s.Lookup]
+		if !ok {
+			return nil, fmt.Errorf("unknown lookup table %q", s.Lookup)
+		}
+		if int64(len(table)) < gm.Xres*gm.Yres {
+			return nil, fmt.Errorf("lookup table %s has %d values for %d grid cells", s.Lookup, len(table), gm.Xres*gm.Yres)
+		}
+		if s.Values == nil || s.Values.Type != "linear_float" {
+			return nil, fmt.Errorf("grid_lookup needs linear_float values")
+		}
+		values, err := s.Values.mapper()
+		if err != nil {
+			return nil, err
+		}
+		return pdk.NewGridToFloatMapper(gm, values.(pdk.LinearFloatMapper), table), nil
+	}
+	return nil, fmt.Errorf("unknown mapper type %q", s.Type)
+}
+
+// attrName matches the attribute names PQL accepts unquoted.
+var attrName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// attrMapper reads a column attribute from a record's fields.
+type attrMapper struct {
+	attr   string
+	field  int
+	parser pdk.Parser
+}
+
+// attrMappers resolves the column attributes for a schema with the given
+// fields.
+func (c *MapperConfig) attrMappers(fields map[string]int) ([]attrMapper, error) {
+	seen := make(map[string]bool)
+	ams := make([]attrMapper, 0, len(c.ColumnAttrs))
+	for _, ac := range c.ColumnAttrs {
+		if !attrName.MatchString(ac.Attr) || seen[ac.Attr] {
+			return nil, fmt.Errorf("bad or duplicate attribute name %q", ac.Attr)
+		}
+		seen[ac.Attr] = true
+		i, ok := fields[ac.Field]
+		if !ok {
+			return nil, fmt.Errorf("attribute %s: unknown field %s", ac.Attr, ac.Field)
+		}
+		am := attrMapper{attr: ac.Attr, field: i}
+		switch ac.Parser {
+		case "", "string":
+		case "int":
+			am.parser = pdk.IntParser{}
+		case "float":
+			am.parser = pdk.FloatParser{}
+		default:
+			return nil, fmt.Errorf("attribute %s: unsupported parser %s", ac.Attr, ac.Parser)
+		}
+		ams = append(ams, am)
+	}
+	return ams, nil
+}
+
+// value returns the attribute's value in fields, reporting false if the
+// field is empty or doesn't parse.
+func (am attrMapper) value(fields []string) (interface{}, bool) {
+	if am.field >= len(fields) || fields[am.field] == "" {
+		return nil, false
+	}
+	if am.parser == nil {
+		return fields[am.field], true
+	}
+	v, err := am.parser.Parse(fields[am.field])
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// rowAttrs returns the row attributes of the frames with RowAttrs set, by
+// frame and row.
+func (c *MapperConfig) rowAttrs() (map[string]map[uint64]map[string]interface{}, error) {
+	attrs := make(map[string]map[uint64]map[string]interface{})
+	for _, fc := range c.Frames {
+		if !fc.RowAttrs {
+			continue
+		}
+		rows, err := fc.Mapper.rowAttrs()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("frame %s", fc.Frame))
+		}
+		attrs[fc.Frame] = rows
+	}
+	return attrs, nil
+}
+
+// rowAttrs describes the rows of the mapper: the center of grid cells, with
+// the value of the grid's lookup table if any, and the range of float bins.
+func (s *MapperSpec) rowAttrs() (map[uint64]map[string]interface{}, error) {
+	rows := make(map[uint64]map[string]interface{})
+	switch s.Type {
+	case "grid":
+		gm, err := s.grid()
+		if err != nil {
+			return nil, err
+		}
+		var table []float64
+		if s.Lookup != "" {
+			var ok bool
+			table, ok = lookupTables[s.Lookup]
+			if !ok || int64(len(table)) < gm.Xres*gm.Yres {
+				return nil, fmt.Errorf("bad lookup table %q", s.Lookup)
+			}
+		}
+		dx := (gm.Xmax - gm.Xmin) / float64(gm.Xres)
+		dy := (gm.Ymax - gm.Ymin) / float64(gm.Yres)
+		for xi := int64(0); xi < gm.Xres; xi++ {
+			for yi := int64(0); yi < gm.Yres; yi++ {
+				id := gm.Yres*xi + yi
+				row := map[string]interface{}{
+					"center_lon": gm.Xmin + (float64(xi)+0.5)*dx,
+					"center_lat": gm.Ymin + (float64(yi)+0.5)*dy,
+				}
+				if table != nil {
+					row[lookupAttrs[s.Lookup]] = table[id]
+				}
+				rows[uint64(id)] = row
+			}
+		}
+	case "grid_lookup":
+		if s.Values == nil {
+			return nil, fmt.Errorf("grid_lookup needs values")
+		}
+		return s.Values.rowAttrs()
+	case "linear_float":
+		if s.Res <= 0 || s.Max <= s.Min {
+			return nil, fmt.Errorf("linear_float needs min < max and res > 0")
+		}
+		width := (s.Max - s.Min) / s.Res
+		for i := 0; i < int(s.Res); i++ {
+			rows[uint64(i)] = map[string]interface{}{"min": s.Min + float64(i)*width, "max": s.Min + float64(i+1)*width}
+		}
+	case "float_buckets":
+		for i := 0; i+1 < len(s.Buckets); i++ {
+			rows[uint64(i)] = map[string]interface{}{"min": s.Buckets[i], "max": s.Buckets[i+1]}
+		}
+	default:
+		return nil, fmt.Errorf("no row attributes for %s mappers", s.Type)
+	}
+	return rows, nil
+}
+
+func (s *MapperSpec) grid() (pdk.GridMapper, error) {
+	if s.Xres <= 0 || s.Yres <= 0 || s.Xmax <= s.Xmin || s.Ymax <= s.Ymin {
+		return pdk.GridMapper{}, fmt.Errorf("%s needs xmin < xmax, ymin < ymax and positive resolutions", s.Type)
+	}
+	return pdk.GridMapper{
+		Xmin: s.Xmin,
+		Xmax: s.Xmax,
+		Xres: s.Xres,
+		Ymin: s.Ymin,
+		Ymax: s.Ymax,
+		Yres: s.Yres,
+	}, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadMapperConfig(t *testing.T) {
+	config, err := readMapperConfig("frames.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, defaultMapperConfig) {
+		t.Fatalf("frames.json differs from the default config")
+	}
+	if len(config.frames()) != 23 {
+		t.Fatalf("expected 23 frames, got %v", config.frames())
+	}
+}
+
+func TestMapperConfigRebin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mappers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frames.json")
+	content := `{"frames": [
+		{"frame": "total_amount_dollars", "fields": ["total_amount"], "parser": "float",
+		 "mapper": {"type": "float_buckets", "buckets": [0, 5, 10, 20, 50, 100]}},
+		{"frame": "speed_mph", "fields": ["pickup_datetime", "dropoff_datetime", "trip_distance"],
+		 "parsers": ["time", "time", "float"], "func": "speed_mph",
+		 "mapper": {"type": "linear_float", "min": 0, "max": 100, "res": 10}}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := readMapperConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bms, err := config.schemaBitMappers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &PilosaWriter{bms: bms}
+	rec := mapperRecords[0].rec
+	bits, ok := w.bits(&rec, NewRecordManager())
+	if !ok {
+		t.Fatalf("record was skipped")
+	}
+	expected := []BitFrame{{Bit: 0, Frame: "cab_type"}, {Bit: 3, Frame: "total_amount_dollars"}, {Bit: 1, Frame: "speed_mph"}}
+	if !reflect.DeepEqual(bits, expected) {
+		t.Fatalf("expected %v, got %v", expected, bits)
+	}
+}
+
+func TestMapperConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mappers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frames.json")
+
+	for _, frame := range []string{
+		`{"frame": "a", "fields": ["no_such_field"], "parser": "float", "mapper": {"type": "year"}}`,
+		`{"frame": "a", "fields": ["trip_distance"], "parser": "complex", "mapper": {"type": "year"}}`,
+		`{"frame": "a", "fields": ["trip_distance"], "mapper": {"type": "year"}}`,
+		`{"frame": "a", "fields": ["trip_distance"], "parsers": ["float", "float"], "mapper": {"type": "year"}}`,
+		`{"frame": "a", "fields": ["trip_distance"], "parser": "float", "mapper": {"type": "log"}}`,
+		`{"frame": "a", "fields": ["trip_distance"], "parser": "float", "mapper": {"type": "linear_float", "min": 1, "max": 0, "res": 5}}`,
+		`{"frame": "a", "fields": ["trip_distance"], "parser": "float", "func": "tip_percent", "mapper": {"type": "year"}}`,
+		`{"frame": "a", "fields": ["trip_distance"], "parser": "float", "func": "speed_mph", "mapper": {"type": "year"}}`,
+		`{"frame": "a", "fields": ["trip_distance"], "parser": "float", "mapper": {"type": "grid_lookup", "xmin": 0, "xmax": 1, "xres": 1000, "ymin": 0, "ymax": 1, "yres": 1000, "lookup": "elevations"}}`,
+		`{"frame": "cab_type", "fields": ["trip_distance"], "parser": "float", "mapper": {"type": "year"}}`,
+		`{"frame": "a", "fields": ["trip_distance"], "parser": "float", "mapper": {"type": "year"}, "color": "red"}`,
+		// green schemas have no improvement surcharge
+		`{"frame": "a", "fields": ["improvement_surcharge"], "parser": "float", "mapper": {"type": "year"}}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(`{"frames": [`+frame+`]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readMapperConfig(path); err == nil {
+			t.Errorf("expected an error for %s", frame)
+		}
+	}
+
+	for _, config := range []string{
+		`{"frames": [{"frame": "a", "fields": ["trip_distance"], "parser": "float", "mapper": {"type": "year"}, "time_quantum": "YD"}]}`,
+		`{"frames": [{"frame": "a", "fields": ["trip_distance"], "parser": "float", "mapper": {"type": "year"}, "time_quantum": "W"}]}`,
+		`{"frames": [], "int_fields": [{"field": "a", "fields": ["trip_distance"], "parser": "float", "min": 10, "max": 0}]}`,
+		`{"frames": [], "int_fields": [{"field": "a", "fields": ["no_such_field"], "parser": "float", "max": 10}]}`,
+		`{"frames": [], "int_fields": [{"field": "cab_type", "fields": ["trip_distance"], "parser": "float", "max": 10}]}`,
+		`{"frames": [{"frame": "a", "fields": ["trip_distance"], "parser": "float", "mapper": {"type": "year"}}],
+		  "int_fields": [{"field": "a", "fields": ["trip_distance"], "parser": "float", "max": 10}]}`,
+		`{"frames": [], "column_attrs": [{"attr": "fare amount", "field": "fare_amount"}]}`,
+		`{"frames": [], "column_attrs": [{"attr": "fare", "field": "fare_amount", "parser": "time"}]}`,
+		`{"frames": [{"frame": "a", "fields": ["trip_distance"], "parser": "float", "mapper": {"type": "year"}, "row_attrs": true}]}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readMapperConfig(path); err == nil {
+			t.Errorf("expected an error for %s", config)
+		}
+	}
+}
@@ -1,28 +1,62 @@
 package main
 
 import (
-	"sync"
+	"sync/atomic"
 )
 
-// Nexter generates unique sequential ids in a threadsafe way.
+// Nexter generates unique sequential ids in a threadsafe way. Busy workers
+// should take their ids from an IDRange, so they only touch the Nexter once
+// per block of ids.
 type Nexter struct {
 	id   uint64
-	lock sync.Mutex
+	used Counter
 }
 
 // Next generates a new id
-func (n *Nexter) Next() (nextID uint64) {
-	n.lock.Lock()
-	nextID = n.id
-	n.id++
-	//fmt.Printf("Next id %d\n", n.id)
-	n.lock.Unlock()
-	return
-}
-
-func (n *Nexter) Last() (lastID uint64) {
-	n.lock.Lock()
-	lastID = n.id - 1
-	n.lock.Unlock()
-	return
+func (n *Nexter) Next() uint64 {
+	n.used.Add(1)
+	return atomic.AddUint64(&n.id, 1) - 1
+}
+
+// Reserve reserves count consecutive ids and returns the first of them.
+func (n *Nexter) Reserve(count uint64) uint64 {
+	return atomic.AddUint64(&n.id, count) - count
+}
+
+// Reserved returns the first id that hasn't been handed out or reserved.
+func (n *Nexter) Reserved() uint64 {
+	return atomic.LoadUint64(&n.id)
+}
+
+// Used returns the number of ids handed out so far, including those handed
+// out by IDRanges but not ids they reserved and haven't handed out yet.
+func (n *Nexter) Used() int64 {
+	return n.used.Get()
+}
+
+// NewRange returns an IDRange reserving blockSize ids at a time from n.
+func (n *Nexter) NewRange(blockSize uint64) *IDRange {
+	return &IDRange{nexter: n, blockSize: blockSize}
+}
+
+// IDRange hands out ids from blocks reserved from a Nexter. Ids are unique
+// across all ranges of a Nexter, but only sequential within a block. An
+// IDRange must not be shared between goroutines.
+type IDRange struct {
+	nexter    *Nexter
+	blockSize uint64
+	next, end uint64
+}
+
+// Next returns a new id, reserving another block when the current one is
+// used up.
+func (r *IDRange) Next() uint64 {
+	if r.next == r.end {
+		r.next = r.nexter.Reserve(r.blockSize)
+		r.end = r.next + r.blockSize
+	}
+	id := r.next
+	r.next++
+	r.nexter.used.Add(1)
+	return id
 }
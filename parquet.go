@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// ParquetRide is a row of the Parquet files. The pickup year and month and
+// the cab type are in the path of the file rather than in its rows.
+// Coordinates are null where missing.
+type ParquetRide struct {
+	VendorID        string   `parquet:"name=vendor_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	PickupTime      int64    `parquet:"name=pickup_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	DropoffTime     int64    `parquet:"name=dropoff_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	PassengerCount  int32    `parquet:"name=passenger_count, type=INT32"`
+	DistanceMiles   float64  `parquet:"name=distance_miles, type=DOUBLE"`
+	DurationMinutes float64  `parquet:"name=duration_minutes, type=DOUBLE"`
+	SpeedMph        float64  `parquet:"name=speed_mph, type=DOUBLE"`
+	TotalAmount     float64  `parquet:"name=total_amount, type=DOUBLE"`
+	PickupLon       *float64 `parquet:"name=pickup_longitude, type=DOUBLE, repetitiontype=OPTIONAL"`
+	PickupLat       *float64 `parquet:"name=pickup_latitude, type=DOUBLE, repetitiontype=OPTIONAL"`
+	DropoffLon      *float64 `parquet:"name=dropoff_longitude, type=DOUBLE, repetitiontype=OPTIONAL"`
+	DropoffLat      *float64 `parquet:"name=dropoff_latitude, type=DOUBLE, repetitiontype=OPTIONAL"`
+}
+
+// newParquetRide returns the row for ride.
+func newParquetRide(ride *Ride) *ParquetRide {
+	row := &ParquetRide{
+		VendorID:        ride.VendorID,
+		PickupTime:      ride.PickupTime.UnixNano() / int64(time.Millisecond),
+		DropoffTime:     ride.DropTime.UnixNano() / int64(time.Millisecond),
+		PassengerCount:  int32(ride.PassengerCount),
+		DistanceMiles:   ride.DistMiles,
+		DurationMinutes: ride.DurationMinutes,
+		SpeedMph:        ride.SpeedMph,
+		TotalAmount:     ride.TotalDollars,
+	}
+	if ride.PickupLon != 0 || ride.PickupLat != 0 {
+		lon, lat := ride.PickupLon, ride.PickupLat
+		row.PickupLon, row.PickupLat = &lon, &lat
+	}
+	if ride.DropLon != 0 || ride.DropLat != 0 {
+		lon, lat := ride.DropLon, ride.DropLat
+		row.DropoffLon, row.DropoffLat = &lon, &lat
+	}
+	return row
+}
+
+// compressionCodecs are the codecs a ParquetWriter can use, by name.
+var compressionCodecs = map[string]parquet.CompressionCodec{
+	"none":   parquet.CompressionCodec_UNCOMPRESSED,
+	"snappy": parquet.CompressionCodec_SNAPPY,
+	"gzip":   parquet.CompressionCodec_GZIP,
+	"zstd":   parquet.CompressionCodec_ZSTD,
+}
+
+// rowFile is a file rows are written to.
+type rowFile interface {
+	Write(row interface{}) error
+	Close() error
+}
+
+// ParquetWriter writes rides to Parquet files under Dir, partitioned Hive
+// style as
+//
+//	pickup_year=2015/pickup_month=01/cab_type=yellow/part-00000.parquet
+//
+// Partitions get a new part file for every run, so earlier ones are kept.
+type ParquetWriter struct {
+	Dir string
+	// RowGroupSize is the size of the row groups in bytes, and Compression
+	// the name of the codec in compressionCodecs.
+	RowGroupSize int64
+	Compression  string
+	// MaxOpenFiles bounds the files open at once, each holding a row group
+	// in memory. The least recently written one is closed to open another,
+	// which starts a new part file for its partition if needed again.
+	MaxOpenFiles int
+
+	// create opens a file at path.
+	create func(path string) (rowFile, error)
+
+	mu    sync.Mutex
+	files map[string]*partitionFile
+	// tick orders the writes, to find the least recently written file.
+	tick uint64
+}
+
+// partitionFile is the open file of a partition.
+type partitionFile struct {
+	file rowFile
+	path string
+	used uint64
+	// held are the records written to file, stored once it is closed.
+	held heldRecords
+}
+
+// NewParquetWriter returns a ParquetWriter writing files under dir.
+func NewParquetWriter(dir string) *ParquetWriter {
+	w := &ParquetWriter{
+		Dir:          dir,
+		RowGroupSize: 128 << 20,
+		Compression:  "snappy",
+		MaxOpenFiles: 16,
+		files:        make(map[string]*partitionFile),
+	}
+	w.create = w.createParquet
+	return w
+}
+
+// createParquet opens a Parquet file of ParquetRides at path.
+func (w *ParquetWriter) createParquet(path string) (rowFile, error) {
+	codec, ok := compressionCodecs[strings.ToLower(w.Compression)]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", w.Compression)
+	}
+	fw, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := writer.NewParquetWriter(fw, new(ParquetRide), 1)
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+	pw.RowGroupSize = w.RowGroupSize
+	pw.CompressionType = codec
+	return &parquetFile{fw: fw, pw: pw}, nil
+}
+
+// parquetFile is a rowFile writing with parquet-go.
+type parquetFile struct {
+	fw interface{ Close() error }
+	pw *writer.ParquetWriter
+}
+
+func (f *parquetFile) Write(row interface{}) error {
+	return f.pw.Write(row)
+}
+
+func (f *parquetFile) Close() error {
+	err := f.pw.WriteStop()
+	if cerr := f.fw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// parquetPartition returns the directory of ride's partition, relative to
+// the Dir of a ParquetWriter.
+func parquetPartition(ride *Ride) string {
+	return filepath.Join(
+		fmt.Sprintf("pickup_year=%04d", ride.PickupTime.Year()),
+		fmt.Sprintf("pickup_month=%02d", int(ride.PickupTime.Month())),
+		"cab_type="+cabTypeName(cabTypeRune(ride.CabType)))
+}
+
+// cabTypeRune returns the record type of a Ride's CabType.
+func cabTypeRune(cabType int) rune {
+	if cabType == 0 {
+		return 'g'
+	}
+	return 'y'
+}
+
+// write adds ride to the file of its partition, then calls written with the
+// records held until that file is closed, while it is still open.
+func (w *ParquetWriter) write(ride *Ride, written func(held *heldRecords)) error {
+	part := parquetPartition(ride)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f, ok := w.files[part]
+	if !ok {
+		var err error
+		f, err = w.open(part)
+		if err != nil {
+			return err
+		}
+	}
+	w.tick++
+	f.used = w.tick
+	if err := f.file.Write(newParquetRide(ride)); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("writing %s", f.path))
+	}
+	written(&f.held)
+	return nil
+}
+
+// open starts a new part file in part, closing the least recently written
+// file if MaxOpenFiles are open.
+func (w *ParquetWriter) open(part string) (*partitionFile, error) {
+	if w.MaxOpenFiles > 0 && len(w.files) >= w.MaxOpenFiles {
+		var oldest string
+		for p, f := range w.files {
+			if oldest == "" || f.used < w.files[oldest].used {
+				oldest = p
+			}
+		}
+		f := w.files[oldest]
+		delete(w.files, oldest)
+		err := f.file.Close()
+		f.held.release(err == nil)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("closing %s", f.path))
+		}
+	}
+
+	dir := filepath.Join(w.Dir, part)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var path string
+	for n := 0; ; n++ {
+		path = filepath.Join(dir, fmt.Sprintf("part-%05d.parquet", n))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	file, err := w.create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("creating %s", path))
+	}
+	f := &partitionFile{file: file, path: path}
+	w.files[part] = f
+	return f, nil
+}
+
+// Close finishes every open file.
+func (w *ParquetWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	for part, f := range w.files {
+		cerr := f.file.Close()
+		f.held.release(cerr == nil)
+		if cerr != nil && err == nil {
+			err = errors.Wrap(cerr, fmt.Sprintf("closing %s", f.path))
+		}
+		delete(w.files, part)
+	}
+	return err
+}
+
+// ParquetImporter converts rides to Parquet files.
+type ParquetImporter struct {
+	manager *RecordManager
+	writer  *ParquetWriter
+}
+
+// NewParquetImporter returns a TaxiImporter writing Parquet files with w.
+func NewParquetImporter(r *RecordManager, w *ParquetWriter) (TaxiImporter, error) {
+	if _, ok := compressionCodecs[strings.ToLower(w.Compression)]; !ok {
+		return nil, fmt.Errorf("unknown compression %q", w.Compression)
+	}
+	if err := os.MkdirAll(w.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ParquetImporter{
+		manager: r,
+		writer:  w,
+	}, nil
+}
+
+func (i *ParquetImporter) fetch(sources <-chan Source, records chan<- []Record) {
+	i.manager.fetch(sources, records)
+}
+
+func (i *ParquetImporter) parse(records <-chan []Record) {
+	start := time.Now()
+	n := 0
+	for batch := range records {
+		for j := range batch {
+			ride, err := parseRide(&batch[j])
+			if err != nil {
+				i.manager.skip(&batch[j], "unparseable ride", nil)
+				continue
+			}
+			rec := &batch[j]
+			err = i.writer.write(ride, func(held *heldRecords) {
+				i.manager.buffered(rec, held)
+			})
+			releaseRide(ride)
+			if err != nil {
+				log.Printf("writing record %d, err: %v", rec.Seq, err)
+				i.manager.failed(rec)
+				continue
+			}
+			n++
+		}
+	}
+	log.Printf("writing %v rides took %v\n", n, time.Since(start))
+}
+
+func (i *ParquetImporter) close() {
+	if err := i.writer.Close(); err != nil {
+		log.Printf("closing Parquet files, err: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// jsonFile is a rowFile writing rows as lines of JSON.
+type jsonFile struct {
+	f *os.File
+}
+
+func createJSONFile(path string) (rowFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonFile{f}, nil
+}
+
+func (f *jsonFile) Write(row interface{}) error {
+	return json.NewEncoder(f.f).Encode(row)
+}
+
+func (f *jsonFile) Close() error {
+	return f.f.Close()
+}
+
+// readParts returns the rows in the part files under dir, by path relative
+// to dir.
+func readParts(t *testing.T, dir string) map[string][]ParquetRide {
+	parts := make(map[string][]ParquetRide)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		parts[rel] = []ParquetRide{}
+		dec := json.NewDecoder(strings.NewReader(string(content)))
+		for dec.More() {
+			var row ParquetRide
+			if err := dec.Decode(&row); err != nil {
+				return err
+			}
+			parts[rel] = append(parts[rel], row)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parts
+}
+
+func TestParquetImporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewParquetWriter(dir)
+	w.Compression = "lzma"
+	if _, err := NewParquetImporter(NewRecordManager(), w); err == nil {
+		t.Fatalf("expected an error for an unknown compression")
+	}
+	w.Compression = "GZIP"
+	w.create = createJSONFile
+	rm := NewRecordManager()
+	imp, err := NewParquetImporter(rm, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	green, yellow := mapperRecords[0].rec, mapperRecords[1].rec
+	nullLoc := yellow
+	nullLoc.Val = strings.Replace(yellow.Val, "-73.993896484375,40.750110626220703", "0,0", 1)
+	bad := yellow
+	bad.Val = strings.Replace(yellow.Val, ",1,1.59,", ",x,1.59,", 1)
+	records := make(chan []Record, 1)
+	records <- []Record{green, yellow, bad, nullLoc}
+	close(records)
+	imp.parse(records)
+	imp.close()
+
+	if s := rm.Stats(); s.Written != 3 || s.Skipped != 1 || s.FailedWrites != 0 {
+		t.Fatalf("expected 3 rides written and 1 skipped, got stats %+v", s)
+	}
+	parts := readParts(t, dir)
+	greenPart := filepath.Join("pickup_year=2013", "pickup_month=08", "cab_type=green", "part-00000.parquet")
+	yellowPart := filepath.Join("pickup_year=2015", "pickup_month=01", "cab_type=yellow", "part-00000.parquet")
+	if len(parts) != 2 || len(parts[greenPart]) != 1 || len(parts[yellowPart]) != 2 {
+		t.Fatalf("expected a green and a yellow part, got %v", parts)
+	}
+	row := parts[yellowPart][0]
+	lon, lat := -73.993896484375, 40.750110626220703
+	pickup := time.Date(2015, 1, 15, 19, 5, 39, 0, time.UTC)
+	if row.VendorID != "2" || row.PickupTime != pickup.Unix()*1000 || row.DropoffTime != pickup.Unix()*1000+1083000 ||
+		row.PassengerCount != 1 || row.DistanceMiles != 1.59 || row.TotalAmount != 17.05 ||
+		!reflect.DeepEqual(row.PickupLon, &lon) || !reflect.DeepEqual(row.PickupLat, &lat) {
+		t.Errorf("unexpected row %+v", row)
+	}
+	if row := parts[yellowPart][1]; row.PickupLon != nil || row.PickupLat != nil || row.DropoffLon == nil {
+		t.Errorf("expected a null pickup, got %+v", row)
+	}
+
+	// another run adds part files, and a writer with one file open at a
+	// time starts a new one when it gets back to a partition
+	w = NewParquetWriter(dir)
+	w.create = createJSONFile
+	w.MaxOpenFiles = 1
+	for _, rec := range []Record{green, yellow, yellow, green} {
+		ride, err := parseRide(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.write(ride, func(*heldRecords) {}); err != nil {
+			t.Fatal(err)
+		}
+		releaseRide(ride)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for path, rows := range readParts(t, dir) {
+		paths = append(paths, fmt.Sprintf("%s:%d", filepath.ToSlash(path), len(rows)))
+	}
+	sort.Strings(paths)
+	expected := []string{
+		"pickup_year=2013/pickup_month=08/cab_type=green/part-00000.parquet:1",
+		"pickup_year=2013/pickup_month=08/cab_type=green/part-00001.parquet:1",
+		"pickup_year=2013/pickup_month=08/cab_type=green/part-00002.parquet:1",
+		"pickup_year=2015/pickup_month=01/cab_type=yellow/part-00000.parquet:2",
+		"pickup_year=2015/pickup_month=01/cab_type=yellow/part-00001.parquet:2",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected parts %q, got %q", expected, paths)
+	}
+}
+
+// TestParquetRoundTrip writes a real Parquet file and reads it back.
+func TestParquetRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewParquetWriter(dir)
+	w.Compression = "gzip"
+	yellow := mapperRecords[1].rec
+	nullLoc := yellow
+	nullLoc.Val = strings.Replace(yellow.Val, "-73.993896484375,40.750110626220703", "0,0", 1)
+	for _, rec := range []Record{yellow, nullLoc} {
+		ride, err := parseRide(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.write(ride, func(*heldRecords) {}); err != nil {
+			t.Fatal(err)
+		}
+		releaseRide(ride)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := local.NewLocalFileReader(filepath.Join(dir, "pickup_year=2015", "pickup_month=01", "cab_type=yellow", "part-00000.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, new(ParquetRide), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	// the root comes first, then the columns in the order of ParquetRide
+	millis, utf8 := parquet.ConvertedType_TIMESTAMP_MILLIS, parquet.ConvertedType_UTF8
+	columns := []struct {
+		name      string
+		typ       parquet.Type
+		converted *parquet.ConvertedType
+		optional  bool
+	}{
+		{"vendor_id", parquet.Type_BYTE_ARRAY, &utf8, false},
+		{"pickup_time", parquet.Type_INT64, &millis, false},
+		{"dropoff_time", parquet.Type_INT64, &millis, false},
+		{"passenger_count", parquet.Type_INT32, nil, false},
+		{"distance_miles", parquet.Type_DOUBLE, nil, false},
+		{"duration_minutes", parquet.Type_DOUBLE, nil, false},
+		{"speed_mph", parquet.Type_DOUBLE, nil, false},
+		{"total_amount", parquet.Type_DOUBLE, nil, false},
+		{"pickup_longitude", parquet.Type_DOUBLE, nil, true},
+		{"pickup_latitude", parquet.Type_DOUBLE, nil, true},
+		{"dropoff_longitude", parquet.Type_DOUBLE, nil, true},
+		{"dropoff_latitude", parquet.Type_DOUBLE, nil, true},
+	}
+	schema := pr.Footer.Schema
+	if len(schema) != len(columns)+1 {
+		t.Fatalf("expected %d columns, got schema %v", len(columns), schema)
+	}
+	for i, c := range columns {
+		el := schema[i+1]
+		// the reader may rename columns to the Go field names
+		if !strings.EqualFold(el.Name, c.name) || el.Type == nil || *el.Type != c.typ ||
+			!reflect.DeepEqual(el.ConvertedType, c.converted) ||
+			el.RepetitionType == nil || (*el.RepetitionType == parquet.FieldRepetitionType_OPTIONAL) != c.optional {
+			t.Errorf("column %s: unexpected schema element %+v", c.name, el)
+		}
+	}
+	if codec := pr.Footer.RowGroups[0].Columns[0].MetaData.Codec; codec != parquet.CompressionCodec_GZIP {
+		t.Errorf("expected gzip, got codec %v", codec)
+	}
+
+	rows := make([]ParquetRide, pr.GetNumRows())
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+	if err := pr.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	lon, lat := -73.993896484375, 40.750110626220703
+	pickup := time.Date(2015, 1, 15, 19, 5, 39, 0, time.UTC)
+	if row := rows[0]; row.VendorID != "2" || row.PickupTime != pickup.Unix()*1000 || row.DropoffTime != pickup.Unix()*1000+1083000 ||
+		row.TotalAmount != 17.05 || !reflect.DeepEqual(row.PickupLon, &lon) || !reflect.DeepEqual(row.PickupLat, &lat) {
+		t.Errorf("unexpected row %+v", row)
+	}
+	if row := rows[1]; row.PickupLon != nil || row.PickupLat != nil || row.DropoffLon == nil || row.DropoffLat == nil {
+		t.Errorf("expected a null pickup, got %+v", row)
+	}
+}
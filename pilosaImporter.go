@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// PilosaImporter imports rides into a Pilosa index.
+type PilosaImporter struct {
+	manager *RecordManager
+	writer  *PilosaWriter
+}
+
+// NewPilosaImporter returns a TaxiImporter writing to index on host, with
+// the frames described by config, creating them if needed.
+func NewPilosaImporter(r *RecordManager, host, index string, bufferSize int, config *MapperConfig) (TaxiImporter, error) {
+	w, err := NewPilosaWriter(host, index, bufferSize, config)
+	if err != nil {
+		return nil, err
+	}
+	return &PilosaImporter{
+		manager: r,
+		writer:  w,
+	}, nil
+}
+
+func (i *PilosaImporter) fetch(sources <-chan Source, records chan<- []Record) {
+	i.manager.fetch(sources, records)
+}
+
+func (i *PilosaImporter) parse(records <-chan []Record) {
+	start := time.Now()
+	n := 0
+	// each parse goroutine takes ids from its own blocks
+	ids := i.manager.nexter.NewRange(1000)
+	for batch := range records {
+		for j := range batch {
+			i.writer.write(&batch[j], i.manager, ids)
+			n++
+		}
+	}
+	log.Printf("writing %v rides took %v\n", n, time.Since(start))
+}
+
+func (i *PilosaImporter) close() {
+	i.writer.Close()
+}
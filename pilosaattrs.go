@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// attrWriter sets row and column attributes with PQL queries, sending
+// batchSize calls per request.
+type attrWriter struct {
+	schema    *PilosaSchema
+	batchSize int
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func newAttrWriter(schema *PilosaSchema, batchSize int) *attrWriter {
+	return &attrWriter{schema: schema, batchSize: batchSize}
+}
+
+// SetColumnAttrs sets attrs on column, sending the batch once it is full.
+func (a *attrWriter) SetColumnAttrs(column uint64, attrs map[string]interface{}) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	return a.add("SetColumnAttrs(columnID=" + strconv.FormatUint(column, 10) + pqlArgs(attrs) + ")")
+}
+
+// SetRowAttrs sets attrs on a row of frame, sending the batch once it is
+// full.
+func (a *attrWriter) SetRowAttrs(frame string, row uint64, attrs map[string]interface{}) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	return a.add("SetRowAttrs(frame=" + strconv.Quote(frame) + ", rowID=" + strconv.FormatUint(row, 10) + pqlArgs(attrs) + ")")
+}
+
+func (a *attrWriter) add(call string) error {
+	a.mu.Lock()
+	a.calls = append(a.calls, call)
+	if len(a.calls) < a.batchSize {
+		a.mu.Unlock()
+		return nil
+	}
+	calls := a.calls
+	a.calls = nil
+	a.mu.Unlock()
+	return a.send(calls)
+}
+
+// Flush sends the calls not sent yet.
+func (a *attrWriter) Flush() error {
+	a.mu.Lock()
+	calls := a.calls
+	a.calls = nil
+	a.mu.Unlock()
+	if len(calls) == 0 {
+		return nil
+	}
+	return a.send(calls)
+}
+
+func (a *attrWriter) send(calls []string) error {
+	return errors.Wrap(a.schema.query(strings.Join(calls, "\n")), "setting attributes")
+}
+
+// pqlArgs formats attrs as PQL arguments, each preceded by a comma, in
+// name order.
+func pqlArgs(attrs map[string]interface{}) string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(", ")
+		b.WriteString(name)
+		b.WriteString("=")
+		switch v := attrs[name].(type) {
+		case string:
+			b.WriteString(strconv.Quote(v))
+		case int64:
+			b.WriteString(strconv.FormatInt(v, 10))
+		case float64:
+			b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			b.WriteString(strconv.FormatBool(v))
+		}
+	}
+	return b.String()
+}
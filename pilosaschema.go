@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PilosaSchema creates the index and frames a MapperConfig needs through
+// Pilosa's HTTP API. Ones that already exist are left alone, so it's safe
+// to run before every import.
+type PilosaSchema struct {
+	Host   string
+	Index  string
+	Client *http.Client
+}
+
+// NewPilosaSchema returns a PilosaSchema for index on host, which may leave
+// out the http:// scheme.
+func NewPilosaSchema(host, index string) *PilosaSchema {
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return &PilosaSchema{
+		Host:   strings.TrimSuffix(host, "/"),
+		Index:  index,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// frameOptions are the options of a Pilosa frame.
+type frameOptions struct {
+	TimeQuantum  string       `json:"timeQuantum,omitempty"`
+	RangeEnabled bool         `json:"rangeEnabled,omitempty"`
+	Fields       []fieldRange `json:"fields,omitempty"`
+}
+
+// fieldRange describes a range-encoded integer field of a frame.
+type fieldRange struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Min  int64  `json:"min"`
+	Max  int64  `json:"max"`
+}
+
+// Ensure creates the index and every frame in config that doesn't exist
+// yet. Each int field gets a range-enabled frame of the same name.
+func (s *PilosaSchema) Ensure(config *MapperConfig) error {
+	if err := s.create("/index/"+s.Index, struct{}{}); err != nil {
+		return err
+	}
+	if err := s.createFrame("cab_type", frameOptions{}); err != nil {
+		return err
+	}
+	for _, fc := range config.Frames {
+		if err := s.createFrame(fc.Frame, frameOptions{TimeQuantum: fc.TimeQuantum}); err != nil {
+			return err
+		}
+	}
+	for _, ic := range config.IntFields {
+		opts := frameOptions{
+			RangeEnabled: true,
+			Fields:       []fieldRange{{Name: ic.Field, Type: "int", Min: ic.Min, Max: ic.Max}},
+		}
+		if err := s.createFrame(ic.Field, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PilosaSchema) createFrame(frame string, opts frameOptions) error {
+	return s.create("/index/"+s.Index+"/frame/"+frame, struct {
+		Options frameOptions `json:"options"`
+	}{opts})
+}
+
+// query runs a PQL query against the index.
+func (s *PilosaSchema) query(pql string) error {
+	path := "/index/" + s.Index + "/query"
+	resp, err := s.Client.Post(s.Host+path, "application/pql", strings.NewReader(pql))
+	if err != nil {
+		return errors.Wrap(err, "querying "+path)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("querying %s: unexpected status %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// create POSTs body to path, treating a conflict as the thing already
+// existing.
+func (s *PilosaSchema) create(path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := s.Client.Post(s.Host+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("creating %s", path))
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("creating %s: unexpected status %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
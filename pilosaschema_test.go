@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePilosa records the schema requests and queries it gets for the taxi
+// index, answering 409 Conflict for the paths in exists.
+type fakePilosa struct {
+	mu       sync.Mutex
+	exists   map[string]bool
+	requests map[string]string
+	queries  []string
+}
+
+func (p *fakePilosa) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r.Method != "POST" {
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == "/index/taxi/query" {
+		p.queries = append(p.queries, string(body))
+		return
+	}
+	if r.URL.Path != "/index/taxi" && !strings.HasPrefix(r.URL.Path, "/index/taxi/frame/") {
+		http.NotFound(w, r)
+		return
+	}
+	p.requests[r.URL.Path] = string(body)
+	if p.exists[r.URL.Path] {
+		http.Error(w, "exists", http.StatusConflict)
+	}
+}
+
+func TestPilosaSchema(t *testing.T) {
+	pilosa := &fakePilosa{
+		exists:   map[string]bool{"/index/taxi": true, "/index/taxi/frame/cab_type": true},
+		requests: make(map[string]string),
+	}
+	srv := httptest.NewServer(pilosa)
+	defer srv.Close()
+
+	config := &MapperConfig{
+		Frames: []FrameConfig{
+			{Frame: "pickup_grid_id", Fields: []string{"pickup_longitude", "pickup_latitude"}, Parser: "float", Mapper: gridSpec, TimeQuantum: "YMD"},
+			{Frame: "passenger_count", Fields: []string{"passenger_count"}, Parser: "int", Mapper: MapperSpec{Type: "int", Min: 0, Max: 9}},
+		},
+		IntFields: []IntFieldConfig{
+			{Field: "total_amount_cents", Fields: []string{"total_amount"}, Parser: "float", Scale: 100, Min: -1000000, Max: 1000000},
+		},
+	}
+	schema := NewPilosaSchema(strings.TrimPrefix(srv.URL, "http://"), "taxi")
+	if err := schema.Ensure(config); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/index/taxi":                          `{}`,
+		"/index/taxi/frame/cab_type":           `{"options":{}}`,
+		"/index/taxi/frame/pickup_grid_id":     `{"options":{"timeQuantum":"YMD"}}`,
+		"/index/taxi/frame/passenger_count":    `{"options":{}}`,
+		"/index/taxi/frame/total_amount_cents": `{"options":{"rangeEnabled":true,"fields":[{"name":"total_amount_cents","type":"int","min":-1000000,"max":1000000}]}}`,
+	}
+	if !reflect.DeepEqual(pilosa.requests, expected) {
+		t.Fatalf("expected requests %v, got %v", expected, pilosa.requests)
+	}
+
+	if err := NewPilosaSchema(srv.URL, "bad/index").Ensure(config); err == nil {
+		t.Fatalf("expected an error for an unknown path")
+	}
+}
+
+// recordingImporter keeps the bits and values set through it.
+type recordingImporter struct {
+	bits   []string
+	values map[string]int64
+}
+
+func (r *recordingImporter) SetBit(bitID, colID uint64, frame string, clustime ...time.Time) {
+	s := frame
+	if len(clustime) > 0 {
+		s += "@" + clustime[0].Format(defaultTimeLayout)
+	}
+	r.bits = append(r.bits, s)
+}
+
+func (r *recordingImporter) SetValue(colID uint64, field string, value int64) {
+	r.values[field] = value
+}
+
+func (r *recordingImporter) Close() {}
+
+func TestPilosaWriterValues(t *testing.T) {
+	srv := httptest.NewServer(&fakePilosa{requests: make(map[string]string)})
+	defer srv.Close()
+	w, err := NewPilosaWriter(srv.URL, "taxi", 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []map[string]int64{
+		{"total_amount_cents": 2130, "dist_hundredths": 500, "duration_seconds": 1200},
+		{"total_amount_cents": 1705, "dist_hundredths": 159, "duration_seconds": 1083},
+	}
+	pickups := []string{"2013-08-31 23:50:00", "2015-01-15 19:05:39"}
+	for i, mr := range mapperRecords {
+		imp := &recordingImporter{values: make(map[string]int64)}
+		w.importer = imp
+		rec := mr.rec
+		rm := NewRecordManager()
+		w.write(&rec, rm, rm.nexter.NewRange(1))
+		if !reflect.DeepEqual(imp.values, expected[i]) {
+			t.Errorf("record %d: expected values %v, got %v", i, expected[i], imp.values)
+		}
+		timed := 0
+		for _, bit := range imp.bits {
+			if strings.HasSuffix(bit, "_grid_id@"+pickups[i]) {
+				timed++
+			} else if strings.Contains(bit, "@") {
+				t.Errorf("record %d: unexpected timed bit %s", i, bit)
+			}
+		}
+		if timed != 2 {
+			t.Errorf("record %d: expected 2 timed bits, got %v", i, imp.bits)
+		}
+	}
+
+	// a value out of range is dropped, but the ride is still written
+	config := &MapperConfig{IntFields: []IntFieldConfig{
+		{Field: "duration_seconds", Fields: []string{"pickup_datetime", "dropoff_datetime"}, Parser: "time", Func: "duration_minutes", Scale: 60, Min: 0, Max: 1000},
+	}}
+	w, err = NewPilosaWriter(srv.URL, "taxi", 100, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := NewRecordManager()
+	imp := &recordingImporter{values: make(map[string]int64)}
+	w.importer = imp
+	rec := mapperRecords[1].rec
+	w.write(&rec, rm, rm.nexter.NewRange(1))
+	if len(imp.values) != 0 || rm.badValues.Get() != 1 || rm.writtenRecords.Get() != 1 || len(imp.bits) != 1 {
+		t.Fatalf("expected a bad duration, got %v, %v, %d bad values", imp.values, imp.bits, rm.badValues.Get())
+	}
+}
+
+func TestPilosaAttrs(t *testing.T) {
+	pilosa := &fakePilosa{requests: make(map[string]string)}
+	srv := httptest.NewServer(pilosa)
+	defer srv.Close()
+
+	config := &MapperConfig{
+		Frames: []FrameConfig{
+			{Frame: "pickup_grid_id", Fields: []string{"pickup_longitude", "pickup_latitude"}, Parser: "float",
+				Mapper: MapperSpec{Type: "grid", Xmin: -80, Xmax: -70, Xres: 2, Ymin: 40, Ymax: 43, Yres: 3, Lookup: "elevations"}, RowAttrs: true},
+			{Frame: "fare", Fields: []string{"fare_amount"}, Parser: "float",
+				Mapper: MapperSpec{Type: "float_buckets", Buckets: []float64{0, 5, 20}}, RowAttrs: true},
+			{Frame: "passenger_count", Fields: []string{"passenger_count"}, Parser: "int", Mapper: MapperSpec{Type: "int", Min: 0, Max: 9}},
+		},
+		ColumnAttrs: []AttrConfig{
+			{Attr: "vendor", Field: "vendor_id"},
+			{Attr: "fare", Field: "fare_amount", Parser: "float"},
+			{Attr: "passengers", Field: "passenger_count", Parser: "int"},
+			{Attr: "surcharge", Field: "ehail_fee", Parser: "float"},
+		},
+	}
+	if _, err := config.attrMappers(yellow2015Schema.Fields); err == nil {
+		t.Fatalf("expected an error for a field missing from the schema")
+	}
+	config.ColumnAttrs = config.ColumnAttrs[:3]
+	w, err := NewPilosaWriter(srv.URL, "taxi", 100, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pilosa.queries) != 1 {
+		t.Fatalf("expected the row attributes in one query, got %d", len(pilosa.queries))
+	}
+	rows := strings.Split(pilosa.queries[0], "\n")
+	if len(rows) != 8 {
+		t.Fatalf("expected 8 rows, got %q", rows)
+	}
+	for _, row := range []string{
+		fmt.Sprintf(`SetRowAttrs(frame="pickup_grid_id", rowID=5, center_lat=42.5, center_lon=-72.5, elevation=%v)`, elevations[5]),
+		`SetRowAttrs(frame="pickup_grid_id", rowID=0, center_lat=40.5, center_lon=-77.5, elevation=5.330401420593262)`,
+		`SetRowAttrs(frame="fare", rowID=1, max=20, min=5)`,
+	} {
+		if !contains(rows, row) {
+			t.Errorf("missing %s in %q", row, rows)
+		}
+	}
+
+	pilosa.queries = nil
+	rm := NewRecordManager()
+	ids := rm.nexter.NewRange(100)
+	for _, mr := range mapperRecords {
+		rec := mr.rec
+		w.write(&rec, rm, ids)
+	}
+	if len(pilosa.queries) != 0 {
+		t.Fatalf("column attributes weren't batched")
+	}
+	w.Close()
+	expected := []string{
+		`SetColumnAttrs(columnID=0, fare=18.5, passengers=3, vendor="2")` + "\n" +
+			`SetColumnAttrs(columnID=1, fare=12, passengers=1, vendor="2")`,
+	}
+	if !reflect.DeepEqual(pilosa.queries, expected) {
+		t.Fatalf("expected %q, got %q", expected, pilosa.queries)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRowAttrsErrors(t *testing.T) {
+	for _, spec := range []MapperSpec{
+		{Type: "year"},
+		{Type: "grid", Xmin: 0, Xmax: 1, Xres: 1000, Ymin: 0, Ymax: 1, Yres: 1000, Lookup: "elevations"},
+		{Type: "grid", Xmin: 0, Xmax: 1, Xres: 10, Ymin: 0, Ymax: 1, Yres: 10, Lookup: "population"},
+	} {
+		if _, err := spec.rowAttrs(); err == nil {
+			t.Errorf("expected an error for %v", spec)
+		}
+	}
+}
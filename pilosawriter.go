@@ -1,59 +1,195 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"strings"
 	"time"
 
 	"github.com/pilosa/pdk"
+	"github.com/pkg/errors"
 	//"github.com/pilosa/pilosa"
 )
 
 type PilosaWriter struct {
-	greenBms  []pdk.BitMapper
-	yellowBms []pdk.BitMapper
-	ams       []pdk.AttrMapper
+	bms map[*Schema][]pdk.BitMapper
+	ams map[*Schema][]attrMapper
+	// ifs are the range-encoded int fields, and timed the frames whose bits
+	// are set at the time in timeField.
+	ifs       map[*Schema][]intField
+	timed     map[string]bool
+	timeField string
 	importer  pdk.PilosaImporter
+	attrs     *attrWriter
+	// held are the records whose bits are queued in importer.
+	held heldRecords
 }
 
-func NewPilosaWriter(host string, index string, bufferSize int) *PilosaWriter {
+// NewPilosaWriter returns a PilosaWriter setting bits as described by
+// config, or by the default mappers if config is nil. The index and frames
+// are created if they don't exist yet.
+func NewPilosaWriter(host string, index string, bufferSize int, config *MapperConfig) (*PilosaWriter, error) {
+	if config == nil {
+		config = defaultMapperConfig
+	}
+	bms, err := config.schemaBitMappers()
+	if err != nil {
+		return nil, err
+	}
+	ifs, err := schemaIntFields(config)
+	if err != nil {
+		return nil, err
+	}
+	timed := make(map[string]bool)
+	for _, fc := range config.Frames {
+		if fc.TimeQuantum != "" {
+			timed[fc.Frame] = true
+		}
+	}
 
-	frames := []string{"cab_type", "passenger_count", "total_amount_dollars", "pickup_time", "pickup_day", "pickup_mday", "pickup_month", "pickup_year", "drop_time", "drop_day", "drop_mday", "drop_month", "drop_year", "dist_miles", "duration_minutes", "speed_mph", "pickup_grid_id", "drop_grid_id", "pickup_elevation", "drop_elevation"}
+	ams, err := config.schemaAttrMappers()
+	if err != nil {
+		return nil, err
+	}
+	rowAttrs, err := config.rowAttrs()
+	if err != nil {
+		return nil, err
+	}
 
-	// pilosaURI, err := pcli.NewURIFromAddress(m.PilosaHost)
-	// if err != nil {
-	// 	return fmt.Errorf("interpreting pilosaHost '%v': %v", m.PilosaHost, err)
-	// }
-	//setupClient := pcli.NewClientWithURI(pilosaURI)
+	schema := NewPilosaSchema(host, index)
+	if err := schema.Ensure(config); err != nil {
+		return nil, errors.Wrap(err, "setting up Pilosa schema")
+	}
+	attrs := newAttrWriter(schema, 1000)
+	for frame, rows := range rowAttrs {
+		for row, rowAttrs := range rows {
+			if err := attrs.SetRowAttrs(frame, row, rowAttrs); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := attrs.Flush(); err != nil {
+		return nil, err
+	}
 
 	return &PilosaWriter{
-		greenBms:  getBitMappers(greenFields),
-		yellowBms: getBitMappers(yellowFields),
-		ams:       getAttrMappers(),
-		importer:  pdk.NewImportClient(host, index, frames, bufferSize),
+		bms:       bms,
+		ams:       ams,
+		attrs:     attrs,
+		ifs:       ifs,
+		timed:     timed,
+		timeField: config.timeField(),
+		importer:  pdk.NewImportClient(host, index, config.frames(), bufferSize),
+	}, nil
+}
+
+// write sets the bits and values of record, in a column taken from ids if
+// its source has no column range.
+func (w *PilosaWriter) write(record *Record, recordManager *RecordManager, ids *IDRange) {
+	bitsToSet, ok := w.bits(record, recordManager)
+	if !ok {
+		return
+	}
+	columnID, ok := columnID(record, ids)
+	if !ok {
+		log.Printf("record %d doesn't fit in column range %s", record.Seq, record.IDs)
+		recordManager.skip(record, "column out of range", recordManager.badColumnIDs)
+		return
+	}
+	fields, _ := record.Clean()
+	clustime, timed := w.clustime(record, fields)
+	for _, bit := range bitsToSet {
+		if timed && w.timed[bit.Frame] {
+			w.importer.SetBit(bit.Bit, columnID, bit.Frame, clustime)
+		} else {
+			w.importer.SetBit(bit.Bit, columnID, bit.Frame)
+		}
+	}
+	for _, f := range w.ifs[record.schema()] {
+		value, err := f.value(fields)
+		if err != nil {
+			// the binned frames still have the ride
+			recordManager.badValues.Add(1)
+			continue
+		}
+		w.importer.SetValue(columnID, f.name, value)
+	}
+	if ams := w.ams[record.schema()]; len(ams) > 0 {
+		attrs := make(map[string]interface{}, len(ams))
+		for _, am := range ams {
+			if v, ok := am.value(fields); ok {
+				attrs[am.attr] = v
+			}
+		}
+		if err := w.attrs.SetColumnAttrs(columnID, attrs); err != nil {
+			log.Printf("writing column attributes, err: %v", err)
+		}
+	}
+	recordManager.buffered(record, &w.held)
+}
+
+// schemaIntFields returns the int fields of config for each schema.
+func schemaIntFields(config *MapperConfig) (map[*Schema][]intField, error) {
+	ifs := make(map[*Schema][]intField, len(schemas))
+	for _, schema := range schemas {
+		fields, err := config.intFields(schema.Fields)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("schema %s", schema))
+		}
+		ifs[schema] = fields
 	}
+	return ifs, nil
 }
 
-func (w *PilosaWriter) write(record *Record, recordManager *RecordManager) {
+// clustime returns the time of record's timed bits, reporting false if
+// there are no timed frames or the time can't be parsed.
+func (w *PilosaWriter) clustime(record *Record, fields []string) (time.Time, bool) {
+	if len(w.timed) == 0 {
+		return time.Time{}, false
+	}
+	i, ok := record.schema().Fields[w.timeField]
+	if !ok || i >= len(fields) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(defaultTimeLayout, fields[i])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Close flushes the bits, values and attributes not imported yet.
+func (w *PilosaWriter) Close() {
+	w.importer.Close()
+	err := w.attrs.Flush()
+	if err != nil {
+		log.Printf("writing column attributes, err: %v", err)
+	}
+	w.held.release(err == nil)
+}
+
+// bits returns the bits to set for record, one per frame. It reports false
+// if record should be skipped, counting the reason in recordManager.
+func (w *PilosaWriter) bits(record *Record, recordManager *RecordManager) ([]BitFrame, bool) {
 	var bms []pdk.BitMapper
 	var cabType uint64
 
 	fields, ok := record.Clean()
 	if !ok {
-		recordManager.skippedRecs.Add(1)
-		return
+		recordManager.skip(record, "empty line", nil)
+		return nil, false
 	}
 
 	if record.Type == 'g' {
-		bms = w.greenBms
 		cabType = 0
 	} else if record.Type == 'y' {
-		bms = w.yellowBms
 		cabType = 1
 	} else {
-		log.Println("unknown record type %v", record)
-		return
+		log.Printf("unknown record type %v", record)
+		recordManager.skip(record, "unknown cab type", recordManager.badUnknowns)
+		return nil, false
 	}
+	bms = w.bms[record.schema()]
 
 	bitsToSet := make([]BitFrame, 0)
 	bitsToSet = append(bitsToSet, BitFrame{Bit: cabType, Frame: "cab_type"})
@@ -69,17 +205,17 @@ func (w *PilosaWriter) write(record *Record, recordManager *RecordManager) {
 			parser := bm.Parsers[n]
 			if fieldnum >= len(fields) {
 				log.Printf("parse: field index: %v out of range for: %v", fieldnum, fields)
-				recordManager.skippedRecs.Add(1)
-				return
+				recordManager.skip(record, "missing field", nil)
+				return nil, false
 			}
 			parsedField, err := parser.Parse(fields[fieldnum])
 			if err != nil && fields[fieldnum] == "" {
-				recordManager.skippedRecs.Add(1)
-				return
+				recordManager.skip(record, "empty field", nil)
+				return nil, false
 			} else if err != nil {
 				log.Printf("parsing: field: %v err: %v bm: %v rec: %v", fields[fieldnum], err, bm, record)
-				recordManager.skippedRecs.Add(1)
-				return
+				recordManager.skip(record, "unparseable field", nil)
+				return nil, false
 			}
 			parsed = append(parsed, parsedField)
 		}
@@ -88,235 +224,133 @@ func (w *PilosaWriter) write(record *Record, recordManager *RecordManager) {
 		ids, err := bm.Mapper.ID(parsed...)
 		if err != nil {
 			if err.Error() == "point (0, 0) out of range" {
-				recordManager.nullLocs.Add(1)
-				recordManager.skippedRecs.Add(1)
-				return
+				recordManager.skip(record, "null location", recordManager.nullLocs)
+				return nil, false
 			}
 			if strings.Contains(bm.Frame, "grid_id") && strings.Contains(err.Error(), "out of range") {
-				recordManager.badLocs.Add(1)
-				recordManager.skippedRecs.Add(1)
-				return
+				recordManager.skip(record, "bad location", recordManager.badLocs)
+				return nil, false
 			}
 			if bm.Frame == "speed_mph" && strings.Contains(err.Error(), "out of range") {
-				recordManager.badSpeeds.Add(1)
-				recordManager.skippedRecs.Add(1)
-				return
+				recordManager.skip(record, "bad speed", recordManager.badSpeeds)
+				return nil, false
 			}
 			if bm.Frame == "total_amount_dollars" && strings.Contains(err.Error(), "out of range") {
-				recordManager.badTotalAmnts.Add(1)
-				recordManager.skippedRecs.Add(1)
-				return
+				recordManager.skip(record, "bad total amount", recordManager.badTotalAmnts)
+				return nil, false
 			}
 			if bm.Frame == "duration_minutes" && strings.Contains(err.Error(), "out of range") {
-				recordManager.badDurations.Add(1)
-				recordManager.skippedRecs.Add(1)
-				return
+				recordManager.skip(record, "bad duration", recordManager.badDurations)
+				return nil, false
 			}
 			if bm.Frame == "passenger_count" && strings.Contains(err.Error(), "out of range") {
-				recordManager.badPassCounts.Add(1)
-				recordManager.skippedRecs.Add(1)
-				return
+				recordManager.skip(record, "bad passenger count", recordManager.badPassCounts)
+				return nil, false
 			}
 			if bm.Frame == "dist_miles" && strings.Contains(err.Error(), "out of range") {
-				recordManager.badDist.Add(1)
-				recordManager.skippedRecs.Add(1)
-				return
+				recordManager.skip(record, "bad distance", recordManager.badDist)
+				return nil, false
 			}
 			log.Printf("mapping: bm: %v, err: %v rec: %v", bm, err, record)
-			recordManager.skippedRecs.Add(1)
-			recordManager.badUnknowns.Add(1)
-			return
+			recordManager.skip(record, "unknown mapping error", recordManager.badUnknowns)
+			return nil, false
 		}
 		for _, id := range ids {
 			bitsToSet = append(bitsToSet, BitFrame{Bit: uint64(id), Frame: bm.Frame})
 		}
 	}
-	columnID := recordManager.nexter.Next()
-	for _, bit := range bitsToSet {
-		w.importer.SetBit(bit.Bit, columnID, bit.Frame)
-	}
-
-}
-
-func getAttrMappers() []pdk.AttrMapper {
-	ams := []pdk.AttrMapper{}
-
-	return ams
+	return bitsToSet, true
 }
 
-func getBitMappers(fields map[string]int) []pdk.BitMapper {
-	// map a pair of floats to a grid sector of a rectangular region
-	gm := pdk.GridMapper{
-		Xmin: -74.27,
-		Xmax: -73.69,
-		Xres: 100,
-		Ymin: 40.48,
-		Ymax: 40.93,
-		Yres: 100,
-	}
-
-	elevFloatMapper := pdk.LinearFloatMapper{
-		Min: -32,
-		Max: 195,
-		Res: 46,
-	}
-
-	gfm := pdk.NewGridToFloatMapper(gm, elevFloatMapper, elevations)
-
-	// map a float according to a custom set of bins
-	// seems like the LFM defined below is more sensible
-	/*
-		fm := pdk.FloatMapper{
-			Buckets: []float64{0, 0.5, 1, 2, 5, 10, 25, 50, 100, 200},
-		}
-	*/
-
-	// this set of bins is equivalent to rounding to nearest int (TODO verify)
-	lfm := pdk.LinearFloatMapper{
-		Min: -0.5,
-		Max: 3600.5,
-		Res: 3601,
+// getSchemaBitMappers returns the default bit mappers for every schema.
+func getSchemaBitMappers() map[*Schema][]pdk.BitMapper {
+	bms, err := defaultMapperConfig.schemaBitMappers()
+	if err != nil {
+		panic(err)
 	}
+	return bms
+}
 
-	// map the (pickupTime, dropTime) pair, according to the duration in minutes, binned using `fm`
-	durm := pdk.CustomMapper{
-		Func: func(fields ...interface{}) interface{} {
-			start := fields[0].(time.Time)
-			end := fields[1].(time.Time)
-			return end.Sub(start).Minutes()
-		},
-		Mapper: lfm,
+// getAttrMappers returns the default column attribute mappers for every
+// schema.
+func getAttrMappers() map[*Schema][]attrMapper {
+	ams, err := defaultMapperConfig.schemaAttrMappers()
+	if err != nil {
+		panic(err)
 	}
+	return ams
+}
 
-	// map the (pickupTime, dropTime, dist) triple, according to the speed in mph, binned using `fm`
-	speedm := pdk.CustomMapper{
-		Func: func(fields ...interface{}) interface{} {
-			start := fields[0].(time.Time)
-			end := fields[1].(time.Time)
-			dist := fields[2].(float64)
-			return dist / end.Sub(start).Hours()
-		},
-		Mapper: lfm,
-	}
+// map a pair of floats to a grid sector of a rectangular region, whose rows
+// are described with the elevation of the sector
+var gridSpec = MapperSpec{
+	Type:   "grid",
+	Xmin:   -74.27,
+	Xmax:   -73.69,
+	Xres:   100,
+	Ymin:   40.48,
+	Ymax:   40.93,
+	Yres:   100,
+	Lookup: "elevations",
+}
 
-	tp := pdk.TimeParser{Layout: "2006-01-02 15:04:05"}
+// look up the elevation of a grid sector, in bins of about 5m
+var elevationSpec = MapperSpec{
+	Type:   "grid_lookup",
+	Xmin:   gridSpec.Xmin,
+	Xmax:   gridSpec.Xmax,
+	Xres:   gridSpec.Xres,
+	Ymin:   gridSpec.Ymin,
+	Ymax:   gridSpec.Ymax,
+	Yres:   gridSpec.Yres,
+	Lookup: "elevations",
+	Values: &MapperSpec{Type: "linear_float", Min: -32, Max: 195, Res: 46},
+}
 
-	bms := []pdk.BitMapper{
-		pdk.BitMapper{
-			Frame:   "passenger_count",
-			Mapper:  pdk.IntMapper{Min: 0, Max: 9},
-			Parsers: []pdk.Parser{pdk.IntParser{}},
-			Fields:  []int{fields["passenger_count"]},
-		},
-		pdk.BitMapper{
-			Frame:   "total_amount_dollars",
-			Mapper:  lfm,
-			Parsers: []pdk.Parser{pdk.FloatParser{}},
-			Fields:  []int{fields["total_amount"]},
-		},
-		pdk.BitMapper{
-			Frame:   "pickup_time",
-			Mapper:  pdk.TimeOfDayMapper{Res: 48},
-			Parsers: []pdk.Parser{tp},
-			Fields:  []int{fields["pickup_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "pickup_day",
-			Mapper:  pdk.DayOfWeekMapper{},
-			Parsers: []pdk.Parser{tp},
-			Fields:  []int{fields["pickup_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "pickup_mday",
-			Mapper:  pdk.DayOfMonthMapper{},
-			Parsers: []pdk.Parser{tp},
-			Fields:  []int{fields["pickup_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "pickup_month",
-			Mapper:  pdk.MonthMapper{},
-			Parsers: []pdk.Parser{tp},
-			Fields:  []int{fields["pickup_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "pickup_year",
-			Mapper:  pdk.YearMapper{},
-			Parsers: []pdk.Parser{tp},
-			Fields:  []int{fields["pickup_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "drop_time",
-			Mapper:  pdk.TimeOfDayMapper{Res: 48},
-			Parsers: []pdk.Parser{tp},
-			Fields:  []int{fields["dropoff_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "drop_day",
-			Mapper:  pdk.DayOfWeekMapper{},
-			Parsers: []pdk.Parser{tp},
-			Fields:  []int{fields["dropoff_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "drop_mday",
-			Mapper:  pdk.DayOfMonthMapper{},
-			Parsers: []pdk.Parser{tp},
-			Fields:  []int{fields["pickup_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "drop_month",
-			Mapper:  pdk.MonthMapper{},
-			Parsers: []pdk.Parser{tp},
-			Fields:  []int{fields["dropoff_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "drop_year",
-			Mapper:  pdk.YearMapper{},
-			Parsers: []pdk.Parser{tp},
-			Fields:  []int{fields["dropoff_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "dist_miles", // note "_miles" is a unit annotation
-			Mapper:  lfm,
-			Parsers: []pdk.Parser{pdk.FloatParser{}},
-			Fields:  []int{fields["trip_distance"]},
-		},
-		pdk.BitMapper{
-			Frame:   "duration_minutes",
-			Mapper:  durm,
-			Parsers: []pdk.Parser{tp, tp},
-			Fields:  []int{fields["pickup_datetime"], fields["dropoff_datetime"]},
-		},
-		pdk.BitMapper{
-			Frame:   "speed_mph",
-			Mapper:  speedm,
-			Parsers: []pdk.Parser{tp, tp, pdk.FloatParser{}},
-			Fields:  []int{fields["pickup_datetime"], fields["dropoff_datetime"], fields["trip_distance"]},
-		},
-		pdk.BitMapper{
-			Frame:   "pickup_grid_id",
-			Mapper:  gm,
-			Parsers: []pdk.Parser{pdk.FloatParser{}, pdk.FloatParser{}},
-			Fields:  []int{fields["pickup_longitude"], fields["pickup_latitude"]},
-		},
-		pdk.BitMapper{
-			Frame:   "drop_grid_id",
-			Mapper:  gm,
-			Parsers: []pdk.Parser{pdk.FloatParser{}, pdk.FloatParser{}},
-			Fields:  []int{fields["dropoff_longitude"], fields["dropoff_latitude"]},
-		},
-		pdk.BitMapper{
-			Frame:   "pickup_elevation",
-			Mapper:  gfm,
-			Parsers: []pdk.Parser{pdk.FloatParser{}, pdk.FloatParser{}},
-			Fields:  []int{fields["dropoff_longitude"], fields["dropoff_latitude"]},
-		},
-		pdk.BitMapper{
-			Frame:   "drop_elevation",
-			Mapper:  gfm,
-			Parsers: []pdk.Parser{pdk.FloatParser{}, pdk.FloatParser{}},
-			Fields:  []int{fields["dropoff_longitude"], fields["dropoff_latitude"]},
-		},
-	}
+// this set of bins is equivalent to rounding to nearest int (TODO verify)
+// a custom set of bins, e.g. float_buckets 0, 0.5, 1, 2, 5, 10, 25, 50, 100,
+// 200, seems less sensible
+var lfmSpec = MapperSpec{Type: "linear_float", Min: -0.5, Max: 3600.5, Res: 3601}
 
-	return bms
+// defaultMapperConfig is used unless a mapper config file is given.
+var defaultMapperConfig = &MapperConfig{
+	Frames: []FrameConfig{
+		{Frame: "passenger_count", Fields: []string{"passenger_count"}, Parser: "int", Mapper: MapperSpec{Type: "int", Min: 0, Max: 9}},
+		{Frame: "total_amount_dollars", Fields: []string{"total_amount"}, Parser: "float", Mapper: lfmSpec},
+		{Frame: "pickup_time", Fields: []string{"pickup_datetime"}, Parser: "time", Mapper: MapperSpec{Type: "time_of_day", Res: 48}},
+		{Frame: "pickup_day", Fields: []string{"pickup_datetime"}, Parser: "time", Mapper: MapperSpec{Type: "day_of_week"}},
+		{Frame: "pickup_mday", Fields: []string{"pickup_datetime"}, Parser: "time", Mapper: MapperSpec{Type: "day_of_month"}},
+		{Frame: "pickup_month", Fields: []string{"pickup_datetime"}, Parser: "time", Mapper: MapperSpec{Type: "month"}},
+		{Frame: "pickup_year", Fields: []string{"pickup_datetime"}, Parser: "time", Mapper: MapperSpec{Type: "year"}},
+		{Frame: "drop_time", Fields: []string{"dropoff_datetime"}, Parser: "time", Mapper: MapperSpec{Type: "time_of_day", Res: 48}},
+		{Frame: "drop_day", Fields: []string{"dropoff_datetime"}, Parser: "time", Mapper: MapperSpec{Type: "day_of_week"}},
+		{Frame: "drop_mday", Fields: []string{"dropoff_datetime"}, Parser: "time", Mapper: MapperSpec{Type: "day_of_month"}},
+		{Frame: "drop_month", Fields: []string{"dropoff_datetime"}, Parser: "time", Mapper: MapperSpec{Type: "month"}},
+		{Frame: "drop_year", Fields: []string{"dropoff_datetime"}, Parser: "time", Mapper: MapperSpec{Type: "year"}},
+		// note "_miles" is a unit annotation
+		{Frame: "dist_miles", Fields: []string{"trip_distance"}, Parser: "float", Mapper: lfmSpec},
+		// the duration in minutes and speed in mph of the ride
+		{Frame: "duration_minutes", Fields: []string{"pickup_datetime", "dropoff_datetime"}, Parser: "time", Func: "duration_minutes", Mapper: lfmSpec},
+		{Frame: "speed_mph", Fields: []string{"pickup_datetime", "dropoff_datetime", "trip_distance"}, Parsers: []string{"time", "time", "float"}, Func: "speed_mph", Mapper: lfmSpec},
+		{Frame: "pickup_grid_id", Fields: []string{"pickup_longitude", "pickup_latitude"}, Parser: "float", Mapper: gridSpec, TimeQuantum: "YMD", RowAttrs: true},
+		{Frame: "drop_grid_id", Fields: []string{"dropoff_longitude", "dropoff_latitude"}, Parser: "float", Mapper: gridSpec, TimeQuantum: "YMD", RowAttrs: true},
+		{Frame: "pickup_elevation", Fields: []string{"pickup_longitude", "pickup_latitude"}, Parser: "float", Mapper: elevationSpec, RowAttrs: true},
+		{Frame: "drop_elevation", Fields: []string{"dropoff_longitude", "dropoff_latitude"}, Parser: "float", Mapper: elevationSpec, RowAttrs: true},
+	},
+	// exact values for range queries, next to the binned frames above
+	IntFields: []IntFieldConfig{
+		{Field: "total_amount_cents", Fields: []string{"total_amount"}, Parser: "float", Scale: 100, Min: -1000000, Max: 1000000},
+		{Field: "dist_hundredths", Fields: []string{"trip_distance"}, Parser: "float", Scale: 100, Min: 0, Max: 10000000},
+		{Field: "duration_seconds", Fields: []string{"pickup_datetime", "dropoff_datetime"}, Parser: "time", Func: "duration_minutes", Scale: 60, Min: 0, Max: 604800},
+	},
+	// raw values, so query results can be read without undoing the bins
+	ColumnAttrs: []AttrConfig{
+		{Attr: "vendor_id", Field: "vendor_id"},
+		{Attr: "fare_amount", Field: "fare_amount", Parser: "float"},
+		{Attr: "total_amount", Field: "total_amount", Parser: "float"},
+		{Attr: "pickup_longitude", Field: "pickup_longitude", Parser: "float"},
+		{Attr: "pickup_latitude", Field: "pickup_latitude", Parser: "float"},
+		{Attr: "dropoff_longitude", Field: "dropoff_longitude", Parser: "float"},
+		{Attr: "dropoff_latitude", Field: "dropoff_latitude", Parser: "float"},
+	},
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// CopyDB is the part of a PostgreSQL database PostGISWriter uses. It is
+// satisfied by SQLCopyDB, and by fakes for tests.
+type CopyDB interface {
+	// Exec runs a statement returning no rows.
+	Exec(query string) error
+	// CopyIn loads rows into table with COPY, all or none of them.
+	CopyIn(table string, columns []string, rows [][]interface{}) error
+}
+
+// SQLCopyDB is a CopyDB over database/sql and lib/pq.
+type SQLCopyDB struct {
+	DB *sql.DB
+}
+
+func (d SQLCopyDB) Exec(query string) error {
+	_, err := d.DB.Exec(query)
+	return err
+}
+
+func (d SQLCopyDB) Close() error {
+	return d.DB.Close()
+}
+
+func (d SQLCopyDB) CopyIn(table string, columns []string, rows [][]interface{}) error {
+	txn, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := txn.Prepare(pq.CopyIn(table, columns...))
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			stmt.Close()
+			txn.Rollback()
+			return err
+		}
+	}
+	// an Exec without arguments sends the buffered rows
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		txn.Rollback()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// rideColumns are the columns of the rides table and their types. Pickup
+// and dropoff are WGS 84 points, NULL where the coordinates are missing.
+var rideColumns = []struct {
+	name, typ string
+}{
+	{"cab_type", "smallint NOT NULL"},
+	{"vendor_id", "text"},
+	{"pickup_time", "timestamp NOT NULL"},
+	{"dropoff_time", "timestamp"},
+	{"passenger_count", "smallint"},
+	{"distance_miles", "double precision"},
+	{"duration_minutes", "double precision"},
+	{"speed_mph", "double precision"},
+	{"total_amount", "double precision"},
+	{"pickup", "geometry(Point, 4326)"},
+	{"dropoff", "geometry(Point, 4326)"},
+}
+
+// pickupTimeColumn is the index of pickup_time in rideColumns.
+const pickupTimeColumn = 2
+
+// PostGISWriter loads rides into a PostgreSQL table with PostGIS geometry
+// columns, by COPY.
+type PostGISWriter struct {
+	db CopyDB
+	// Table is the name of the rides table. If PartitionByMonth is set it
+	// is partitioned by pickup time, with a partition per month created as
+	// rides for it come in.
+	Table            string
+	PartitionByMonth bool
+	// BatchSize is the number of rows loaded per COPY.
+	BatchSize int
+
+	mu         sync.Mutex
+	partitions map[string]bool
+}
+
+// NewPostGISWriter returns a PostGISWriter for table in the database at
+// url, creating the table if it doesn't exist yet.
+func NewPostGISWriter(url, table string, partitioned bool) (*PostGISWriter, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening PostgreSQL database")
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "connecting to PostgreSQL")
+	}
+	return NewPostGISWriterFor(SQLCopyDB{db}, table, partitioned)
+}
+
+// NewPostGISWriterFor returns a PostGISWriter for table in db, creating the
+// table if it doesn't exist yet.
+func NewPostGISWriterFor(db CopyDB, table string, partitioned bool) (*PostGISWriter, error) {
+	w := &PostGISWriter{
+		db:               db,
+		Table:            table,
+		PartitionByMonth: partitioned,
+		BatchSize:        10000,
+		partitions:       make(map[string]bool),
+	}
+	for _, stmt := range w.createTable() {
+		if err := db.Exec(stmt); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("creating table %s", table))
+		}
+	}
+	return w, nil
+}
+
+// createTable returns the statements creating the table and its indexes.
+func (w *PostGISWriter) createTable() []string {
+	table := pq.QuoteIdentifier(w.Table)
+	cols := make([]string, len(rideColumns))
+	for i, c := range rideColumns {
+		cols[i] = c.name + " " + c.typ
+	}
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)", table, strings.Join(cols, ",\n\t"))
+	if w.PartitionByMonth {
+		create += " PARTITION BY RANGE (pickup_time)"
+	}
+	stmts := []string{"CREATE EXTENSION IF NOT EXISTS postgis", create}
+	for _, c := range []struct{ col, method string }{{"pickup_time", "btree"}, {"pickup", "gist"}, {"dropoff", "gist"}} {
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s USING %s (%s)",
+			pq.QuoteIdentifier(w.Table+"_"+c.col+"_idx"), table, c.method, c.col))
+	}
+	return stmts
+}
+
+// partition returns the name of the partition for rides picked up in the
+// month of t, and the statement creating it.
+func (w *PostGISWriter) partition(t time.Time) (string, string) {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	name := w.Table + start.Format("_2006_01")
+	return name, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+		pq.QuoteIdentifier(name), pq.QuoteIdentifier(w.Table),
+		start.Format("2006-01-02"), start.AddDate(0, 1, 0).Format("2006-01-02"))
+}
+
+// ensurePartitions creates the partitions rows will go into, if they don't
+// exist yet.
+func (w *PostGISWriter) ensurePartitions(rows [][]interface{}) error {
+	stmts := make(map[string]string)
+	for _, row := range rows {
+		name, stmt := w.partition(row[pickupTimeColumn].(time.Time))
+		stmts[name] = stmt
+	}
+	names := make([]string, 0, len(stmts))
+	for name := range stmts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, name := range names {
+		if w.partitions[name] {
+			continue
+		}
+		if err := w.db.Exec(stmts[name]); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("creating partition %s", name))
+		}
+		w.partitions[name] = true
+	}
+	return nil
+}
+
+// write loads rows, made by rideRow, into the table.
+func (w *PostGISWriter) write(rows [][]interface{}) error {
+	if w.PartitionByMonth {
+		if err := w.ensurePartitions(rows); err != nil {
+			return err
+		}
+	}
+	cols := make([]string, len(rideColumns))
+	for i, c := range rideColumns {
+		cols[i] = c.name
+	}
+	return w.db.CopyIn(w.Table, cols, rows)
+}
+
+// Close closes the database, if it can be closed.
+func (w *PostGISWriter) Close() error {
+	if c, ok := w.db.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// rideRow returns the values of rideColumns for ride.
+func rideRow(ride *Ride) []interface{} {
+	return []interface{}{
+		ride.CabType,
+		ride.VendorID,
+		*ride.PickupTime,
+		*ride.DropTime,
+		ride.PassengerCount,
+		ride.DistMiles,
+		ride.DurationMinutes,
+		ride.SpeedMph,
+		ride.TotalDollars,
+		point(ride.PickupLon, ride.PickupLat),
+		point(ride.DropLon, ride.DropLat),
+	}
+}
+
+// point returns a WGS 84 point as EWKT, or nil for the null location.
+func point(lon, lat float64) interface{} {
+	if lon == 0 && lat == 0 {
+		return nil
+	}
+	return "SRID=4326;POINT(" + strconv.FormatFloat(lon, 'f', -1, 64) + " " + strconv.FormatFloat(lat, 'f', -1, 64) + ")"
+}
+
+// PostGISImporter imports rides into a PostGIS table.
+type PostGISImporter struct {
+	manager *RecordManager
+	writer  *PostGISWriter
+}
+
+// NewPostGISImporter returns a TaxiImporter writing to table in the
+// database at url.
+func NewPostGISImporter(r *RecordManager, url, table string, partitioned bool) (TaxiImporter, error) {
+	w, err := NewPostGISWriter(url, table, partitioned)
+	if err != nil {
+		return nil, err
+	}
+	return &PostGISImporter{
+		manager: r,
+		writer:  w,
+	}, nil
+}
+
+func (i *PostGISImporter) fetch(sources <-chan Source, records chan<- []Record) {
+	i.manager.fetch(sources, records)
+}
+
+func (i *PostGISImporter) parse(records <-chan []Record) {
+	start := time.Now()
+	n := 0
+	rows := make([][]interface{}, 0, i.writer.BatchSize)
+	recs := make([]*Record, 0, i.writer.BatchSize)
+	for batch := range records {
+		for j := range batch {
+			ride, err := parseRide(&batch[j])
+			if err != nil {
+				i.manager.skip(&batch[j], "unparseable ride", nil)
+				continue
+			}
+			rows = append(rows, rideRow(ride))
+			recs = append(recs, &batch[j])
+			releaseRide(ride)
+			if len(rows) >= i.writer.BatchSize {
+				i.flush(rows, recs)
+				n += len(rows)
+				rows, recs = rows[:0], recs[:0]
+			}
+		}
+	}
+	i.flush(rows, recs)
+	n += len(rows)
+	log.Printf("writing %v rides took %v\n", n, time.Since(start))
+}
+
+// flush writes rows, counting the records they were made of as written or
+// failed.
+func (i *PostGISImporter) flush(rows [][]interface{}, recs []*Record) {
+	if len(rows) == 0 {
+		return
+	}
+	err := i.writer.write(rows)
+	if err != nil {
+		log.Printf("copying %d rides into %s, err: %v", len(rows), i.writer.Table, err)
+	}
+	for _, rec := range recs {
+		if err != nil {
+			i.manager.failed(rec)
+		} else {
+			i.manager.written(rec)
+		}
+	}
+}
+
+func (i *PostGISImporter) close() {
+	if err := i.writer.Close(); err != nil {
+		log.Printf("closing %s, err: %v", i.writer.Table, err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCopyDB keeps the statements run and rows copied into it, failing the
+// copies while fail is set.
+type fakeCopyDB struct {
+	mu    sync.Mutex
+	stmts []string
+	rows  map[string][][]interface{}
+	fail  bool
+}
+
+func (db *fakeCopyDB) Exec(query string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.stmts = append(db.stmts, query)
+	return nil
+}
+
+func (db *fakeCopyDB) CopyIn(table string, columns []string, rows [][]interface{}) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.fail {
+		return errors.New("connection reset by peer")
+	}
+	if len(columns) != len(rideColumns) {
+		return fmt.Errorf("copying %d columns", len(columns))
+	}
+	for _, row := range rows {
+		db.rows[table] = append(db.rows[table], append([]interface{}(nil), row...))
+	}
+	return nil
+}
+
+func TestPostGISImporter(t *testing.T) {
+	db := &fakeCopyDB{rows: make(map[string][][]interface{})}
+	w, err := NewPostGISWriterFor(db, "rides", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.BatchSize = 2
+	if len(db.stmts) != 5 || db.stmts[0] != "CREATE EXTENSION IF NOT EXISTS postgis" ||
+		!strings.HasSuffix(db.stmts[1], ") PARTITION BY RANGE (pickup_time)") ||
+		!strings.Contains(db.stmts[1], "\tpickup geometry(Point, 4326),\n") ||
+		db.stmts[3] != `CREATE INDEX IF NOT EXISTS "rides_pickup_idx" ON "rides" USING gist (pickup)` {
+		t.Fatalf("unexpected statements creating the table: %q", db.stmts)
+	}
+	db.stmts = nil
+
+	rm := NewRecordManager()
+	imp := &PostGISImporter{manager: rm, writer: w}
+	green, yellow := mapperRecords[0].rec, mapperRecords[1].rec
+	nullLoc := yellow
+	nullLoc.Val = strings.Replace(strings.Replace(yellow.Val, "-73.993896484375,40.750110626220703", "0,0", 1), "19:05:39", "19:06:00", 1)
+	bad := yellow
+	bad.Val = strings.Replace(yellow.Val, ",1,1.59,", ",x,1.59,", 1)
+	records := make(chan []Record, 2)
+	records <- []Record{green, yellow, bad}
+	records <- []Record{nullLoc}
+	close(records)
+	imp.parse(records)
+
+	s := rm.Stats()
+	if s.Written != 3 || s.Skipped != 1 || s.FailedWrites != 0 {
+		t.Fatalf("expected 3 rides written and 1 skipped, got stats %+v", s)
+	}
+	expected := []string{
+		`CREATE TABLE IF NOT EXISTS "rides_2013_08" PARTITION OF "rides" FOR VALUES FROM ('2013-08-01') TO ('2013-09-01')`,
+		`CREATE TABLE IF NOT EXISTS "rides_2015_01" PARTITION OF "rides" FOR VALUES FROM ('2015-01-01') TO ('2015-02-01')`,
+	}
+	if !reflect.DeepEqual(db.stmts, expected) {
+		t.Fatalf("expected partitions %q, got %q", expected, db.stmts)
+	}
+	rows := db.rows["rides"]
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %v", rows)
+	}
+	pickup := time.Date(2015, 1, 15, 19, 5, 39, 0, time.UTC)
+	row := []interface{}{1, "2", pickup, pickup.Add(18*time.Minute + 3*time.Second), 1, 1.59, rows[1][6], rows[1][7], 17.05,
+		"SRID=4326;POINT(-73.993896484375 40.7501106262207)", "SRID=4326;POINT(-73.97478485107422 40.75061798095703)"}
+	if !reflect.DeepEqual(rows[1], row) {
+		t.Errorf("expected row\n%v\ngot\n%v", row, rows[1])
+	}
+	if rows[2][9] != nil || rows[2][10] == nil {
+		t.Errorf("expected a NULL pickup, got %v", rows[2])
+	}
+
+	// failed copies count every ride in them
+	db.fail = true
+	records = make(chan []Record, 1)
+	records <- []Record{green, yellow, green}
+	close(records)
+	imp.parse(records)
+	if s := rm.Stats(); s.FailedWrites != 3 || s.Written != 3 {
+		t.Fatalf("expected 3 failed writes, got stats %+v", s)
+	}
+	if len(db.stmts) != 2 {
+		t.Fatalf("partitions were created again: %q", db.stmts)
+	}
+}
+
+// TestPostGIS loads rides into the PostGIS database at TAXI_POSTGRES_URL,
+// such as postgres://postgres@localhost/taxi?sslmode=disable, into a table
+// it drops afterwards.
+func TestPostGIS(t *testing.T) {
+	url := os.Getenv("TAXI_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TAXI_POSTGRES_URL not set")
+	}
+	dir, err := ioutil.TempDir("", "postgis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFixtureServer()
+	defer srv.Close()
+
+	table := fmt.Sprintf("rides_test_%d", time.Now().UnixNano())
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer db.Exec("DROP TABLE IF EXISTS " + table + " CASCADE")
+
+	green := newTripFixture('g', 200)
+	yellow := newTripFixture('y', 300)
+	m, _ := newTestMain(dir,
+		srv.add("/green_tripdata_2013-08.csv", green.content, false),
+		srv.add("/yellow_tripdata_2015-01.csv", yellow.content, false),
+	)
+	m.importer = nil
+	m.PostgresURL = url
+	m.PostgresTable = table
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var n, partitions int
+	if err := db.QueryRow("SELECT count(*) FROM " + table + " WHERE ST_Y(pickup) > 40").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != green.good+yellow.good {
+		t.Errorf("expected %d rides, got %d", green.good+yellow.good, n)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM pg_inherits WHERE inhparent = $1::regclass", table).Scan(&partitions); err != nil {
+		t.Fatal(err)
+	}
+	if partitions != 2 {
+		t.Errorf("expected 2 partitions, got %d", partitions)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/pilosa/pdk"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Producer publishes rides to Topic of a Broker as the MongoDB extended
+// JSON documents written to Cosmos DB, keyed by Key: "cell" for the cell of
+// the elevation grid the ride was picked up in, so nearby pickups share a
+// partition, or "date" for the pickup date. Rides picked up outside the
+// grid have the key "none".
+type Producer struct {
+	Broker Broker
+	Topic  string
+	Key    string
+
+	grid pdk.GridMapper
+}
+
+// NewProducer returns a Producer publishing to topic on b, keyed by key.
+func NewProducer(b Broker, topic, key string) (*Producer, error) {
+	if key != "cell" && key != "date" {
+		return nil, fmt.Errorf("unknown message key %q, expected cell or date", key)
+	}
+	grid, err := gridSpec.grid()
+	if err != nil {
+		return nil, err
+	}
+	return &Producer{
+		Broker: b,
+		Topic:  topic,
+		Key:    key,
+		grid:   grid,
+	}, nil
+}
+
+// key returns the key of the message for ride.
+func (p *Producer) key(ride *Ride) string {
+	if p.Key == "date" {
+		return ride.PickupTime.Format("2006-01-02")
+	}
+	ids, err := p.grid.ID(ride.PickupLon, ride.PickupLat)
+	if err != nil {
+		return "none"
+	}
+	return strconv.FormatInt(ids[0], 10)
+}
+
+// message returns the message publishing ride.
+func (p *Producer) message(ride *Ride) (Message, error) {
+	var buf bytes.Buffer
+	if err := writeExtendedJSON(&buf, reflect.ValueOf(ride)); err != nil {
+		return Message{}, err
+	}
+	return Message{Topic: p.Topic, Key: []byte(p.key(ride)), Value: buf.Bytes()}, nil
+}
+
+// ProducerImporter publishes rides with a Producer.
+type ProducerImporter struct {
+	manager  *RecordManager
+	producer *Producer
+}
+
+// NewProducerImporter returns a TaxiImporter publishing with p.
+func NewProducerImporter(r *RecordManager, p *Producer) TaxiImporter {
+	return &ProducerImporter{
+		manager:  r,
+		producer: p,
+	}
+}
+
+func (i *ProducerImporter) fetch(sources <-chan Source, records chan<- []Record) {
+	i.manager.fetch(sources, records)
+}
+
+// parse publishes the rides of each batch at once.
+func (i *ProducerImporter) parse(records <-chan []Record) {
+	start := time.Now()
+	n := 0
+	for batch := range records {
+		msgs := make([]Message, 0, len(batch))
+		recs := make([]*Record, 0, len(batch))
+		for j := range batch {
+			ride, err := parseRide(&batch[j])
+			if err != nil {
+				i.manager.skip(&batch[j], "unparseable ride", nil)
+				continue
+			}
+			ride.ID = bson.NewObjectId()
+			msg, err := i.producer.message(ride)
+			releaseRide(ride)
+			if err != nil {
+				log.Printf("encoding record %d, err: %v", batch[j].Seq, err)
+				i.manager.skip(&batch[j], "unencodable ride", nil)
+				continue
+			}
+			msgs = append(msgs, msg)
+			recs = append(recs, &batch[j])
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		err := i.producer.Broker.Publish(msgs)
+		if err != nil {
+			log.Printf("publishing %d rides to %s, err: %v", len(msgs), i.producer.Topic, err)
+		}
+		for _, rec := range recs {
+			if err != nil {
+				i.manager.failed(rec)
+			} else {
+				i.manager.written(rec)
+			}
+		}
+		if err == nil {
+			n += len(msgs)
+		}
+	}
+	log.Printf("publishing %v rides took %v\n", n, time.Since(start))
+}
+
+func (i *ProducerImporter) close() {
+	if c, ok := i.producer.Broker.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("closing broker, err: %v", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// failingBroker is a MemoryBroker failing to publish.
+type failingBroker struct {
+	*MemoryBroker
+}
+
+func (failingBroker) Publish(msgs []Message) error {
+	return errors.New("leader not available")
+}
+
+func TestProducer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "producer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFixtureServer()
+	defer srv.Close()
+
+	green, yellow := newTripFixture('g', 200), newTripFixture('y', 300)
+	m, _ := newTestMain(dir,
+		srv.add("/green_tripdata_2013-08.csv", green.content, false),
+		srv.add("/yellow_tripdata_2015-01.csv", yellow.content, false),
+	)
+	m.importer = nil
+	b := NewMemoryBroker(4)
+	if m.Producer, err = NewProducer(b, "rides", "date"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for p := 0; p < 4; p++ {
+		msgs, err := b.Fetch("rides", p, 0, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs {
+			var doc struct {
+				PickupTime struct {
+					Date string `json:"$date"`
+				} `json:"pickup_time"`
+			}
+			if err := json.Unmarshal(msg.Value, &doc); err != nil {
+				t.Fatalf("bad message %s: %v", msg.Value, err)
+			}
+			pickup, err := time.Parse("2006-01-02T15:04:05.000Z", doc.PickupTime.Date)
+			if err != nil || pickup.Format("2006-01-02") != string(msg.Key) {
+				t.Fatalf("message keyed %s for pickup %s", msg.Key, doc.PickupTime.Date)
+			}
+			n++
+		}
+	}
+	if good := green.good + yellow.good; n != good || m.recordManager.Stats().Written != int64(good) {
+		t.Fatalf("expected %d messages, got %d, stats %+v", good, n, m.recordManager.Stats())
+	}
+
+	// failed publishes count every ride in them
+	rm := NewRecordManager()
+	imp := NewProducerImporter(rm, &Producer{Broker: failingBroker{b}, Topic: "rides", Key: "date"})
+	records := make(chan []Record, 1)
+	records <- []Record{mapperRecords[0].rec, mapperRecords[1].rec}
+	close(records)
+	imp.parse(records)
+	if s := rm.Stats(); s.FailedWrites != 2 || s.Written != 0 {
+		t.Fatalf("expected 2 failed writes, got stats %+v", s)
+	}
+}
+
+func TestProducerKey(t *testing.T) {
+	if _, err := NewProducer(NewMemoryBroker(1), "rides", "zone"); err == nil {
+		t.Fatalf("expected an error for an unknown key")
+	}
+	p, err := NewProducer(NewMemoryBroker(1), "rides", "cell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ride, err := parseRide(&mapperRecords[0].rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseRide(ride)
+	if key := p.key(ride); key != "4660" {
+		t.Errorf("expected cell 4660, got %s", key)
+	}
+	ride.PickupLon, ride.PickupLat = 0, 0
+	if key := p.key(ride); key != "none" {
+		t.Errorf("expected no cell for a null location, got %s", key)
+	}
+}
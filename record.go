@@ -58,6 +58,19 @@ var yellowFields = map[string]int{
 type Record struct {
 	Type rune
 	Val  string
+	// Schema is the column layout of Val, nil for the default layout of Type.
+	Schema *Schema
+	// Seq is the position of the record among those read from its source,
+	// and IDs the column range of the source, if it has one.
+	Seq uint64
+	IDs *ColumnRange
+	// Event, if set, is the event of the ride the record is replayed as,
+	// copied to its Ride, and replayed the ride shared with its other event.
+	Event    string
+	replayed *replayedRide
+	// delivery, if set, is the topic message the record came from, told
+	// once the record is written, skipped or failed.
+	delivery *delivery
 }
 
 // Ride rides
@@ -84,10 +97,17 @@ type Ride struct {
 	DropMonth       int           `bson:"drop_month"`
 	DropYear        int           `bson:"drop_year"`
 	CabType         int           `bson:"cab_type"`
+	// Event is "pickup" or "dropoff" for rides replayed as separate events.
+	Event string `bson:"event,omitempty"`
 	//pickupGridID    uint64    `bson:"pickup_grid_id, omitempty"`
 	//dropGridID      uint64    `bson:"drop_grid_id, omitempty"`
 	//pickupElevation float64   `bson:"pickup_elevation, omitempty"`
 	//dropElevation   float64   `bson:"drop_elevation, omitempty"`
+
+	// backing storage for PickupTime and DropTime, so parseRide doesn't need
+	// to allocate them
+	pickupTime time.Time
+	dropTime   time.Time
 }
 
 func (r *Record) Clean() ([]string, bool) {
@@ -98,6 +118,23 @@ func (r *Record) Clean() ([]string, bool) {
 	return fields, true
 }
 
+// schema returns the column layout of the record.
+func (r *Record) schema() *Schema {
+	if r.Schema != nil {
+		return r.Schema
+	}
+	return defaultSchema(r.Type)
+}
+
+// fieldNames returns the column names of the record mapped to their index.
+func (r *Record) fieldNames() (map[string]int, error) {
+	schema := r.schema()
+	if schema == nil {
+		return nil, fmt.Errorf("Bad Record Type %v", r.Type)
+	}
+	return schema.Fields, nil
+}
+
 func parseDate(datetime string) (*time.Time, error) {
 	dateFormat := "2006-01-02 15:04:05"
 
@@ -121,12 +158,9 @@ func (r *Record) safeParseDateField(fieldName string, fields []string) (t *time.
 	var tm time.Time
 	dateFormat := "2006-01-02 15:04:05"
 
-	if r.Type == 'g' {
-		fieldNames = greenFields
-	} else if r.Type == 'y' {
-		fieldNames = yellowFields
-	} else {
-		return nil, fmt.Errorf("Bad Record Type %v", r.Type)
+	fieldNames, err = r.fieldNames()
+	if err != nil {
+		return nil, err
 	}
 
 	if fieldNames[fieldName] < len(fields) {
@@ -148,12 +182,9 @@ func (r *Record) safeParseIntegerField(fieldName string, fields []string) (i int
 
 	var fieldNames map[string]int
 
-	if r.Type == 'g' {
-		fieldNames = greenFields
-	} else if r.Type == 'y' {
-		fieldNames = yellowFields
-	} else {
-		return -1, fmt.Errorf("Bad Record Type %v", r.Type)
+	fieldNames, err = r.fieldNames()
+	if err != nil {
+		return -1, err
 	}
 
 	if fieldNames[fieldName] < len(fields) {
@@ -175,12 +206,9 @@ func (r *Record) safeParseFloatField(fieldName string, fields []string) (f float
 
 	var fieldNames map[string]int
 
-	if r.Type == 'g' {
-		fieldNames = greenFields
-	} else if r.Type == 'y' {
-		fieldNames = yellowFields
-	} else {
-		return -1, fmt.Errorf("Bad Record Type %v", r.Type)
+	fieldNames, err = r.fieldNames()
+	if err != nil {
+		return -1, err
 	}
 
 	if fieldNames[fieldName] < len(fields) {
@@ -213,6 +241,7 @@ func (r *Record) toRide() (ride *Ride, err error) {
 		log.Printf("unknown record type, %v\n", r)
 		return nil, nil
 	}
+	ride.Event = r.Event
 
 	// pilosa smaple does not include
 	// store_and_fwd_flag
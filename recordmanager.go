@@ -1,28 +1,44 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"reflect"
+	"runtime"
 	"strings"
-	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/pilosa/pdk"
+	"github.com/pkg/errors"
 )
 
 // RecordManager fetches
 type RecordManager struct {
 	UseReadAll bool
-	totalBytes int64
-	bytesLock  sync.Mutex
+	HTTP       *HTTPFetcher
+	// BatchSize is the number of records sent down the records channel at
+	// once.
+	BatchSize int
+	// Local files larger than ChunkSize are read in chunks of that size, by
+	// up to ChunkConcurrency goroutines at once.
+	ChunkSize        int64
+	ChunkConcurrency int
+	// Retries hands out sources to fetch and retries the ones that fail.
+	Retries *RetryQueue
+	// Cache, if set, keeps local copies of remote files.
+	Cache *Cache
+	// Lines longer than MaxLineSize bytes are written to Rejects and
+	// skipped.
+	MaxLineSize int
+	Rejects     *RejectLog
+	// Samples, if set, keeps a few of the records skipped for each reason.
+	Samples *RejectSamples
+
+	totalBytes *Counter
 	nexter     *Nexter
 
 	totalRecs      *Counter
@@ -37,14 +53,30 @@ type RecordManager struct {
 	badUnknowns    *Counter
 	readRecords    *Counter
 	writtenRecords *Counter
+	longLines      *Counter
+	badColumnIDs   *Counter
+	// badValues counts int field values that couldn't be stored; the ride
+	// itself is kept.
+	badValues *Counter
+	// failedWrites counts records the sink wouldn't take.
+	failedWrites *Counter
+	// filteredRecs counts records the filter dropped, which aren't skipped.
+	filteredRecs *Counter
 }
 
 //NewRecordManager returns a new RecordManager
 func NewRecordManager() *RecordManager {
 	return &RecordManager{
-		UseReadAll: false,
-		nexter:     &Nexter{id: 0},
+		UseReadAll:       false,
+		HTTP:             NewHTTPFetcher(),
+		BatchSize:        1000,
+		ChunkSize:        64 << 20,
+		ChunkConcurrency: runtime.NumCPU(),
+		Retries:          NewRetryQueue(10, 10*time.Second),
+		MaxLineSize:      1 << 20,
+		nexter:           &Nexter{id: 0},
 
+		totalBytes:     &Counter{},
 		totalRecs:      &Counter{},
 		skippedRecs:    &Counter{},
 		nullLocs:       &Counter{},
@@ -57,136 +89,314 @@ func NewRecordManager() *RecordManager {
 		badUnknowns:    &Counter{},
 		readRecords:    &Counter{},
 		writtenRecords: &Counter{},
+		longLines:      &Counter{},
+		badColumnIDs:   &Counter{},
+		badValues:      &Counter{},
+		failedWrites:   &Counter{},
+		filteredRecs:   &Counter{},
 	}
 
 }
 
-func stringCopy(s string) string {
-	var b []byte
-	h := (*reflect.SliceHeader)(unsafe.Pointer(&b))
-	h.Data = (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
-	h.Len = len(s)
-	h.Cap = len(s)
-	return string(b)
+// newLineReader returns a lineReader for r, the content of src, which
+// quarantines lines longer than MaxLineSize.
+func (f *RecordManager) newLineReader(src Source, r io.Reader) *lineReader {
+	return newLineReader(r, f.MaxLineSize, func() io.WriteCloser {
+		f.totalRecs.Add(1)
+		f.skippedRecs.Add(1)
+		f.longLines.Add(1)
+		return f.Rejects.quarantine(src.URL, fmt.Sprintf("line longer than %d bytes", f.MaxLineSize))
+	})
 }
 
-func (f *RecordManager) fetch(urls <-chan string, records chan<- Record) {
+func (f *RecordManager) fetch(sources <-chan Source, records chan<- []Record) {
 	fmt.Println("RecordManager fetch")
-	failedURLs := make(map[string]int)
 	for {
-		url, ok := getNextURL(urls, failedURLs)
-		fmt.Printf("next url %s\n", url)
+		src, ok := f.Retries.Next(sources)
 		if !ok {
 			break
 		}
-		var typ rune
-		if strings.Contains(url, "green") {
-			typ = 'g'
-		} else if strings.Contains(url, "yellow") {
-			typ = 'y'
+		fmt.Printf("next url %s\n", src)
+		err := f.fetchSource(src, records)
+		if err == nil {
+			f.Retries.Done(src)
+		} else if f.Retries.Fail(src, err) {
+			log.Printf("fetching %s failed, will retry, err: %v", src, err)
 		} else {
-			typ = 'x'
+			log.Printf("fetching %s failed for good, err: %v", src, err)
 		}
-		var content io.ReadCloser
-		if strings.HasPrefix(url, "http") {
-			resp, err := http.Get(url)
-			if err != nil {
-				log.Printf("fetching %s, err: %v", url, err)
-				continue
-			}
-			content = resp.Body
-		} else {
-			f, err := os.Open(url)
-			if err != nil {
-				log.Printf("opening %s, err: %v", url, err)
-				continue
-			}
-			content = f
+	}
+}
+
+// fetchSource reads all records from src into records. Errors that happen
+// after the first record was sent are permanent, since retrying would send
+// records twice.
+func (f *RecordManager) fetchSource(src Source, records chan<- []Record) error {
+	url := src.URL
+	typ := src.Type
+	if typ == 0 {
+		typ = guessCabType(url)
+	}
+	content, err := f.open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := content.Close(); err != nil {
+			log.Printf("closing %s, err: %v", url, err)
 		}
-		var scan *bufio.Scanner
-		if f.UseReadAll {
-			// we're using ReadAll here to ensure that we can read the entire
-			// file/url before we start putting it into Pilosa. Not great for memory
-			// usage or smooth performance, but we want to ensure repeatable results
-			// in the simplest way possible.
-			contentBytes, err := ioutil.ReadAll(content)
-			if err != nil {
-				failedURLs[url]++
-				if failedURLs[url] > 10 {
-					log.Fatalf("Unrecoverable failure while fetching url: %v, err: %v. Could not read fully after 10 tries.", url, err)
-				}
-				continue
-			}
-			err = content.Close()
-			if err != nil {
-				log.Printf("closing %s, err: %v", url, err)
-			}
-
-			buf := bytes.NewBuffer(contentBytes)
-			scan = bufio.NewScanner(buf)
-		} else {
-			scan = bufio.NewScanner(content)
+	}()
+
+	if file, ok := content.(*os.File); ok && !f.UseReadAll && f.ChunkConcurrency > 1 {
+		info, err := file.Stat()
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("opening %s", url))
+		}
+		if info.Size() > f.ChunkSize {
+			return f.fetchFileChunks(src, typ, file, info.Size(), records)
+		}
+	}
+
+	var lines *lineReader
+	if f.UseReadAll {
+		// we're using ReadAll here to ensure that we can read the entire
+		// file/url before we start putting it into Pilosa. Not great for memory
+		// usage or smooth performance, but we want to ensure repeatable results
+		// in the simplest way possible.
+		contentBytes, err := ioutil.ReadAll(content)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("reading %s", url))
 		}
+		lines = f.newLineReader(src, bytes.NewReader(contentBytes))
+	} else {
+		lines = f.newLineReader(src, content)
+	}
+
+	// discard header line, checking it against the schema
+	schema := src.Schema
+	header, err := lines.ReadLine()
+	if err == nil || err == errLineTooLong {
+		schema, err = checkSourceHeader(src, typ, header)
+		if err != nil {
+			return err
+		}
+	} else if err == io.EOF {
+		err = nil
+	}
+	b := f.newBatcher(records, nil)
+	var seq uint64
+	for err == nil || err == errLineTooLong {
+		var line string
+		line, err = lines.ReadLine()
+		if err == nil {
+			b.add(Record{Val: line, Type: typ, Schema: schema, Seq: seq, IDs: src.IDs})
+			seq++
+		}
+	}
+	b.flush()
+	fmt.Println("done scanning")
+	if err != io.EOF {
+		err = errors.Wrap(err, fmt.Sprintf("scanning %s", url))
+		if b.sent {
+			return permanent(err)
+		}
+		return err
+	}
+	return nil
+}
 
-		// discard header line
-		correctLine := false
-		if scan.Scan() {
-			header := scan.Text()
-			if strings.HasPrefix(header, "vendor_") {
-				correctLine = true
-			}
+// open opens the url or file of src, through the cache if there is one.
+// Files named .gz are decompressed, and so never read in chunks. Errors that
+// retrying won't fix are permanent.
+func (f *RecordManager) open(src Source) (io.ReadCloser, error) {
+	url := src.URL
+	if strings.HasPrefix(url, "http") {
+		var body io.ReadCloser
+		var err error
+		if f.Cache != nil {
+			body, err = f.Cache.Open(url)
+		} else {
+			body, err = f.HTTP.Open(url)
 		}
-		for scan.Scan() {
-			f.totalRecs.Add(1)
-			record := scan.Text()
-			f.AddBytes(len(record))
-			if correctLine {
-				// last field needs to be shifted over by 1
-				lastcomma := strings.LastIndex(record, ",")
-				if lastcomma == -1 {
-					f.skippedRecs.Add(1)
-					continue
-				}
-				record = record[:lastcomma] + "," + record[lastcomma:]
-			}
-			f.readRecords.Add(1)
-			records <- Record{Val: record, Type: typ}
+		if se, ok := err.(*statusError); ok && !se.temporary() {
+			return nil, permanent(err)
+		} else if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("fetching %s", url))
 		}
-		fmt.Println("done scanning")
-		err := scan.Err()
+		return body, nil
+	}
+	file, err := os.Open(url)
+	if os.IsNotExist(err) {
+		return nil, permanent(err)
+	} else if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("opening %s", url))
+	}
+	if strings.HasSuffix(url, ".gz") {
+		zr, err := gzip.NewReader(file)
 		if err != nil {
-			log.Printf("scan error on %s, err: %v", url, err)
+			file.Close()
+			return nil, permanent(errors.Wrap(err, fmt.Sprintf("decompressing %s", url)))
 		}
-		delete(failedURLs, url)
+		return &gzipFile{Reader: zr, file: file}, nil
+	}
+	return file, nil
+}
+
+// gzipFile is the decompressed content of a gzipped file.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Reader.Close()
+	if cerr := g.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fetchFileChunks reads a local file with fetchChunks.
+func (f *RecordManager) fetchFileChunks(src Source, typ rune, file *os.File, size int64, records chan<- []Record) error {
+	lines := f.newLineReader(src, io.NewSectionReader(file, 0, size))
+	header, err := lines.ReadLine()
+	if err != nil && err != io.EOF && err != errLineTooLong {
+		return errors.Wrap(err, fmt.Sprintf("reading %s", src.URL))
+	}
+	schema, err := checkSourceHeader(src, typ, header)
+	if err != nil {
+		return err
+	}
+	sent, err := f.fetchChunks(src, file, lines.offset, size, func(line string) Record {
+		return Record{Val: line, Type: typ, Schema: schema, IDs: src.IDs}
+	}, records)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("reading %s", src.URL))
+		if sent {
+			return permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkSourceHeader returns the schema of src given its header line.
+func checkSourceHeader(src Source, typ rune, header string) (*Schema, error) {
+	if typ != 'g' && typ != 'y' {
+		return src.Schema, nil
+	}
+	schema, err := checkHeader(typ, src.Schema, header)
+	if err != nil {
+		return nil, permanent(errors.Wrap(err, fmt.Sprintf("checking header of %s", src.URL)))
+	}
+	return schema, nil
+}
+
+// skip counts record as skipped for reason, and in counter if it isn't nil.
+func (f *RecordManager) skip(record *Record, reason string, counter *Counter) {
+	if count, _ := record.replayed.done(true, true); !count {
+		record.settle(true)
+		return
+	}
+	f.skippedRecs.Add(1)
+	if counter != nil {
+		counter.Add(1)
+	}
+	f.Samples.Add(reason, record.Val)
+	record.settle(true)
+}
+
+// written counts record as written.
+func (f *RecordManager) written(record *Record) {
+	f.countWrite(record, true)
+	record.settle(true)
+}
+
+// buffered counts record as written by a sink that stores it later, holding
+// it in held to be settled then.
+func (f *RecordManager) buffered(record *Record, held *heldRecords) {
+	f.countWrite(record, true)
+	held.hold(record)
+}
+
+// failed counts record as failed to be written.
+func (f *RecordManager) failed(record *Record) {
+	f.countWrite(record, false)
+	record.settle(false)
+}
+
+// countWrite counts record as written if ok, or as failed. The ride of a
+// replayed event is counted once, by the last of its events.
+func (f *RecordManager) countWrite(record *Record, ok bool) {
+	count, failed := record.replayed.done(false, ok)
+	if !count {
+		return
+	}
+	if failed {
+		f.failedWrites.Add(1)
+	} else {
+		f.writtenRecords.Add(1)
 	}
 }
 
 func (f *RecordManager) AddBytes(n int) {
-	f.bytesLock.Lock()
-	f.totalBytes += int64(n)
-	f.bytesLock.Unlock()
+	f.totalBytes.Add(n)
 }
 
 func (f *RecordManager) BytesProcessed() (num int64) {
-	f.bytesLock.Lock()
-	num = f.totalBytes
-	f.bytesLock.Unlock()
-	return
-}
-
-// getNextURL fetches the next url from the channel, or if it is emtpy, gets a
-// url from the failedURLs map after 10 seconds of waiting on the channel. As
-// long as it gets a url, its boolean return value is true - if it does not get
-// a url, it returns false.
-func getNextURL(urls <-chan string, failedURLs map[string]int) (string, bool) {
-	url, open := <-urls
-	if !open {
-		for url, _ := range failedURLs {
-			return url, true
-		}
-		return "", false
+	return f.totalBytes.Get()
+}
+
+// Stats is a snapshot of a RecordManager's counters.
+type Stats struct {
+	Rides         int64
+	Bytes         int64
+	Records       int64
+	Read          int64
+	Written       int64
+	FailedWrites  int64
+	FailedSources int
+	LongLines     int64
+	Filtered      int64
+	Skipped       int64
+	BadLocs       int64
+	NullLocs      int64
+	BadSpeeds     int64
+	BadTotalAmnts int64
+	BadDurations  int64
+	BadUnknowns   int64
+	BadPassCounts int64
+	BadDist       int64
+	BadColumnIDs  int64
+	BadValues     int64
+}
+
+// Stats returns the current counts without holding up the goroutines
+// updating them. The counters are read one after the other while they keep
+// changing, so totals can be slightly ahead of their parts.
+func (f *RecordManager) Stats() Stats {
+	return Stats{
+		Rides:         f.nexter.Used(),
+		Bytes:         f.BytesProcessed(),
+		Records:       f.totalRecs.Get(),
+		Read:          f.readRecords.Get(),
+		Written:       f.writtenRecords.Get(),
+		FailedWrites:  f.failedWrites.Get(),
+		FailedSources: len(f.Retries.Failed()),
+		LongLines:     f.longLines.Get(),
+		Filtered:      f.filteredRecs.Get(),
+		Skipped:       f.skippedRecs.Get(),
+		BadLocs:       f.badLocs.Get(),
+		NullLocs:      f.nullLocs.Get(),
+		BadSpeeds:     f.badSpeeds.Get(),
+		BadTotalAmnts: f.badTotalAmnts.Get(),
+		BadDurations:  f.badDurations.Get(),
+		BadUnknowns:   f.badUnknowns.Get(),
+		BadPassCounts: f.badPassCounts.Get(),
+		BadDist:       f.badDist.Get(),
+		BadColumnIDs:  f.badColumnIDs.Get(),
+		BadValues:     f.badValues.Get(),
 	}
-	return url, true
 }
 
 func (m *RecordManager) printStats() *time.Ticker {
@@ -195,10 +405,10 @@ func (m *RecordManager) printStats() *time.Ticker {
 	go func() {
 		for range t.C {
 			duration := time.Since(start)
-			bytes := m.BytesProcessed()
-			log.Printf("Rides: %d, Bytes: %s, Records: %v, Duration: %v, Rate: %v/s", m.nexter.Last(), pdk.Bytes(bytes), m.totalRecs.Get(), duration, pdk.Bytes(float64(bytes)/duration.Seconds()))
-			log.Printf("Read: %d, Written: %d", m.readRecords.Get(), m.writtenRecords.Get())
-			log.Printf("Skipped: %v, badLocs: %v, nullLocs: %v, badSpeeds: %v, badTotalAmnts: %v, badDurations: %v, badUnknowns: %v, badPassCounts: %v, badDist: %v", m.skippedRecs.Get(), m.badLocs.Get(), m.nullLocs.Get(), m.badSpeeds.Get(), m.badTotalAmnts.Get(), m.badDurations.Get(), m.badUnknowns.Get(), m.badPassCounts.Get(), m.badDist.Get())
+			s := m.Stats()
+			log.Printf("Rides: %d, Bytes: %s, Records: %v, Duration: %v, Rate: %v/s", s.Rides, pdk.Bytes(s.Bytes), s.Records, duration, pdk.Bytes(float64(s.Bytes)/duration.Seconds()))
+			log.Printf("Read: %d, Filtered: %d, Written: %d, Failed writes: %d, Failed sources: %d, Long lines: %d", s.Read, s.Filtered, s.Written, s.FailedWrites, s.FailedSources, s.LongLines)
+			log.Printf("Skipped: %v, badLocs: %v, nullLocs: %v, badSpeeds: %v, badTotalAmnts: %v, badDurations: %v, badUnknowns: %v, badPassCounts: %v, badDist: %v, badColumnIDs: %v, badValues: %v", s.Skipped, s.BadLocs, s.NullLocs, s.BadSpeeds, s.BadTotalAmnts, s.BadDurations, s.BadUnknowns, s.BadPassCounts, s.BadDist, s.BadColumnIDs, s.BadValues)
 		}
 	}()
 	return t
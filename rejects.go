@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RejectLog records lines that could not be imported, one per line as
+//
+//	source<TAB>reason<TAB>line
+//
+// A nil *RejectLog discards everything.
+type RejectLog struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+	c  io.Closer
+}
+
+// NewRejectLog returns a RejectLog writing to w.
+func NewRejectLog(w io.Writer) *RejectLog {
+	l := &RejectLog{w: bufio.NewWriter(w)}
+	if c, ok := w.(io.Closer); ok {
+		l.c = c
+	}
+	return l
+}
+
+// CreateRejectLog returns a RejectLog writing to a new file at path.
+func CreateRejectLog(path string) (*RejectLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewRejectLog(f), nil
+}
+
+// Reject records line from source as rejected for reason.
+func (l *RejectLog) Reject(source, reason, line string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writeHeader(source, reason)
+	l.w.WriteString(line)
+	l.w.WriteByte('\n')
+}
+
+// quarantine starts a reject entry whose line is written piece by piece to
+// the returned writer, for lines too long to hold in memory. The line is
+// spooled to a temporary file and only copied into the log once the writer
+// is closed, so a slow source doesn't hold up the other entries.
+func (l *RejectLog) quarantine(source, reason string) io.WriteCloser {
+	if l == nil {
+		return nopWriteCloser{}
+	}
+	return &quarantined{l: l, source: source, reason: reason}
+}
+
+func (l *RejectLog) writeHeader(source, reason string) {
+	l.w.WriteString(strings.Replace(source, "\t", " ", -1))
+	l.w.WriteByte('\t')
+	l.w.WriteString(reason)
+	l.w.WriteByte('\t')
+}
+
+// Close flushes the log and closes the underlying writer.
+func (l *RejectLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.w.Flush()
+	if l.c != nil {
+		if cerr := l.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type quarantined struct {
+	l              *RejectLog
+	source, reason string
+	// spool holds the line until Close, created by the first Write.
+	spool *os.File
+}
+
+func (q *quarantined) Write(p []byte) (int, error) {
+	if q.spool == nil {
+		f, err := ioutil.TempFile("", "reject")
+		if err != nil {
+			return 0, err
+		}
+		q.spool = f
+	}
+	return q.spool.Write(p)
+}
+
+func (q *quarantined) Close() error {
+	var err error
+	q.l.mu.Lock()
+	q.l.writeHeader(q.source, q.reason)
+	if q.spool != nil {
+		if _, err = q.spool.Seek(0, io.SeekStart); err == nil {
+			_, err = io.Copy(q.l.w, q.spool)
+		}
+	}
+	if werr := q.l.w.WriteByte('\n'); err == nil {
+		err = werr
+	}
+	q.l.mu.Unlock()
+	if q.spool != nil {
+		q.spool.Close()
+		os.Remove(q.spool.Name())
+	}
+	return err
+}
+
+type nopWriteCloser struct{}
+
+func (nopWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopWriteCloser) Close() error                { return nil }
+
+// RejectSamples keeps the first lines rejected for each reason, and counts
+// them all. A nil *RejectSamples discards everything.
+type RejectSamples struct {
+	// Max is the number of lines kept per reason.
+	Max int
+
+	mu      sync.Mutex
+	counts  map[string]int64
+	samples map[string][]string
+}
+
+// NewRejectSamples returns a RejectSamples keeping up to max lines per
+// reason.
+func NewRejectSamples(max int) *RejectSamples {
+	return &RejectSamples{
+		Max:     max,
+		counts:  make(map[string]int64),
+		samples: make(map[string][]string),
+	}
+}
+
+// Add records line as rejected for reason.
+func (s *RejectSamples) Add(reason, line string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[reason]++
+	if len(s.samples[reason]) < s.Max {
+		s.samples[reason] = append(s.samples[reason], line)
+	}
+}
+
+// Reasons returns the reasons seen so far, most frequent first.
+func (s *RejectSamples) Reasons() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reasons := make([]string, 0, len(s.counts))
+	for reason := range s.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if s.counts[reasons[i]] != s.counts[reasons[j]] {
+			return s.counts[reasons[i]] > s.counts[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	return reasons
+}
+
+// Count returns the number of lines rejected for reason.
+func (s *RejectSamples) Count(reason string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[reason]
+}
+
+// Lines returns the lines kept for reason.
+func (s *RejectSamples) Lines(reason string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.samples[reason]...)
+}
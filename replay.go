@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Replay emits the records of a run in pickup time order, paced against a
+// virtual clock that starts at the first pickup and runs Speed times as
+// fast as the wall clock, so 60 replays an hour of rides in a minute. A
+// Speed of 0 emits them as fast as possible. Records are held in memory
+// until every source is read, so a replay should cover about a month.
+//
+// With Events set, every ride is emitted twice, as a "pickup" event at its
+// pickup time and a "dropoff" event at its dropoff time, the Event of its
+// Ride telling them apart. The stats still count rides: a ride is written
+// once both its events are, and failed if either failed.
+type Replay struct {
+	Speed  float64
+	Events bool
+
+	// now and sleep are the wall clock, replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewReplay returns a Replay at speed.
+func NewReplay(speed float64) *Replay {
+	return &Replay{
+		Speed: speed,
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+// replayEvent is a record due at a time of the virtual clock.
+type replayEvent struct {
+	at  time.Time
+	rec Record
+}
+
+// replayedRide is the ride the pickup and dropoff events of a replay are
+// records of, for it to be counted once rather than for each event.
+type replayedRide struct {
+	mu      sync.Mutex
+	pending int
+	skipped bool
+	failed  bool
+}
+
+// done tells r that one of its events was skipped if skip is set, or
+// otherwise written if ok, and reports whether the ride is to be counted
+// now: when the first of its events is skipped, or when the last is done
+// with and neither was skipped, as failed if either failed. A nil r is the
+// ride of a record that isn't an event, counted every time.
+func (r *replayedRide) done(skip, ok bool) (count, failed bool) {
+	if r == nil {
+		return true, !ok
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending--
+	if skip {
+		count = !r.skipped
+		r.skipped = true
+		return count, false
+	}
+	r.failed = r.failed || !ok
+	return r.pending == 0 && !r.skipped, r.failed
+}
+
+// eventTime returns the time in field of r, reporting false if it can't be
+// read.
+func eventTime(r *Record, field string) (time.Time, bool) {
+	schema := r.schema()
+	if schema == nil {
+		return time.Time{}, false
+	}
+	fields, ok := r.Clean()
+	if !ok {
+		return time.Time{}, false
+	}
+	s, ok := fieldValue(fields, schema, field)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := parseTimeField(s, field)
+	return t, err == nil
+}
+
+// run collects the records from in, then sends them to out in batches of
+// up to size, each once the virtual clock reaches it. Records without
+// readable times are sent first, for the sinks to count as they do.
+func (r *Replay) run(in <-chan []Record, out chan<- []Record, size int) {
+	var events []replayEvent
+	var undated []Record
+	for batch := range in {
+		for _, rec := range batch {
+			pickup, ok := eventTime(&rec, "pickup_datetime")
+			if !ok {
+				undated = append(undated, rec)
+				continue
+			}
+			if !r.Events {
+				events = append(events, replayEvent{at: pickup, rec: rec})
+				continue
+			}
+			dropoff, ok := eventTime(&rec, "dropoff_datetime")
+			if !ok {
+				undated = append(undated, rec)
+				continue
+			}
+			rec.replayed = &replayedRide{pending: 2}
+			rec.Event = "pickup"
+			events = append(events, replayEvent{at: pickup, rec: rec})
+			rec.Event = "dropoff"
+			events = append(events, replayEvent{at: dropoff, rec: rec})
+		}
+	}
+	for len(undated) > 0 {
+		n := size
+		if n > len(undated) {
+			n = len(undated)
+		}
+		out <- undated[:n]
+		undated = undated[n:]
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at.Before(events[j].at) })
+	first, last := events[0].at, events[len(events)-1].at
+	log.Printf("replaying %d events from %v to %v at %vx", len(events), first, last, r.Speed)
+	start := r.now()
+	batch := make([]Record, 0, size)
+	for _, e := range events {
+		if r.Speed > 0 {
+			due := start.Add(time.Duration(float64(e.at.Sub(first)) / r.Speed))
+			if wait := due.Sub(r.now()); wait > 0 {
+				// what is due now goes out before waiting for the rest
+				if len(batch) > 0 {
+					out <- batch
+					batch = make([]Record, 0, size)
+				}
+				r.sleep(wait)
+			}
+		}
+		batch = append(batch, e.rec)
+		if len(batch) >= size {
+			out <- batch
+			batch = make([]Record, 0, size)
+		}
+	}
+	if len(batch) > 0 {
+		out <- batch
+	}
+	log.Printf("replayed %v of rides in %v", last.Sub(first), r.now().Sub(start))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeClock is a wall clock that moves only when slept on.
+type fakeClock struct {
+	t     time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.slept = append(c.slept, d)
+	c.t = c.t.Add(d)
+}
+
+// replayRecord returns a yellow record picked up at pickup and dropped off
+// minutes later.
+func replayRecord(pickup string, minutes int) Record {
+	t, _ := time.Parse(defaultTimeLayout, pickup)
+	return Record{Type: 'y', Schema: yellow2015Schema, Val: "2," + pickup + "," + t.Add(time.Duration(minutes)*time.Minute).Format(defaultTimeLayout) +
+		",1,1.59,-73.993896484375,40.750110626220703,1,N,-73.974784851074219,40.750617980957031,1,12,1,0.5,3.25,0,0.3,17.05"}
+}
+
+// runReplay replays batches and returns the batches sent.
+func runReplay(r *Replay, size int, batches ...[]Record) [][]Record {
+	in := make(chan []Record, len(batches))
+	for _, b := range batches {
+		in <- b
+	}
+	close(in)
+	out := make(chan []Record, 100)
+	r.run(in, out, size)
+	close(out)
+	var sent [][]Record
+	for b := range out {
+		sent = append(sent, b)
+	}
+	return sent
+}
+
+func TestReplay(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	r := NewReplay(60)
+	r.now, r.sleep = clock.now, clock.sleep
+
+	a := replayRecord("2015-01-15 19:00:00", 10)
+	b := replayRecord("2015-01-15 19:00:00", 5)
+	c := replayRecord("2015-01-15 19:30:00", 20)
+	d := replayRecord("2015-01-15 20:00:00", 1)
+	bad := Record{Type: 'y', Schema: yellow2015Schema, Val: "2,yesterday"}
+	sent := runReplay(r, 2, []Record{c, a, bad}, []Record{d, b})
+
+	// rides picked up at the same time keep their order, and the clock
+	// waits a minute for every hour of rides
+	expected := [][]Record{{bad}, {a, b}, {c}, {d}}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("expected batches\n%v\ngot\n%v", expected, sent)
+	}
+	if !reflect.DeepEqual(clock.slept, []time.Duration{30 * time.Second, 30 * time.Second}) {
+		t.Fatalf("unexpected waits %v", clock.slept)
+	}
+
+	// events come at both ends of the rides, in order
+	clock.slept = nil
+	r.Events = true
+	var events []string
+	for _, batch := range runReplay(r, 10, []Record{c, a, d}) {
+		for _, rec := range batch {
+			events = append(events, rec.Val[2:21]+" "+rec.Event)
+		}
+	}
+	expectedEvents := []string{
+		"2015-01-15 19:00:00 pickup",
+		"2015-01-15 19:00:00 dropoff",
+		"2015-01-15 19:30:00 pickup",
+		"2015-01-15 19:30:00 dropoff",
+		"2015-01-15 20:00:00 pickup",
+		"2015-01-15 20:00:00 dropoff",
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Fatalf("expected events\n%v\ngot\n%v", expectedEvents, events)
+	}
+	// the 19:30 dropoff at 19:50 and the 20:00 one at 20:01 are waited for
+	if !reflect.DeepEqual(clock.slept, []time.Duration{10 * time.Second, 20 * time.Second, 20 * time.Second, 10 * time.Second, time.Second}) {
+		t.Fatalf("unexpected waits %v", clock.slept)
+	}
+}
+
+func TestReplayedRideStats(t *testing.T) {
+	rm := NewRecordManager()
+	written, failed, skipped := &replayedRide{pending: 2}, &replayedRide{pending: 2}, &replayedRide{pending: 2}
+	rm.written(&Record{replayed: written})
+	if s := rm.Stats(); s.Written != 0 {
+		t.Fatalf("counted a ride before its dropoff was written, stats %+v", s)
+	}
+	rm.written(&Record{replayed: written})
+	rm.failed(&Record{replayed: failed})
+	rm.written(&Record{replayed: failed})
+	rm.skip(&Record{replayed: skipped}, "unparseable ride", nil)
+	rm.skip(&Record{replayed: skipped}, "unparseable ride", nil)
+	if s := rm.Stats(); s.Written != 1 || s.FailedWrites != 1 || s.Skipped != 1 {
+		t.Fatalf("expected a ride written, failed and skipped each, got stats %+v", s)
+	}
+}
+
+func TestMainRunReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFixtureServer()
+	defer srv.Close()
+
+	green, yellow := newTripFixture('g', 100), newTripFixture('y', 100)
+	m, _ := newTestMain(dir,
+		srv.add("/green_tripdata_2013-08.csv", green.content, false),
+		srv.add("/yellow_tripdata_2015-01.csv", yellow.content, false),
+	)
+	m.importer = nil
+	m.Concurrency = 1
+	b := NewMemoryBroker(1)
+	if m.Producer, err = NewProducer(b, "rides", "date"); err != nil {
+		t.Fatal(err)
+	}
+	m.Replay = NewReplay(0)
+	m.Replay.Events = true
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := b.Fetch("rides", 0, 0, 10000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := green.good + yellow.good
+	if len(msgs) != 2*good {
+		t.Fatalf("expected %d events, got %d", 2*good, len(msgs))
+	}
+	var last time.Time
+	pickups := 0
+	for _, msg := range msgs {
+		var doc struct {
+			Event      string
+			PickupTime struct {
+				Date string `json:"$date"`
+			} `json:"pickup_time"`
+			DropTime struct {
+				Date string `json:"$date"`
+			} `json:"drop_time"`
+		}
+		if err := json.Unmarshal(msg.Value, &doc); err != nil {
+			t.Fatal(err)
+		}
+		at := doc.PickupTime.Date
+		if doc.Event == "dropoff" {
+			at = doc.DropTime.Date
+		} else if doc.Event == "pickup" {
+			pickups++
+		} else {
+			t.Fatalf("unexpected event %s", msg.Value)
+		}
+		ts, err := time.Parse("2006-01-02T15:04:05.000Z", at)
+		if err != nil || ts.Before(last) {
+			t.Fatalf("event out of order at %s: %s", last, msg.Value)
+		}
+		last = ts
+	}
+	if pickups != good {
+		t.Fatalf("expected %d pickups, got %d", good, pickups)
+	}
+	if s := m.recordManager.Stats(); s.Written != int64(good) || s.FailedWrites != 0 {
+		t.Fatalf("expected %d rides written, got stats %+v", good, s)
+	}
+
+	m, _ = newTestMain(dir, srv.add("/yellow_tripdata_2015-02.csv", yellow.content, false))
+	m.importer = nil
+	m.ParquetDir = dir
+	m.Replay = NewReplay(0)
+	m.Replay.Events = true
+	if err := m.Run(); err == nil {
+		t.Fatalf("expected Parquet to be refused for events")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryQueue hands out sources to fetch goroutines and takes back the ones
+// that failed. A failed source is handed out again after a delay that grows
+// with each attempt, until it has failed MaxAttempts times. Sources that fail
+// for good are kept so they can be reported at the end of the run.
+//
+// A RetryQueue reads from a single source channel; Next must always be called
+// with the same one.
+type RetryQueue struct {
+	// MaxAttempts is the number of times a source is tried before it is
+	// given up on.
+	MaxAttempts int
+	// Delay is the wait before the first retry of a source, and is
+	// multiplied by the attempt number for later ones.
+	Delay time.Duration
+
+	mu       sync.Mutex
+	closed   bool
+	inFlight int
+	attempts map[string]int
+	pending  []retry
+	failed   []FailedSource
+	// changed is closed and replaced whenever a source is finished.
+	changed chan struct{}
+}
+
+type retry struct {
+	src       Source
+	notBefore time.Time
+}
+
+// FailedSource is a source that could not be imported.
+type FailedSource struct {
+	Source   Source
+	Attempts int
+	Err      error
+}
+
+// permanentError is a failure that retrying will not fix.
+type permanentError struct {
+	error
+}
+
+// permanent marks err as not worth retrying.
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// NewRetryQueue returns a RetryQueue that tries each source up to
+// maxAttempts times.
+func NewRetryQueue(maxAttempts int, delay time.Duration) *RetryQueue {
+	return &RetryQueue{
+		MaxAttempts: maxAttempts,
+		Delay:       delay,
+		attempts:    make(map[string]int),
+		changed:     make(chan struct{}),
+	}
+}
+
+// Next returns the next source to fetch, preferring retries that are due
+// over new sources. Once sources is closed it waits for outstanding retries
+// and for sources still being fetched, since those may fail and need another
+// attempt. It returns false when there is nothing left to do. Every source
+// returned must be passed to Done or Fail.
+func (q *RetryQueue) Next(sources <-chan Source) (Source, bool) {
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		wait := time.Duration(-1)
+		for i, r := range q.pending {
+			if !r.notBefore.After(now) {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				q.inFlight++
+				q.mu.Unlock()
+				return r.src, true
+			}
+			if d := r.notBefore.Sub(now); wait < 0 || d < wait {
+				wait = d
+			}
+		}
+		if q.closed && len(q.pending) == 0 && q.inFlight == 0 {
+			q.mu.Unlock()
+			return Source{}, false
+		}
+		in := sources
+		if q.closed {
+			in = nil
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		select {
+		case src, ok := <-in:
+			q.mu.Lock()
+			if ok {
+				q.inFlight++
+			} else {
+				q.closed = true
+			}
+			q.mu.Unlock()
+			if ok {
+				if timer != nil {
+					timer.Stop()
+				}
+				return src, true
+			}
+		case <-due:
+		case <-changed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Done marks src as successfully fetched.
+func (q *RetryQueue) Done(src Source) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.attempts, src.URL)
+	q.finish()
+}
+
+// Fail records a failed attempt at src, scheduling a retry unless it has
+// used up its attempts or err is permanent. It returns true if src will be
+// retried.
+func (q *RetryQueue) Fail(src Source, err error) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.finish()
+
+	q.attempts[src.URL]++
+	attempts := q.attempts[src.URL]
+	if _, ok := errors.Cause(err).(permanentError); ok || attempts >= q.MaxAttempts {
+		delete(q.attempts, src.URL)
+		q.failed = append(q.failed, FailedSource{Source: src, Attempts: attempts, Err: err})
+		return false
+	}
+	q.pending = append(q.pending, retry{
+		src:       src,
+		notBefore: time.Now().Add(q.Delay * time.Duration(attempts)),
+	})
+	return true
+}
+
+// finish wakes up goroutines waiting in Next. q.mu must be held.
+func (q *RetryQueue) finish() {
+	q.inFlight--
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Failed returns the sources that were given up on.
+func (q *RetryQueue) Failed() []FailedSource {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	failed := make([]FailedSource, len(q.failed))
+	copy(failed, q.failed)
+	return failed
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryQueue(t *testing.T) {
+	q := NewRetryQueue(3, time.Millisecond)
+	sources := make(chan Source, 4)
+	for _, url := range []string{"flaky", "broken", "missing", "fine"} {
+		sources <- Source{URL: url}
+	}
+	close(sources)
+
+	var mu sync.Mutex
+	tries := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				src, ok := q.Next(sources)
+				if !ok {
+					return
+				}
+				mu.Lock()
+				tries[src.URL]++
+				n := tries[src.URL]
+				mu.Unlock()
+				switch {
+				case src.URL == "flaky" && n < 3, src.URL == "broken":
+					q.Fail(src, errors.New("connection reset"))
+				case src.URL == "missing":
+					q.Fail(src, permanent(errors.New("no such file")))
+				default:
+					q.Done(src)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	expected := map[string]int{"flaky": 3, "broken": 3, "missing": 1, "fine": 1}
+	for url, n := range expected {
+		if tries[url] != n {
+			t.Errorf("expected %d tries of %s, got %d", n, url, tries[url])
+		}
+	}
+	failed := q.Failed()
+	if len(failed) != 2 {
+		t.Fatalf("expected 2 failed sources, got %v", failed)
+	}
+	for _, f := range failed {
+		if f.Source.URL == "broken" && f.Attempts != 3 || f.Source.URL == "missing" && f.Attempts != 1 {
+			t.Errorf("unexpected failure %v", f)
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail every request until the fetcher's own retries run out once
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("VendorID,tpep_pickup_datetime,tpep_dropoff_datetime,passenger_count,trip_distance,pickup_longitude,pickup_latitude,RateCodeID,store_and_fwd_flag,dropoff_longitude,dropoff_latitude,payment_type,fare_amount,extra,mta_tax,tip_amount,tolls_amount,improvement_surcharge,total_amount\n" +
+			"2,2015-01-15 19:05:39,2015-01-15 19:23:42,1,1.59,-73.993896484375,40.750110626220703,1,N,-73.974784851074219,40.750617980957031,1,12,1,0.5,3.25,0,0.3,17.05\n"))
+	}))
+	defer ts.Close()
+
+	rm := NewRecordManager()
+	rm.HTTP = testHTTPFetcher()
+	rm.HTTP.MaxRetries = 1
+	rm.Retries = NewRetryQueue(3, time.Millisecond)
+
+	sources := make(chan Source, 2)
+	records := make(chan []Record, 10)
+	sources <- Source{URL: ts.URL + "/yellow_tripdata_2015-01.csv"}
+	sources <- Source{URL: "/does/not/exist/yellow_tripdata_2015-01.csv"}
+	close(sources)
+	rm.fetch(sources, records)
+	close(records)
+
+	if batch := <-records; len(batch) != 1 || len(records) != 0 {
+		t.Fatalf("expected 1 record, got %v", batch)
+	}
+	failed := rm.Retries.Failed()
+	if len(failed) != 1 || failed[0].Source.URL != "/does/not/exist/yellow_tripdata_2015-01.csv" || failed[0].Attempts != 1 {
+		t.Fatalf("expected the missing file to fail once, got %v", failed)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var green2015Fields = map[string]int{
+	"vendor_id":             0,
+	"pickup_datetime":       1,
+	"dropoff_datetime":      2,
+	"passenger_count":       9,
+	"trip_distance":         10,
+	"pickup_longitude":      5,
+	"pickup_latitude":       6,
+	"ratecode_id":           4,
+	"store_and_fwd_flag":    3,
+	"dropoff_longitude":     7,
+	"dropoff_latitude":      8,
+	"payment_type":          19,
+	"fare_amount":           11,
+	"extra":                 12,
+	"mta_tax":               13,
+	"tip_amount":            14,
+	"tolls_amount":          15,
+	"improvement_surcharge": 17,
+	"total_amount":          18,
+}
+
+var yellow2009Fields = map[string]int{
+	"vendor_id":          0,
+	"pickup_datetime":    1,
+	"dropoff_datetime":   2,
+	"passenger_count":    3,
+	"trip_distance":      4,
+	"pickup_longitude":   5,
+	"pickup_latitude":    6,
+	"ratecode_id":        7,
+	"store_and_fwd_flag": 8,
+	"dropoff_longitude":  9,
+	"dropoff_latitude":   10,
+	"payment_type":       11,
+	"fare_amount":        12,
+	"extra":              13,
+	"mta_tax":            14,
+	"tip_amount":         15,
+	"tolls_amount":       16,
+	"total_amount":       17,
+}
+
+// Schema describes the column layout of one generation of trip data files.
+type Schema struct {
+	// Name is the first year the layout was published in.
+	Name string
+	Type rune
+	// Columns is the number of columns in the header line.
+	Columns int
+	Fields  map[string]int
+	// Header is the header line of files published in this layout.
+	Header string
+
+	layout rideLayout
+}
+
+func (s *Schema) String() string {
+	return fmt.Sprintf("%s-%s", cabTypeName(s.Type), s.Name)
+}
+
+var (
+	green2013Schema = &Schema{Name: "2013", Type: 'g', Columns: 20, Fields: greenFields,
+		Header: "VendorID,lpep_pickup_datetime,Lpep_dropoff_datetime,Store_and_fwd_flag,RateCodeID,Pickup_longitude,Pickup_latitude,Dropoff_longitude,Dropoff_latitude,Passenger_count,Trip_distance,Fare_amount,Extra,MTA_tax,Tip_amount,Tolls_amount,Ehail_fee,Total_amount,Payment_type,Trip_type "}
+	green2015Schema = &Schema{Name: "2015", Type: 'g', Columns: 21, Fields: green2015Fields,
+		Header: "VendorID,lpep_pickup_datetime,Lpep_dropoff_datetime,Store_and_fwd_flag,RateCodeID,Pickup_longitude,Pickup_latitude,Dropoff_longitude,Dropoff_latitude,Passenger_count,Trip_distance,Fare_amount,Extra,MTA_tax,Tip_amount,Tolls_amount,Ehail_fee,improvement_surcharge,Total_amount,Payment_type,Trip_type "}
+	yellow2009Schema = &Schema{Name: "2009", Type: 'y', Columns: 18, Fields: yellow2009Fields,
+		Header: "vendor_name,Trip_Pickup_DateTime,Trip_Dropoff_DateTime,Passenger_Count,Trip_Distance,Start_Lon,Start_Lat,Rate_Code,store_and_forward,End_Lon,End_Lat,Payment_Type,Fare_Amt,surcharge,mta_tax,Tip_Amt,Tolls_Amt,Total_Amt"}
+	yellow2015Schema = &Schema{Name: "2015", Type: 'y', Columns: 19, Fields: yellowFields,
+		Header: "VendorID,tpep_pickup_datetime,tpep_dropoff_datetime,passenger_count,trip_distance,pickup_longitude,pickup_latitude,RateCodeID,store_and_fwd_flag,dropoff_longitude,dropoff_latitude,payment_type,fare_amount,extra,mta_tax,tip_amount,tolls_amount,improvement_surcharge,total_amount"}
+)
+
+// schemas lists the known layouts, oldest first within each cab type.
+var schemas = []*Schema{green2013Schema, green2015Schema, yellow2009Schema, yellow2015Schema}
+
+// defaultSchema returns the layout assumed for records of typ when nothing
+// else is known about them.
+func defaultSchema(typ rune) *Schema {
+	switch typ {
+	case 'g':
+		return green2013Schema
+	case 'y':
+		return yellow2015Schema
+	}
+	return nil
+}
+
+// lookupSchema returns the layout in use for cab type typ in the given year,
+// so "2014" finds the yellow layout introduced in 2009.
+func lookupSchema(typ rune, year string) (*Schema, error) {
+	y, err := strconv.Atoi(year)
+	if err != nil {
+		return nil, fmt.Errorf("bad schema %q, expected a year", year)
+	}
+	var found *Schema
+	for _, s := range schemas {
+		first, _ := strconv.Atoi(s.Name)
+		if s.Type == typ && first <= y {
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no %s schema for %s, known schemas: %s", cabTypeName(typ), year, schemaNames())
+	}
+	return found, nil
+}
+
+// checkHeader returns the schema describing a file of cab type typ with the
+// given header line. If schema is not nil, it is checked against the header
+// instead of being inferred from it.
+func checkHeader(typ rune, schema *Schema, header string) (*Schema, error) {
+	lower := strings.ToLower(header)
+	if typ == 'y' && strings.Contains(lower, "lpep_") {
+		return nil, fmt.Errorf("header looks like a green cab file: %s", header)
+	}
+	if typ == 'g' && strings.Contains(lower, "tpep_") {
+		return nil, fmt.Errorf("header looks like a yellow cab file: %s", header)
+	}
+
+	columns := len(strings.Split(strings.TrimRight(header, ", \r"), ","))
+	if schema != nil {
+		if schema.Type != typ {
+			return nil, fmt.Errorf("schema %v does not apply to %s cabs", schema, cabTypeName(typ))
+		}
+		if schema.Columns != columns {
+			return nil, fmt.Errorf("schema %v expects %d columns, header has %d", schema, schema.Columns, columns)
+		}
+		return schema, nil
+	}
+	for _, s := range schemas {
+		if s.Type == typ && s.Columns == columns {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s schema with %d columns", cabTypeName(typ), columns)
+}
+
+func parseCabType(name string) (rune, error) {
+	switch strings.ToLower(name) {
+	case "green", "g":
+		return 'g', nil
+	case "yellow", "y":
+		return 'y', nil
+	}
+	return 0, fmt.Errorf("unknown cab type %q", name)
+}
+
+func cabTypeName(typ rune) string {
+	switch typ {
+	case 'g':
+		return "green"
+	case 'y':
+		return "yellow"
+	}
+	return "unknown"
+}
+
+// guessCabType derives the cab type from a url, for sources that don't
+// declare one.
+func guessCabType(url string) rune {
+	if strings.Contains(url, "green") {
+		return 'g'
+	} else if strings.Contains(url, "yellow") {
+		return 'y'
+	}
+	return 'x'
+}
+
+// schemaNames lists the known schemas, for error messages.
+func schemaNames() string {
+	names := make([]string, 0, len(schemas))
+	for _, s := range schemas {
+		names = append(names, s.String())
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// monthRange matches a month range template like {2009-01..2015-12}
+var monthRange = regexp.MustCompile(`\{(\d{4}-\d{2})\.\.(\d{4}-\d{2})\}`)
+
+// Source is a url or file to import, along with what is known about its
+// contents.
+type Source struct {
+	URL string
+	// Type is the cab type, 'g' or 'y'. If it is 0, it is guessed from URL.
+	Type rune
+	// Schema is the column layout. If it is nil, it is inferred from the
+	// header line.
+	Schema *Schema
+	// IDs, if set, are the Pilosa columns reserved for the rides in the
+	// source.
+	IDs *ColumnRange
+}
+
+func (s Source) String() string {
+	return s.URL
+}
+
+// readSourceFile reads a list of sources from a file, one per line. Blank
+// lines and lines starting with # are skipped, every other line is parsed
+// with parseSourceLine.
+func readSourceFile(path string) ([]Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sources := make([]Source, 0)
+	s := bufio.NewScanner(f)
+	line := 0
+	for s.Scan() {
+		line++
+		spec := strings.TrimSpace(s.Text())
+		if spec == "" || strings.HasPrefix(spec, "#") {
+			continue
+		}
+		expanded, err := parseSourceLine(spec)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("%s:%d", path, line))
+		}
+		sources = append(sources, expanded...)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// parseSourceLine parses a source specification, optionally annotated with
+// metadata, e.g.
+//
+//	type=yellow schema=2014 ids=0-99999999 url=/data/yellow_tripdata_2014-*.csv
+//
+// type is green or yellow, and schema is a year whose column layout the
+// files follow. ids is an inclusive range of Pilosa column ids, divided
+// evenly among the files the spec expands to, in order. A line without any
+// key=value pairs is a plain spec. The spec is expanded with expandSource
+// and the metadata applies to every result.
+func parseSourceLine(line string) ([]Source, error) {
+	var src Source
+	var schema string
+	var ids *ColumnRange
+	var specs []string
+	annotated := false
+	for _, tok := range strings.Fields(line) {
+		kv := strings.SplitN(tok, "=", 2)
+		if len(kv) != 2 {
+			specs = append(specs, tok)
+			continue
+		}
+		switch kv[0] {
+		case "type":
+			typ, err := parseCabType(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			src.Type = typ
+		case "schema":
+			schema = kv[1]
+		case "ids":
+			var err error
+			ids, err = parseColumnRange(kv[1])
+			if err != nil {
+				return nil, err
+			}
+		case "url":
+			specs = append(specs, kv[1])
+		default:
+			specs = append(specs, tok)
+			continue
+		}
+		annotated = true
+	}
+	if !annotated {
+		specs = []string{line}
+	}
+	if len(specs) != 1 {
+		return nil, fmt.Errorf("need exactly one url in %q", line)
+	}
+	spec := specs[0]
+	if schema != "" {
+		if src.Type == 0 {
+			return nil, fmt.Errorf("schema needs a type in %q", line)
+		}
+		var err error
+		src.Schema, err = lookupSchema(src.Type, schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	urls, err := expandSource(spec)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []*ColumnRange
+	if ids != nil {
+		ranges, err = ids.split(len(urls))
+		if err != nil {
+			return nil, err
+		}
+	}
+	sources := make([]Source, 0, len(urls))
+	for i, url := range urls {
+		src.URL = url
+		if ranges != nil {
+			src.IDs = ranges[i]
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// expandSource turns a single source specification into the urls or file
+// paths it stands for. A spec may be
+//   - a url or file path, returned as is
+//   - a template with a month range, e.g. yellow_tripdata_{2009-01..2015-12}.csv
+//   - a local directory, expanded to the regular files in it
+//   - a glob, e.g. /data/yellow_*.csv.gz
+func expandSource(spec string) ([]string, error) {
+	if monthRange.MatchString(spec) {
+		return expandMonthRange(spec)
+	}
+	if isRemote(spec) {
+		return []string{spec}, nil
+	}
+	if strings.ContainsAny(spec, "*?[") {
+		matches, err := filepath.Glob(spec)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("bad glob %s", spec))
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("glob %s matched no files", spec)
+		}
+		return matches, nil
+	}
+	info, err := os.Stat(spec)
+	if err == nil && info.IsDir() {
+		return readSourceDir(spec)
+	}
+	return []string{spec}, nil
+}
+
+// expandMonthRange expands the first month range in spec into one entry per
+// month, inclusive on both ends. Each result is expanded again so further
+// ranges or globs in spec are honored.
+func expandMonthRange(spec string) ([]string, error) {
+	loc := monthRange.FindStringSubmatchIndex(spec)
+	from, err := time.Parse("2006-01", spec[loc[2]:loc[3]])
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("bad month range in %s", spec))
+	}
+	to, err := time.Parse("2006-01", spec[loc[4]:loc[5]])
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("bad month range in %s", spec))
+	}
+	if to.Before(from) {
+		return nil, fmt.Errorf("month range in %s ends before it starts", spec)
+	}
+
+	urls := make([]string, 0)
+	for month := from; !month.After(to); month = month.AddDate(0, 1, 0) {
+		expanded, err := expandSource(spec[:loc[0]] + month.Format("2006-01") + spec[loc[1]:])
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, expanded...)
+	}
+	return urls, nil
+}
+
+// readSourceDir lists the regular files in dir, sorted by name. Hidden files
+// are ignored.
+func readSourceDir(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		urls = append(urls, filepath.Join(dir, info.Name()))
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+func isRemote(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandMonthRange(t *testing.T) {
+	urls, err := expandSource("https://s3.amazonaws.com/nyc-tlc/trip+data/yellow_tripdata_{2015-11..2016-02}.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"https://s3.amazonaws.com/nyc-tlc/trip+data/yellow_tripdata_2015-11.csv",
+		"https://s3.amazonaws.com/nyc-tlc/trip+data/yellow_tripdata_2015-12.csv",
+		"https://s3.amazonaws.com/nyc-tlc/trip+data/yellow_tripdata_2016-01.csv",
+		"https://s3.amazonaws.com/nyc-tlc/trip+data/yellow_tripdata_2016-02.csv",
+	}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("unexpected expansion: %v", urls)
+	}
+
+	if _, err := expandSource("yellow_tripdata_{2016-02..2015-11}.csv"); err == nil {
+		t.Fatalf("backwards month range should fail")
+	}
+}
+
+func TestReadSourceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"yellow_tripdata_2009-01.csv", "yellow_tripdata_2009-02.csv", "green_tripdata_2013-08.csv", ".hidden"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub := filepath.Join(dir, "green")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sub, "green_tripdata_2013-09.csv"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := filepath.Join(dir, "sources.txt")
+	content := "# local copies\n\n" +
+		filepath.Join(dir, "yellow_*.csv") + "\n" +
+		"  # indented comment\n" +
+		sub + "\n" +
+		"https://s3.amazonaws.com/nyc-tlc/trip+data/green_tripdata_{2013-08..2013-09}.csv\n"
+	if err := ioutil.WriteFile(manifest, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := readSourceFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := make([]string, 0, len(sources))
+	for _, src := range sources {
+		urls = append(urls, src.URL)
+	}
+	expected := []string{
+		filepath.Join(dir, "yellow_tripdata_2009-01.csv"),
+		filepath.Join(dir, "yellow_tripdata_2009-02.csv"),
+		filepath.Join(sub, "green_tripdata_2013-09.csv"),
+		"https://s3.amazonaws.com/nyc-tlc/trip+data/green_tripdata_2013-08.csv",
+		"https://s3.amazonaws.com/nyc-tlc/trip+data/green_tripdata_2013-09.csv",
+	}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("unexpected sources: %v", urls)
+	}
+}
+
+func TestReadURLFiles(t *testing.T) {
+	urls, err := readSourceFile("greenAndYellowUrls.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 125 {
+		t.Fatalf("expected 125 urls, got %d", len(urls))
+	}
+	urls, err = readSourceFile("urls.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 143 {
+		t.Fatalf("expected 143 urls, got %d", len(urls))
+	}
+}
+
+func TestParseSourceLine(t *testing.T) {
+	sources, err := parseSourceLine("type=yellow schema=2014 url=https://example.com/trips_{2014-11..2014-12}.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 {
+		t.Fatalf("expected 2 sources, got %v", sources)
+	}
+	for _, src := range sources {
+		if src.Type != 'y' || src.Schema != yellow2009Schema {
+			t.Fatalf("unexpected metadata for %v: %c %v", src, src.Type, src.Schema)
+		}
+	}
+
+	sources, err = parseSourceLine("schema=2015 https://example.com/mirror.csv type=green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0].URL != "https://example.com/mirror.csv" || sources[0].Type != 'g' || sources[0].Schema != green2015Schema {
+		t.Fatalf("unexpected sources: %v", sources)
+	}
+
+	sources, err = parseSourceLine("https://example.com/green_tripdata_2013-08.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0].Type != 0 || sources[0].Schema != nil {
+		t.Fatalf("plain url should carry no metadata: %v", sources)
+	}
+
+	for _, line := range []string{
+		"schema=2014 url=https://example.com/a.csv",
+		"type=blue url=https://example.com/a.csv",
+		"type=green schema=2010 url=https://example.com/a.csv",
+		"type=green https://example.com/a.csv https://example.com/b.csv",
+		"ids=10-1 url=https://example.com/a.csv",
+		"ids=0-2 url=https://example.com/trips_{2014-01..2014-12}.csv",
+	} {
+		if _, err := parseSourceLine(line); err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	yellow2009 := "vendor_name,Trip_Pickup_DateTime,Trip_Dropoff_DateTime,Passenger_Count,Trip_Distance,Start_Lon,Start_Lat,Rate_Code,store_and_forward,End_Lon,End_Lat,Payment_Type,Fare_Amt,surcharge,mta_tax,Tip_Amt,Tolls_Amt,Total_Amt"
+	yellow2015 := "VendorID,tpep_pickup_datetime,tpep_dropoff_datetime,passenger_count,trip_distance,pickup_longitude,pickup_latitude,RateCodeID,store_and_fwd_flag,dropoff_longitude,dropoff_latitude,payment_type,fare_amount,extra,mta_tax,tip_amount,tolls_amount,improvement_surcharge,total_amount"
+	green2013 := "VendorID,lpep_pickup_datetime,Lpep_dropoff_datetime,Store_and_fwd_flag,RateCodeID,Pickup_longitude,Pickup_latitude,Dropoff_longitude,Dropoff_latitude,Passenger_count,Trip_distance,Fare_amount,Extra,MTA_tax,Tip_amount,Tolls_amount,Ehail_fee,Total_amount,Payment_type,Trip_type "
+
+	tests := []struct {
+		typ      rune
+		schema   *Schema
+		header   string
+		expected *Schema
+	}{
+		{'y', nil, yellow2009, yellow2009Schema},
+		{'y', nil, yellow2015, yellow2015Schema},
+		{'g', nil, green2013, green2013Schema},
+		{'y', yellow2009Schema, yellow2009, yellow2009Schema},
+		{'y', yellow2015Schema, yellow2009, nil},
+		{'g', green2013Schema, yellow2015, nil},
+		{'y', nil, green2013, nil},
+		{'g', yellow2009Schema, green2013, nil},
+	}
+	for i, test := range tests {
+		schema, err := checkHeader(test.typ, test.schema, test.header)
+		if schema != test.expected {
+			t.Errorf("test %d: expected %v, got %v, err: %v", i, test.expected, schema, err)
+		}
+		if test.expected == nil && err == nil {
+			t.Errorf("test %d: expected error", i)
+		}
+	}
+}